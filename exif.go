@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Just enough EXIF to get where and when a photo was taken. The EXIF data is a
+// TIFF structure, found in an APP1 segment in JPEGs and as an item in the meta
+// box of HEIC/HEIF files.
+
+// IFD pointers and the tags we read
+const (
+	exifTagExifIFD = 0x8769
+	exifTagGPSIFD  = 0x8825
+
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTime         = 0x9010
+	exifTagOffsetTimeOriginal = 0x9011
+
+	gpsTagLatitudeRef       = 0x0001
+	gpsTagLatitude          = 0x0002
+	gpsTagLongitudeRef      = 0x0003
+	gpsTagLongitude         = 0x0004
+	gpsTagAltitudeRef       = 0x0005
+	gpsTagAltitude          = 0x0006
+	gpsTagTimeStamp         = 0x0007
+	gpsTagSpeedRef          = 0x000c
+	gpsTagSpeed             = 0x000d
+	gpsTagTrack             = 0x000f
+	gpsTagDateStamp         = 0x001d
+	gpsTagHPositioningError = 0x001f
+)
+
+// field types
+const (
+	exifTypeByte      = 1
+	exifTypeASCII     = 2
+	exifTypeShort     = 3
+	exifTypeLong      = 4
+	exifTypeRational  = 5
+	exifTypeUndefined = 7
+	exifTypeSLong     = 9
+	exifTypeSRational = 10
+)
+
+// exifMaxIFDEntries guards against reading garbage as an IFD
+const exifMaxIFDEntries = 1000
+
+var exifTypeSizes = map[uint16]int{
+	exifTypeByte:      1,
+	exifTypeASCII:     1,
+	exifTypeShort:     2,
+	exifTypeLong:      4,
+	exifTypeRational:  8,
+	exifTypeUndefined: 1,
+	exifTypeSLong:     4,
+	exifTypeSRational: 8,
+}
+
+var errNoEXIF = fmt.Errorf("no EXIF data found")
+
+type exifField struct {
+	typ   uint16
+	count uint32
+	data  []byte
+	order binary.ByteOrder
+}
+
+func (f exifField) string() string {
+	return strings.TrimSpace(strings.TrimRight(string(f.data), "\x00"))
+}
+
+func (f exifField) uint() (uint32, bool) {
+	switch {
+	case f.count < 1:
+		return 0, false
+	case f.typ == exifTypeByte || f.typ == exifTypeUndefined:
+		return uint32(f.data[0]), true
+	case f.typ == exifTypeShort:
+		return uint32(f.order.Uint16(f.data)), true
+	case f.typ == exifTypeLong:
+		return f.order.Uint32(f.data), true
+	}
+	return 0, false
+}
+
+// rationals returns the field's values, for RATIONAL or SRATIONAL fields
+func (f exifField) rationals() []float64 {
+	if f.typ != exifTypeRational && f.typ != exifTypeSRational {
+		return nil
+	}
+	var ret []float64
+	for i := 0; i < int(f.count); i++ {
+		num, den := f.order.Uint32(f.data[i*8:]), f.order.Uint32(f.data[i*8+4:])
+		if den == 0 {
+			return nil
+		}
+		if f.typ == exifTypeSRational {
+			ret = append(ret, float64(int32(num))/float64(int32(den)))
+		} else {
+			ret = append(ret, float64(num)/float64(den))
+		}
+	}
+	return ret
+}
+
+// exifData is the fields from the EXIF and GPS IFDs. Both are keyed by tag.
+type exifData struct {
+	exif map[uint16]exifField
+	gps  map[uint16]exifField
+}
+
+// readEXIF finds and parses the EXIF data in a JPEG, HEIC or TIFF file's
+// contents
+func readEXIF(b []byte) (*exifData, error) {
+	var (
+		tiff []byte
+		err  error
+	)
+	switch {
+	case len(b) > 2 && b[0] == 0xff && b[1] == 0xd8:
+		tiff, err = jpegEXIF(b)
+	case len(b) > 12 && string(b[4:8]) == "ftyp":
+		tiff, err = heicEXIF(b)
+	case len(b) > 8 && (string(b[:4]) == "II*\x00" || string(b[:4]) == "MM\x00*"):
+		// TIFF based raw formats, e.g DNG, CR2 and NEF
+		tiff = b
+	default:
+		return nil, fmt.Errorf("unsupported image format")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseTIFF(tiff)
+}
+
+// jpegEXIF returns the TIFF data from the Exif APP1 segment
+func jpegEXIF(b []byte) ([]byte, error) {
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return nil, fmt.Errorf("invalid JPEG marker at %d", i)
+		}
+		marker := b[i+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8):
+			// no length
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// image data follows, metadata is always before it
+			return nil, errNoEXIF
+		}
+		l := int(binary.BigEndian.Uint16(b[i+2:]))
+		if l < 2 || i+2+l > len(b) {
+			return nil, fmt.Errorf("invalid JPEG segment length at %d", i)
+		}
+		seg := b[i+4 : i+2+l]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return seg[6:], nil
+		}
+		i += 2 + l
+	}
+	return nil, errNoEXIF
+}
+
+type isoBox struct {
+	typ  string
+	data []byte // contents, after the header
+}
+
+// isoBoxes splits ISO base media file format data in to its boxes
+func isoBoxes(b []byte) ([]isoBox, error) {
+	var ret []isoBox
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("truncated box")
+		}
+		size := uint64(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, fmt.Errorf("truncated %s box", typ)
+			}
+			size = binary.BigEndian.Uint64(b[8:])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return nil, fmt.Errorf("invalid %s box size %d", typ, size)
+		}
+		ret = append(ret, isoBox{typ: typ, data: b[hdr:size]})
+		b = b[size:]
+	}
+	return ret, nil
+}
+
+// heicEXIF finds the Exif item in the meta box, and returns its TIFF data
+func heicEXIF(b []byte) ([]byte, error) {
+	boxes, err := isoBoxes(b)
+	if err != nil {
+		return nil, err
+	}
+	var meta []byte
+	for _, bx := range boxes {
+		if bx.typ == "meta" {
+			meta = bx.data
+		}
+	}
+	// meta is a full box, with a version and flags before its children
+	if len(meta) < 4 {
+		return nil, errNoEXIF
+	}
+	children, err := isoBoxes(meta[4:])
+	if err != nil {
+		return nil, fmt.Errorf("reading meta box: %v", err)
+	}
+
+	var (
+		exifID uint32
+		found  bool
+		iloc   []byte
+	)
+	for _, bx := range children {
+		switch bx.typ {
+		case "iinf":
+			exifID, found, err = heicEXIFItemID(bx.data)
+			if err != nil {
+				return nil, err
+			}
+		case "iloc":
+			iloc = bx.data
+		}
+	}
+	if !found || iloc == nil {
+		return nil, errNoEXIF
+	}
+
+	off, l, err := heicItemLocation(iloc, exifID)
+	if err != nil {
+		return nil, err
+	}
+	// the location is from the file, so don't let it overflow
+	if off > uint64(len(b)) || l > uint64(len(b))-off || l < 4 {
+		return nil, fmt.Errorf("exif item out of range")
+	}
+	item := b[off : off+l]
+	// the item starts with the offset to the TIFF header, usually skipping
+	// an Exif\0\0 prefix
+	hdrOff := uint64(binary.BigEndian.Uint32(item)) + 4
+	if hdrOff > uint64(len(item)) {
+		return nil, fmt.Errorf("invalid exif item header offset")
+	}
+	return item[hdrOff:], nil
+}
+
+// heicEXIFItemID returns the id of the Exif item, from the item info box
+func heicEXIFItemID(iinf []byte) (uint32, bool, error) {
+	if len(iinf) < 6 {
+		return 0, false, fmt.Errorf("truncated iinf box")
+	}
+	start := 6
+	if iinf[0] > 0 {
+		start = 8
+	}
+	if len(iinf) < start {
+		return 0, false, fmt.Errorf("truncated iinf box")
+	}
+	entries, err := isoBoxes(iinf[start:])
+	if err != nil {
+		return 0, false, fmt.Errorf("reading iinf box: %v", err)
+	}
+	for _, e := range entries {
+		// item info entries from version 2 have the item type
+		if e.typ != "infe" || len(e.data) < 4 || e.data[0] < 2 {
+			continue
+		}
+		d := e.data[4:]
+		var id uint32
+		if e.data[0] == 2 {
+			if len(d) < 8 {
+				continue
+			}
+			id, d = uint32(binary.BigEndian.Uint16(d)), d[2:]
+		} else {
+			if len(d) < 10 {
+				continue
+			}
+			id, d = binary.BigEndian.Uint32(d), d[4:]
+		}
+		// skip the protection index
+		if string(d[2:6]) == "Exif" {
+			return id, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// heicItemLocation returns the offset in the file and length of an item, from
+// the item location box. Only items stored as a single extent in the file are
+// supported, which is how Exif is stored in practice.
+func heicItemLocation(iloc []byte, itemID uint32) (offset, length uint64, _ error) {
+	r := &isoReader{b: iloc}
+	version := r.uint(1)
+	r.uint(3) // flags
+	sizes := r.uint(2)
+	offSize, lenSize, baseSize, idxSize := int(sizes>>12), int(sizes>>8&0xf), int(sizes>>4&0xf), int(sizes&0xf)
+	if version == 0 {
+		idxSize = 0
+	}
+	idSize := 2
+	if version >= 2 {
+		idSize = 4
+	}
+	count := r.uint(idSize)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		id := r.uint(idSize)
+		method := uint64(0)
+		if version >= 1 {
+			method = r.uint(2) & 0xf
+		}
+		r.uint(2) // data reference index
+		base := r.uint(baseSize)
+		extents := r.uint(2)
+		for e := uint64(0); e < extents && r.err == nil; e++ {
+			r.uint(idxSize)
+			off := r.uint(offSize)
+			l := r.uint(lenSize)
+			if uint32(id) != itemID || r.err != nil {
+				continue
+			}
+			if method != 0 || extents != 1 {
+				return 0, 0, fmt.Errorf("unsupported exif item storage")
+			}
+			if off > math.MaxUint64-base {
+				return 0, 0, fmt.Errorf("exif item offset out of range")
+			}
+			return base + off, l, nil
+		}
+	}
+	if r.err != nil {
+		return 0, 0, fmt.Errorf("reading iloc box: %v", r.err)
+	}
+	return 0, 0, errNoEXIF
+}
+
+// isoReader reads big endian integers of various sizes, recording the first
+// error
+type isoReader struct {
+	b   []byte
+	err error
+}
+
+func (r *isoReader) uint(size int) uint64 {
+	if r.err != nil || size == 0 {
+		return 0
+	}
+	if size > 8 || len(r.b) < size {
+		r.err = fmt.Errorf("truncated")
+		return 0
+	}
+	var v uint64
+	for _, c := range r.b[:size] {
+		v = v<<8 | uint64(c)
+	}
+	r.b = r.b[size:]
+	return v
+}
+
+// parseTIFF reads the EXIF and GPS IFDs, that IFD0 points to
+func parseTIFF(b []byte) (*exifData, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("truncated TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid TIFF byte order")
+	}
+	if order.Uint16(b[2:]) != 42 {
+		return nil, fmt.Errorf("invalid TIFF header")
+	}
+
+	ifd0, err := readIFD(b, order, order.Uint32(b[4:]))
+	if err != nil {
+		return nil, fmt.Errorf("reading IFD0: %v", err)
+	}
+	ret := &exifData{exif: map[uint16]exifField{}, gps: map[uint16]exifField{}}
+	if f, ok := ifd0[exifTagExifIFD]; ok {
+		off, _ := f.uint()
+		if ret.exif, err = readIFD(b, order, off); err != nil {
+			return nil, fmt.Errorf("reading EXIF IFD: %v", err)
+		}
+	}
+	if f, ok := ifd0[exifTagGPSIFD]; ok {
+		off, _ := f.uint()
+		if ret.gps, err = readIFD(b, order, off); err != nil {
+			return nil, fmt.Errorf("reading GPS IFD: %v", err)
+		}
+	}
+	return ret, nil
+}
+
+func readIFD(b []byte, order binary.ByteOrder, off uint32) (map[uint16]exifField, error) {
+	if uint64(off)+2 > uint64(len(b)) {
+		return nil, fmt.Errorf("offset %d out of range", off)
+	}
+	n := int(order.Uint16(b[off:]))
+	if n > exifMaxIFDEntries || int(off)+2+n*12 > len(b) {
+		return nil, fmt.Errorf("invalid entry count %d", n)
+	}
+	ret := map[uint16]exifField{}
+	for i := 0; i < n; i++ {
+		e := b[int(off)+2+i*12:]
+		f := exifField{
+			typ:   order.Uint16(e[2:]),
+			count: order.Uint32(e[4:]),
+			order: order,
+		}
+		size, ok := exifTypeSizes[f.typ]
+		if !ok {
+			continue
+		}
+		l := uint64(size) * uint64(f.count)
+		// values that fit in 4 bytes are stored in the entry, otherwise it
+		// has the offset to them
+		if l <= 4 {
+			f.data = e[8 : 8+l]
+		} else {
+			vo := uint64(order.Uint32(e[8:]))
+			if vo+l > uint64(len(b)) {
+				continue
+			}
+			f.data = b[vo : vo+l]
+		}
+		ret[order.Uint16(e)] = f
+	}
+	return ret, nil
+}
+
+// latLng returns the photo's GPS position, if it has one
+func (e *exifData) latLng() (lat, lng float64, ok bool) {
+	la, lo := e.gps[gpsTagLatitude].rationals(), e.gps[gpsTagLongitude].rationals()
+	if len(la) != 3 || len(lo) != 3 {
+		return 0, 0, false
+	}
+	lat = la[0] + la[1]/60 + la[2]/3600
+	lng = lo[0] + lo[1]/60 + lo[2]/3600
+	if strings.EqualFold(e.gps[gpsTagLatitudeRef].string(), "S") {
+		lat = -lat
+	}
+	if strings.EqualFold(e.gps[gpsTagLongitudeRef].string(), "W") {
+		lng = -lng
+	}
+	return lat, lng, true
+}
+
+// altitude is in metres, negative below sea level
+func (e *exifData) altitude() *float64 {
+	a := e.gps[gpsTagAltitude].rationals()
+	if len(a) != 1 {
+		return nil
+	}
+	alt := a[0]
+	if ref, _ := e.gps[gpsTagAltitudeRef].uint(); ref == 1 {
+		alt = -alt
+	}
+	return &alt
+}
+
+// speed is in km/h
+func (e *exifData) speed() *float64 {
+	s := e.gps[gpsTagSpeed].rationals()
+	if len(s) != 1 {
+		return nil
+	}
+	v := s[0]
+	switch strings.ToUpper(e.gps[gpsTagSpeedRef].string()) {
+	case "M":
+		v *= 1.609344
+	case "N":
+		v *= 1.852
+	}
+	return &v
+}
+
+// course is the direction of travel in degrees
+func (e *exifData) course() *float64 {
+	return e.gpsSingle(gpsTagTrack)
+}
+
+// accuracy is the horizontal positioning error in metres
+func (e *exifData) accuracy() *float64 {
+	return e.gpsSingle(gpsTagHPositioningError)
+}
+
+func (e *exifData) gpsSingle(tag uint16) *float64 {
+	v := e.gps[tag].rationals()
+	if len(v) != 1 || math.IsNaN(v[0]) {
+		return nil
+	}
+	return &v[0]
+}
+
+// takenAt returns when the photo was taken. DateTimeOriginal has no zone, so
+// the offset is used if it was recorded, otherwise the GPS time (which is UTC).
+// If neither is available the time is treated as being in loc.
+func (e *exifData) takenAt(loc *time.Location) (time.Time, error) {
+	dto := e.exif[exifTagDateTimeOriginal].string()
+	if dto != "" {
+		for _, tag := range []uint16{exifTagOffsetTimeOriginal, exifTagOffsetTime} {
+			if off := e.exif[tag].string(); off != "" {
+				ts, err := time.Parse("2006:01:02 15:04:05-07:00", dto+off)
+				if err != nil {
+					return time.Time{}, fmt.Errorf("parsing DateTimeOriginal %q with offset %q: %v", dto, off, err)
+				}
+				return ts, nil
+			}
+		}
+	}
+	if gt, ok := e.gpsTime(); ok {
+		return gt, nil
+	}
+	if dto == "" {
+		return time.Time{}, fmt.Errorf("no DateTimeOriginal or GPS time")
+	}
+	ts, err := time.ParseInLocation("2006:01:02 15:04:05", dto, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing DateTimeOriginal %q: %v", dto, err)
+	}
+	return ts, nil
+}
+
+// gpsTime is the UTC time of the GPS fix
+func (e *exifData) gpsTime() (time.Time, bool) {
+	ds := e.gps[gpsTagDateStamp].string()
+	hms := e.gps[gpsTagTimeStamp].rationals()
+	if ds == "" || len(hms) != 3 {
+		return time.Time{}, false
+	}
+	d, err := time.Parse("2006:01:02", ds)
+	if err != nil {
+		return time.Time{}, false
+	}
+	secs := hms[0]*3600 + hms[1]*60 + hms[2]
+	return d.Add(time.Duration(secs * float64(time.Second))).Truncate(time.Second), true
+}
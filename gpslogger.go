@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// gpsloggerServer handles locations sent by GPSLogger for Android's custom URL
+// logging. Each request is a single location, using GPSLogger's standard field
+// names as query or form parameters, or as a JSON object.
+//
+// https://gpslogger.app/#customurl
+type gpsloggerServer struct {
+	log   logger
+	store deviceLocationStore
+}
+
+func (g *gpsloggerServer) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := gpsloggerFields(r)
+	if err != nil {
+		metricGPSLoggerSubmitErrorCount.Inc()
+		g.log.Printf("reading gpslogger request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, device := gpsloggerPublishDevice(r, fields)
+	if user == "" || device == "" {
+		metricGPSLoggerSubmitErrorCount.Inc()
+		g.log.Print("can't identify the device for gpslogger location")
+		http.Error(w, "device could not be identified, use device credentials or send ser", http.StatusBadRequest)
+		return
+	}
+
+	loc, err := parseGPSLoggerLocation(fields)
+	if err != nil {
+		metricGPSLoggerSubmitErrorCount.Inc()
+		g.log.Printf("parsing gpslogger location (%s): %v", fields.Encode(), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dups, err := g.store.AddDeviceLocations(r.Context(), user, device, []newDeviceLocation{loc})
+	if err != nil {
+		metricGPSLoggerSubmitErrorCount.Inc()
+		g.log.Printf("persisting gpslogger location: %v", err)
+		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if dups > 0 {
+		g.log.Printf("skipped already stored location from gpslogger %s/%s", user, device)
+	}
+
+	metricGPSLoggerSubmitSuccessCount.Inc()
+}
+
+// gpsloggerFields returns the fields sent in the request. JSON bodies are
+// flattened in to the same form as query and form parameters.
+func gpsloggerFields(r *http.Request) (url.Values, error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != http.MethodPost || ct != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.Form, nil
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %v", err)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, fmt.Errorf("decoding body: %v", err)
+	}
+
+	ret := r.URL.Query()
+	for k, v := range body {
+		switch v := v.(type) {
+		case string:
+			ret.Set(k, v)
+		case float64:
+			ret.Set(k, strconv.FormatFloat(v, 'f', -1, 64))
+		case nil:
+		default:
+			return nil, fmt.Errorf("field %s has unsupported type %T", k, v)
+		}
+	}
+	return ret, nil
+}
+
+// gpsloggerPublishDevice identifies the device a location is from. The
+// device's own credentials are authoritative, otherwise it's the basic auth
+// user and the device's serial number.
+func gpsloggerPublishDevice(r *http.Request, fields url.Values) (user, device string) {
+	if d := authenticatedDevice(r.Context()); d != nil {
+		return d.User, d.Name
+	}
+	user, _, _ = r.BasicAuth()
+	return user, fields.Get("ser")
+}
+
+// parseGPSLoggerLocation converts GPSLogger's fields to a location
+func parseGPSLoggerLocation(v url.Values) (newDeviceLocation, error) {
+	loc := newDeviceLocation{
+		Source: sourceGPSLogger,
+		Raw:    []byte(v.Encode()),
+	}
+
+	var err error
+	if loc.Lat, err = strconv.ParseFloat(v.Get("lat"), 64); err != nil {
+		return newDeviceLocation{}, fmt.Errorf("invalid lat %q", v.Get("lat"))
+	}
+	if loc.Lng, err = strconv.ParseFloat(v.Get("lon"), 64); err != nil {
+		return newDeviceLocation{}, fmt.Errorf("invalid lon %q", v.Get("lon"))
+	}
+	if err := validLatLng(loc.Lat, loc.Lng); err != nil {
+		return newDeviceLocation{}, err
+	}
+
+	switch {
+	case v.Get("time") != "":
+		if loc.Timestamp, err = time.Parse(time.RFC3339, v.Get("time")); err != nil {
+			return newDeviceLocation{}, fmt.Errorf("invalid time %q", v.Get("time"))
+		}
+		loc.Timestamp = loc.Timestamp.UTC()
+	case v.Get("timestamp") != "":
+		ts, err := strconv.ParseInt(v.Get("timestamp"), 10, 64)
+		if err != nil {
+			return newDeviceLocation{}, fmt.Errorf("invalid timestamp %q", v.Get("timestamp"))
+		}
+		loc.Timestamp = time.Unix(ts, 0).UTC()
+	default:
+		return newDeviceLocation{}, fmt.Errorf("time is required")
+	}
+
+	if err := parseMeasurementParams(v, []measurementParam{
+		// metres/second
+		{param: "spd", scale: 3.6, known: true, dest: &loc.Velocity},
+		{param: "dir", scale: 1, known: true, dest: &loc.CourseOverGround},
+		{param: "alt", scale: 1, dest: &loc.Altitude},
+		{param: "acc", scale: 1, known: true, dest: &loc.Accuracy},
+		{param: "batt", scale: 1, known: true, dest: &loc.Batt},
+	}); err != nil {
+		return newDeviceLocation{}, err
+	}
+
+	return loc, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGPSLoggerHandlePublish(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	gls := &gpsloggerServer{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		store: s,
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "lat=-33.8688&lon=151.2093&time=2020-06-20T22:15:00.000Z&acc=8.5&alt=40&spd=10&dir=180&batt=55&ser=ABC123",
+		},
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"lat":-33.87,"lon":151.21,"time":"2020-06-21T08:16:00.000+10:00","acc":9,"alt":41,"spd":"0","dir":"","batt":54,"ser":"ABC123"}`,
+		},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/gpslogger", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		req.SetBasicAuth("jane", "pw")
+		rec := httptest.NewRecorder()
+		gls.HandlePublish(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: want status 200, got %d: %s", tc.name, rec.Code, rec.Body.String())
+		}
+	}
+
+	locs, err := s.RecentLocations(ctx, time.Date(2020, 6, 20, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC), LocationFilter{User: "jane", Device: "ABC123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 {
+		t.Fatalf("want 2 locations for jane/ABC123, got %d", len(locs))
+	}
+	l := locs[0]
+	if l.Lat != -33.8688 || l.Lng != 151.2093 || l.Accuracy != 9 {
+		t.Errorf("unexpected location: %#v", l)
+	}
+	if l.Velocity == nil || *l.Velocity != 36 {
+		t.Errorf("want speed 36km/h, got %v", l.Velocity)
+	}
+	if l.CourseOverGround == nil || *l.CourseOverGround != 180 {
+		t.Errorf("want dir 180, got %v", l.CourseOverGround)
+	}
+	if locs[1].Batt == nil || *locs[1].Batt != 54 {
+		t.Errorf("want batt from json body, got %v", locs[1].Batt)
+	}
+
+	var sources []string
+	rows, err := s.db.QueryContext(ctx, `select source from device_locations`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var src string
+		if err := rows.Scan(&src); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, src)
+	}
+	if strings.Join(sources, ",") != "gpslogger,gpslogger" {
+		t.Errorf("want locations recorded as from gpslogger, got: %v", sources)
+	}
+
+	for _, q := range []string{
+		"lat=1&lon=2&ser=ABC123",
+		"lat=NaN&lon=2&time=2020-06-20T22:17:00Z&ser=ABC123",
+		"lat=1&lon=2&time=2020-06-20T22:17:00Z&spd=NaN&ser=ABC123",
+		"lat=1&lon=2&time=2020-06-20T22:17:00Z&alt=Inf&ser=ABC123",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/gpslogger?"+q, nil)
+		req.SetBasicAuth("jane", "pw")
+		rec := httptest.NewRecorder()
+		gls.HandlePublish(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("want %s rejected, got %d", q, rec.Code)
+		}
+	}
+}
+
+func TestParseGPSLoggerLocationUTC(t *testing.T) {
+	for _, v := range []url.Values{
+		{"lat": {"1"}, "lon": {"2"}, "time": {"2020-06-21T08:15:00+10:00"}},
+		{"lat": {"1"}, "lon": {"2"}, "timestamp": {"1592691300"}},
+	} {
+		loc, err := parseGPSLoggerLocation(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := time.Date(2020, 6, 20, 22, 15, 0, 0, time.UTC); loc.Timestamp != want {
+			t.Errorf("%v: want %s, got %s", v, want, loc.Timestamp)
+		}
+	}
+}
@@ -50,6 +50,10 @@ func main() {
 			log: l,
 		}
 
+		mqttsub := &owntracksMQTTSubscriber{
+			log: l,
+		}
+
 		fssync := &fsqSyncCommand{
 			log: l,
 		}
@@ -64,6 +68,10 @@ func main() {
 			log: l,
 		}
 
+		icalsync := &icsimportCommand{
+			log: l,
+		}
+
 		var (
 			listen            string
 			promListen        string
@@ -74,11 +82,13 @@ func main() {
 			otListen          string
 			otUsername        string
 			otPassword        string
+			otEncryptionKeys  string
 			requireSubject    string
 			disable4sqSync    bool
 			disableTripitSync bool
 			fsqSyncInterval   time.Duration
 			tpSyncInterval    time.Duration
+			icalSyncInterval  time.Duration
 		)
 
 		fs := flag.NewFlagSet("serve", flag.ExitOnError)
@@ -89,15 +99,17 @@ func main() {
 		fs.StringVar(&baseURL, "base-url", getEnvDefault("BASE_URL", "http://localhost:8080"), "Base URL this service runs on")
 
 		fs.StringVar(&otListen, "ot-listen", getEnvDefault("OT_LISTEN", ""), "Optional address to listen on for the owntracks publish endpoint.")
-		fs.StringVar(&otUsername, "ot-username", getEnvDefault("OT_PUBLISH_USERNAME", ""), "Username for the owntracks publish endpoint (required)")
-		fs.StringVar(&otPassword, "ot-password", "", "Password for the owntracks publish endpoint (required)")
+		fs.StringVar(&otUsername, "ot-username", getEnvDefault("OT_PUBLISH_USERNAME", ""), "Shared username for the owntracks publish endpoint. Devices can also use their own credentials, see the credentials command")
+		fs.StringVar(&otPassword, "ot-password", "", "Shared password for the owntracks publish endpoint")
+		fs.StringVar(&otEncryptionKeys, "ot-encryption-keys", "", "Comma separated list of topic=secret pairs (e.g owntracks/jane/phone=s3cret), for devices that encrypt their payloads")
+		mqttsub.AddFlags(fs)
 
 		fs.StringVar(&ah.Issuer, "auth-issuer", getEnvDefault("AUTH_ISSUER", ""), "OIDC Issuer (required unless auth disabled)")
 		fs.StringVar(&ah.ClientID, "auth-client-id", getEnvDefault("AUTH_CLIENT_ID", ""), "OIDC Client ID (required unless auth disabled)")
 		fs.StringVar(&ah.ClientSecret, "auth-client-secret", "", "OIDC Client Secret (required unless auth disabled)")
 		fs.StringVar(&ah.RedirectURL, "auth-redirect-url", getEnvDefault("AUTH_REDIRECT_URL", ""), "OIDC Redirect URL (required unless auth disabled)")
 		fs.StringVar(&requireSubject, "auth-require-subject", getEnvDefault("AUTH_REQUIRE_SUBJECT", ""), "If set, require this subject to grant access")
-		fs.BoolVar(&basicAuth, "i-am-basic", false, "If enabled, basic auth will be used for the web UI using the owntracks endpoint creds")
+		fs.BoolVar(&basicAuth, "i-am-basic", false, "If enabled, basic auth will be used for the web UI using the shared owntracks endpoint creds")
 
 		fs.BoolVar(&disableAuth, "auth-disabled", false, "Disable auth altogether")
 
@@ -113,6 +125,9 @@ func main() {
 		fs.BoolVar(&disableTripitSync, "tripit-sync-disabled", false, "Disable background tripit sync")
 		fs.DurationVar(&tpSyncInterval, "tripit-sync-interval", 6*time.Hour, "How often we should sync tripit in the background")
 		tpsync.AddFlags(fs)
+		// an alternative to the API, from the calendar feed settings in TripIt
+		fs.StringVar(&icalsync.url, "tripit-ical-url", "", "Private iCalendar feed URL for TripIt. If set, trips are synced from it in the background")
+		fs.DurationVar(&icalSyncInterval, "tripit-ical-sync-interval", 6*time.Hour, "How often we should sync the TripIt iCalendar feed in the background")
 
 		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
 			l.Fatal(err.Error())
@@ -128,12 +143,21 @@ func main() {
 		if v := os.Getenv("OT_PUBLISH_PASSWORD"); v != "" && otPassword == "" {
 			otPassword = v
 		}
+		if v := os.Getenv("OT_ENCRYPTION_KEYS"); v != "" && otEncryptionKeys == "" {
+			otEncryptionKeys = v
+		}
+		if v := os.Getenv("MQTT_PASSWORD"); v != "" && mqttsub.password == "" {
+			mqttsub.password = v
+		}
 		if v := os.Getenv("AUTH_CLIENT_SECRET"); v != "" && ah.ClientSecret == "" {
 			ah.ClientSecret = v
 		}
 		if v := os.Getenv("FSQ_CLIENT_SECRET"); v != "" && ws.fsqOauthConfig.ClientSecret == "" {
 			ws.fsqOauthConfig.ClientSecret = v
 		}
+		if v := os.Getenv("TRIPIT_ICAL_URL"); v != "" && icalsync.url == "" {
+			icalsync.url = v
+		}
 
 		if v, ok := os.LookupEnv("CREDENTIALS_DIRECTORY"); ok {
 			l.Printf("loading credentials from files in directory %s", v)
@@ -144,6 +168,12 @@ func main() {
 			if s, err := os.ReadFile(filepath.Join(v, "ot-publish-password")); err == nil {
 				otPassword = strings.TrimSpace(string(s))
 			}
+			if s, err := os.ReadFile(filepath.Join(v, "ot-encryption-keys")); err == nil {
+				otEncryptionKeys = strings.TrimSpace(string(s))
+			}
+			if s, err := os.ReadFile(filepath.Join(v, "mqtt-password")); err == nil {
+				mqttsub.password = strings.TrimSpace(string(s))
+			}
 			if s, err := os.ReadFile(filepath.Join(v, "auth-client-secret")); err == nil {
 				ah.ClientSecret = strings.TrimSpace(string(s))
 			}
@@ -161,6 +191,9 @@ func main() {
 				ws.tripitAPISecret = strings.TrimSpace(string(s))
 				tpsync.oauthAPISecret = strings.TrimSpace(string(s))
 			}
+			if s, err := os.ReadFile(filepath.Join(v, "tripit-ical-url")); err == nil {
+				icalsync.url = strings.TrimSpace(string(s))
+			}
 		}
 
 		var errs []string
@@ -169,12 +202,17 @@ func main() {
 			errs = append(errs, "secure-key required")
 		}
 
-		if otUsername == "" {
-			errs = append(errs, "ot-username required")
+		if (otUsername == "") != (otPassword == "") {
+			errs = append(errs, "ot-username and ot-password must be set together")
 		}
 
-		if otPassword == "" {
-			errs = append(errs, "ot-password required")
+		if basicAuth && otUsername == "" {
+			errs = append(errs, "ot-username and ot-password required for basic auth")
+		}
+
+		otKeys, err := parseOTEncryptionKeys(otEncryptionKeys)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("ot-encryption-keys: %v", err))
 		}
 
 		if !disableAuth && !basicAuth {
@@ -225,6 +263,7 @@ func main() {
 		ws.tripitAPISecret = tpsync.oauthAPISecret
 
 		ots.store = base.storage
+		ots.encryptionKeys = otKeys
 
 		mux := http.NewServeMux()
 
@@ -262,11 +301,22 @@ func main() {
 
 		var g run.Group
 
+		ols := &overlandServer{log: l, store: base.storage}
+		oas := &osmandServer{log: l, store: base.storage}
+		gls := &gpsloggerServer{log: l, store: base.storage}
+
+		addPublishHandlers := func(m *http.ServeMux) {
+			m.Handle("/pub", wrapPublishAuth(l, base.storage, otUsername, otPassword, http.HandlerFunc(ots.HandlePublish)))
+			m.Handle("/overland", wrapPublishAuth(l, base.storage, otUsername, otPassword, http.HandlerFunc(ols.HandlePublish)))
+			m.Handle("/osmand", wrapPublishAuth(l, base.storage, otUsername, otPassword, http.HandlerFunc(oas.HandlePublish)))
+			m.Handle("/gpslogger", wrapPublishAuth(l, base.storage, otUsername, otPassword, http.HandlerFunc(gls.HandlePublish)))
+		}
+
 		if otListen == "" {
-			mux.Handle("/pub", wrapBasicAuth(otUsername, otPassword, http.HandlerFunc(ots.HandlePublish)))
+			addPublishHandlers(mux)
 		} else {
 			otmux := http.NewServeMux()
-			otmux.Handle("/pub", wrapBasicAuth(otUsername, otPassword, http.HandlerFunc(ots.HandlePublish)))
+			addPublishHandlers(otmux)
 			srv := http.Server{Addr: otListen, Handler: otmux}
 
 			g.Add(func() error {
@@ -281,6 +331,22 @@ func main() {
 			})
 		}
 
+		if mqttsub.broker != "" {
+			mqttsub.ots = ots
+
+			if err := mqttsub.Validate(); err != nil {
+				l.Fatalf("validating mqtt subscriber: %v", err)
+			}
+
+			mqttCtx, mqttCancel := context.WithCancel(ctx)
+			g.Add(func() error {
+				return mqttsub.run(mqttCtx)
+			}, func(error) {
+				mqttCancel()
+				log.Print("returning mqtt shutdown")
+			})
+		}
+
 		if !disable4sqSync {
 			if ws.fsqOauthConfig.ClientID == "" || ws.fsqOauthConfig.ClientSecret == "" {
 				l.Fatal("foursquare oauth2 config not set")
@@ -381,6 +447,33 @@ func main() {
 
 		}
 
+		if icalsync.url != "" {
+			icalsync.store = base.storage
+
+			icalSyncDone := make(chan struct{}, 1)
+			g.Add(func() error {
+				for {
+					l.Print("Running tripit ical sync")
+					if err := icalsync.run(ctx); err != nil {
+						metricTripitICalSyncErrorCount.Inc()
+						l.Printf("error running tripit ical sync: %v", err)
+					} else {
+						metricTripitICalSyncSuccessCount.Inc()
+					}
+
+					select {
+					case <-icalSyncDone:
+						return nil
+					case <-time.After(icalSyncInterval):
+						continue
+					}
+				}
+			}, func(error) {
+				icalSyncDone <- struct{}{}
+				log.Print("returning tripit ical shutdown")
+			})
+		}
+
 		mainSrv := &http.Server{
 			Addr:    listen,
 			Handler: mux,
@@ -474,6 +567,31 @@ func main() {
 		if err := cmd.run(ctx); err != nil {
 			l.Fatal(err.Error())
 		}
+	case "4sqexportimport":
+		cmd := fsqExportImportCommand{
+			log: l,
+		}
+
+		fs := flag.NewFlagSet("4sqexportimport", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to the foursquare/swarm data export zip (required)")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		if cmd.path == "" {
+			fmt.Printf("path required\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := trackImport(ctx, l, base.storage, importSourceFoursquareExport, cmd.path, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
 	case "tripitsync":
 		cmd := tripitSyncCommand{
 			log: l,
@@ -511,7 +629,12 @@ func main() {
 
 		fs := flag.NewFlagSet("takeoutimport", flag.ExitOnError)
 		base.AddFlags(fs)
-		fs.StringVar(&cmd.filePath, "path", "", "Path to google takeout locatiom history file (required)")
+		fs.StringVar(&cmd.filePath, "path", "", "Path to google location history file, either takeout Records.json or a Timeline export from a device (required)")
+		fs.StringVar(&cmd.username, "user", "", "User to attribute the locations to")
+		fs.StringVar(&cmd.device, "device", "", "Device to attribute the locations to, required if user is set")
+		fs.IntVar(&cmd.batchSize, "batch-size", 10000, "Number of records to commit in each transaction")
+		fs.StringVar(&cmd.checkpointPath, "checkpoint", "", "File to record progress in. If it exists, the import resumes from where it left off")
+		fs.BoolVar(&cmd.skipInvalid, "skip-invalid", false, "Log and skip invalid records, rather than failing the import")
 
 		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
 			l.Fatal(err.Error())
@@ -524,6 +647,193 @@ func main() {
 			errs = append(errs, "path required")
 		}
 
+		if cmd.batchSize < 1 {
+			errs = append(errs, "batch-size must be at least 1")
+		}
+
+		if (cmd.username == "") != (cmd.device == "") {
+			errs = append(errs, "user and device must be set together")
+		}
+
+		if len(errs) > 0 {
+			fmt.Printf("%s\n", strings.Join(errs, ", "))
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := trackImport(ctx, l, base.storage, sourceGoogleTakeout, cmd.filePath, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "semanticimport":
+		cmd := semanticimportCommand{
+			log: l,
+		}
+
+		fs := flag.NewFlagSet("semanticimport", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to a takeout Semantic Location History month file, or a directory containing them (required)")
+		fs.StringVar(&cmd.username, "user", "", "User to attribute the visits to")
+		fs.StringVar(&cmd.device, "device", "", "Device to attribute the visits to, required if user is set")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		var errs []string
+
+		if cmd.path == "" {
+			errs = append(errs, "path required")
+		}
+
+		if (cmd.username == "") != (cmd.device == "") {
+			errs = append(errs, "user and device must be set together")
+		}
+
+		if len(errs) > 0 {
+			fmt.Printf("%s\n", strings.Join(errs, ", "))
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := trackImport(ctx, l, base.storage, sourceGoogleSemantic, cmd.path, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "gpximport":
+		cmd := gpximportCommand{
+			log: l,
+		}
+
+		fs := flag.NewFlagSet("gpximport", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to a GPX file, or a directory to import all GPX files under (required)")
+		fs.StringVar(&cmd.source, "source", sourceGPX, "Source to record the locations and places as from, e.g strava")
+		fs.StringVar(&cmd.username, "user", "", "User to attribute the locations to")
+		fs.StringVar(&cmd.device, "device", "", "Device to attribute the locations to, required if user is set")
+		fs.IntVar(&cmd.batchSize, "batch-size", 10000, "Number of points to commit in each transaction")
+		fs.BoolVar(&cmd.skipInvalid, "skip-invalid", false, "Log and skip invalid points, rather than failing the import")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		var errs []string
+
+		if cmd.path == "" {
+			errs = append(errs, "path required")
+		}
+
+		if cmd.source == "" {
+			errs = append(errs, "source required")
+		}
+
+		if cmd.batchSize < 1 {
+			errs = append(errs, "batch-size must be at least 1")
+		}
+
+		if (cmd.username == "") != (cmd.device == "") {
+			errs = append(errs, "user and device must be set together")
+		}
+
+		if len(errs) > 0 {
+			fmt.Printf("%s\n", strings.Join(errs, ", "))
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := trackImport(ctx, l, base.storage, cmd.source, cmd.path, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "kmlimport":
+		cmd := kmlimportCommand{
+			log: l,
+		}
+
+		fs := flag.NewFlagSet("kmlimport", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to a KML or KMZ file, or a directory to import all of them under (required)")
+		fs.StringVar(&cmd.source, "source", sourceKML, "Source to record the imported data as from, e.g google_earth")
+		fs.StringVar(&cmd.username, "user", "", "User to attribute the data to")
+		fs.StringVar(&cmd.device, "device", "", "Device to attribute the data to, required if user is set")
+		fs.IntVar(&cmd.batchSize, "batch-size", 10000, "Number of track points to commit in each transaction")
+		fs.BoolVar(&cmd.skipInvalid, "skip-invalid", false, "Log and skip invalid placemarks, rather than failing the import")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		var errs []string
+
+		if cmd.path == "" {
+			errs = append(errs, "path required")
+		}
+
+		if cmd.source == "" {
+			errs = append(errs, "source required")
+		}
+
+		if cmd.batchSize < 1 {
+			errs = append(errs, "batch-size must be at least 1")
+		}
+
+		if (cmd.username == "") != (cmd.device == "") {
+			errs = append(errs, "user and device must be set together")
+		}
+
+		if len(errs) > 0 {
+			fmt.Printf("%s\n", strings.Join(errs, ", "))
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := trackImport(ctx, l, base.storage, cmd.source, cmd.path, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "photoimport":
+		cmd := photoimportCommand{
+			log: l,
+		}
+
+		var tz string
+
+		fs := flag.NewFlagSet("photoimport", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to a directory of JPEG or HEIC photos to import the locations of (required)")
+		fs.StringVar(&cmd.username, "user", "", "User to attribute the locations to")
+		fs.StringVar(&cmd.device, "device", "", "Device to attribute the locations to, required if user is set")
+		fs.StringVar(&tz, "tz", "Local", "Time zone for photos that don't record their offset from UTC, e.g Europe/Berlin")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		var errs []string
+
+		if cmd.path == "" {
+			errs = append(errs, "path required")
+		}
+
+		if (cmd.username == "") != (cmd.device == "") {
+			errs = append(errs, "user and device must be set together")
+		}
+
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid tz: %v", err))
+		}
+		cmd.loc = loc
+
 		if len(errs) > 0 {
 			fmt.Printf("%s\n", strings.Join(errs, ", "))
 			fs.Usage()
@@ -532,6 +842,300 @@ func main() {
 
 		cmd.store = base.storage
 
+		if err := trackImport(ctx, l, base.storage, sourcePhoto, cmd.path, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "geotag":
+		cmd := geotagCommand{
+			log: l,
+			out: os.Stdout,
+		}
+
+		var tz string
+
+		fs := flag.NewFlagSet("geotag", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to a directory of photos to geotag (required)")
+		fs.StringVar(&tz, "tz", "Local", "Time zone the camera's clock was set to, for photos that don't record their offset from UTC, e.g Europe/Berlin")
+		fs.DurationVar(&cmd.offset, "offset", 0, "Correction to add to the camera's clock, e.g -90s if it was 90 seconds fast")
+		fs.DurationVar(&cmd.window, "window", 10*time.Minute, "How far from when the photo was taken a location can be and still be used")
+		fs.BoolVar(&cmd.dryRun, "dry-run", false, "Report where photos would be tagged, without writing any sidecars")
+		fs.StringVar(&cmd.filter.User, "user", "", "Only use locations from this user's devices")
+		fs.StringVar(&cmd.filter.Device, "device", "", "Only use locations from devices with this name")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		var errs []string
+
+		if cmd.path == "" {
+			errs = append(errs, "path required")
+		}
+
+		if cmd.window <= 0 {
+			errs = append(errs, "window must be positive")
+		}
+
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid tz: %v", err))
+		}
+		cmd.loc = loc
+
+		if len(errs) > 0 {
+			fmt.Printf("%s\n", strings.Join(errs, ", "))
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := cmd.run(ctx); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "csvimport":
+		cmd := csvimportCommand{
+			log: l,
+			out: os.Stdout,
+		}
+
+		var columns, delimiter, tz string
+
+		fs := flag.NewFlagSet("csvimport", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to the CSV file to import (required)")
+		fs.StringVar(&cmd.source, "source", sourceCSV, "Source to record the locations as from, e.g the app that exported them")
+		fs.StringVar(&cmd.username, "user", "", "User to attribute the locations to")
+		fs.StringVar(&cmd.device, "device", "", "Device to attribute the locations to, required if user is set")
+		fs.StringVar(&columns, "columns", "", "Mapping of location fields to column names, e.g lat=Latitude,lng=Longitude,timestamp=Time. Fields are lat, lng, timestamp, accuracy, altitude, speed and course (required)")
+		fs.StringVar(&delimiter, "delimiter", ",", "Field delimiter")
+		fs.StringVar(&cmd.timeFormat, "time-format", csvTimeRFC3339, "Format of the timestamp column. rfc3339, unix, unixms, or a Go time layout like \"2006-01-02 15:04:05\"")
+		fs.StringVar(&tz, "tz", "UTC", "Time zone for timestamps that don't include one")
+		fs.StringVar(&cmd.speedUnit, "speed-unit", "m/s", "Unit of the speed column. m/s, km/h, mph or knots")
+		fs.IntVar(&cmd.batchSize, "batch-size", 10000, "Number of rows to commit in each transaction")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		var errs []string
+
+		if cmd.path == "" {
+			errs = append(errs, "path required")
+		}
+
+		if cmd.source == "" {
+			errs = append(errs, "source required")
+		}
+
+		if (cmd.username == "") != (cmd.device == "") {
+			errs = append(errs, "user and device must be set together")
+		}
+
+		cols, err := parseCSVColumns(columns)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		cmd.columns = cols
+
+		if d := []rune(delimiter); len(d) != 1 {
+			errs = append(errs, "delimiter must be a single character")
+		} else {
+			cmd.delimiter = d[0]
+		}
+
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid tz: %v", err))
+		}
+		cmd.loc = loc
+
+		if _, ok := csvSpeedUnits[cmd.speedUnit]; !ok {
+			errs = append(errs, "speed-unit must be one of m/s, km/h, mph or knots")
+		}
+
+		if cmd.batchSize < 1 {
+			errs = append(errs, "batch-size must be at least 1")
+		}
+
+		if len(errs) > 0 {
+			fmt.Printf("%s\n", strings.Join(errs, ", "))
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := trackImport(ctx, l, base.storage, cmd.source, cmd.path, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "activitybackfill":
+		cmd := activitybackfillCommand{
+			log: l,
+		}
+
+		fs := flag.NewFlagSet("activitybackfill", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.IntVar(&cmd.batchSize, "batch-size", 10000, "Number of locations to handle in each transaction")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		if cmd.batchSize < 1 {
+			fmt.Printf("batch-size must be at least 1\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		if err := cmd.run(ctx); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "icsimport":
+		cmd := icsimportCommand{
+			log: l,
+		}
+
+		fs := flag.NewFlagSet("icsimport", flag.ExitOnError)
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.path, "path", "", "Path to an iCalendar file downloaded from TripIt")
+		fs.StringVar(&cmd.url, "url", "", "TripIt iCalendar feed URL to import from, instead of a file")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+		base.Parse(ctx, l)
+
+		if (cmd.path == "") == (cmd.url == "") {
+			fmt.Printf("one of path or url required\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		cmd.store = base.storage
+
+		// the feed URL contains a private token, so only a file path is
+		// recorded
+		if err := trackImport(ctx, l, base.storage, importSourceTripitICal, cmd.path, cmd.run); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "imports":
+		cmd := importsCommand{
+			log: l,
+			out: os.Stdout,
+		}
+
+		// the action is the first argument after the command
+		if len(os.Args) > parseIdx {
+			cmd.action = os.Args[parseIdx]
+			parseIdx++
+		}
+
+		fs := flag.NewFlagSet("imports", flag.ExitOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: %s imports list|rollback [flags]\n", os.Args[0])
+			fs.PrintDefaults()
+		}
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.id, "id", "", "ID of the import, as shown by list (rollback)")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+
+		if err := cmd.Validate(); err != nil {
+			fmt.Printf("%v\n", err)
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		base.Parse(ctx, l)
+
+		cmd.store = base.storage
+
+		if err := cmd.run(ctx); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "shares":
+		cmd := sharesCommand{
+			log: l,
+			out: os.Stdout,
+		}
+
+		// the action is the first argument after the command
+		if len(os.Args) > parseIdx {
+			cmd.action = os.Args[parseIdx]
+			parseIdx++
+		}
+
+		fs := flag.NewFlagSet("shares", flag.ExitOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: %s shares add|list|remove [flags]\n", os.Args[0])
+			fs.PrintDefaults()
+		}
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.username, "user", "", "User whose devices are shared (add, remove)")
+		fs.StringVar(&cmd.with, "with", "", "User whose devices can see them as friends (add, remove)")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+
+		if err := cmd.Validate(); err != nil {
+			fmt.Printf("%v\n", err)
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		base.Parse(ctx, l)
+
+		cmd.store = base.storage
+
+		if err := cmd.run(ctx); err != nil {
+			l.Fatal(err.Error())
+		}
+	case "credentials":
+		cmd := credentialsCommand{
+			log: l,
+			out: os.Stdout,
+		}
+
+		// the action is the first argument after the command
+		if len(os.Args) > parseIdx {
+			cmd.action = os.Args[parseIdx]
+			parseIdx++
+		}
+
+		fs := flag.NewFlagSet("credentials", flag.ExitOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: %s credentials create|list|rotate|revoke [flags]\n", os.Args[0])
+			fs.PrintDefaults()
+		}
+		base.AddFlags(fs)
+		fs.StringVar(&cmd.username, "user", "", "User the device belongs to (create)")
+		fs.StringVar(&cmd.device, "device", "", "Name of the device (create)")
+		fs.StringVar(&cmd.credUsername, "username", "", "Username of the credential (rotate, revoke)")
+
+		if err := fs.Parse(os.Args[parseIdx:]); err != nil {
+			l.Fatal(err.Error())
+		}
+
+		if err := cmd.Validate(); err != nil {
+			fmt.Printf("%v\n", err)
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		base.Parse(ctx, l)
+
+		cmd.store = base.storage
+
 		if err := cmd.run(ctx); err != nil {
 			l.Fatal(err.Error())
 		}
@@ -613,6 +1217,52 @@ func wrapBasicAuth(username, password string, wrap http.Handler) http.Handler {
 	})
 }
 
+type deviceAuthenticator interface {
+	// AuthenticateDevice returns the device the credentials belong to, or nil
+	// if they are invalid.
+	AuthenticateDevice(ctx context.Context, username, password string) (*Device, error)
+}
+
+type authDeviceCtxKey struct{}
+
+// wrapPublishAuth requires requests to use basic auth with a device's
+// credentials, or the shared username and password if they are set. Requests
+// authenticated with a device's credentials have it available via
+// authenticatedDevice.
+func wrapPublishAuth(l logger, devices deviceAuthenticator, username, password string, wrap http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wherewasi"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if username != "" && subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1 && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			wrap.ServeHTTP(w, r)
+			return
+		}
+		d, err := devices.AuthenticateDevice(r.Context(), u, p)
+		if err != nil {
+			l.Printf("authenticating device %s: %v", u, err)
+			http.Error(w, "Internal Error", http.StatusInternalServerError)
+			return
+		}
+		if d == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wherewasi"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		wrap.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authDeviceCtxKey{}, d)))
+	})
+}
+
+// authenticatedDevice returns the device the request was authenticated as, or
+// nil if it wasn't authenticated with a device's credentials.
+func authenticatedDevice(ctx context.Context) *Device {
+	d, _ := ctx.Value(authDeviceCtxKey{}).(*Device)
+	return d
+}
+
 type secrets struct {
 	FourquareAPIKey   string `json:"foursquare_api_key,omitempty"`
 	TripitOAuthToken  string `json:"tripit_oauth_token,omitempty"`
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type fsqExportStorage interface {
+	Add4sqExportCheckin(ctx context.Context, checkin fsqCheckin) (bool, error)
+	Sync4sqUsers(ctx context.Context) error
+	Sync4sqVenues(ctx context.Context) error
+}
+
+var _ fsqExportStorage = (*Storage)(nil)
+
+// fsqExportImportCommand imports the checkins from a foursquare/swarm data
+// export. The checkins are in checkins.json, or split across checkins1.json,
+// checkins2.json etc. in larger exports.
+type fsqExportImportCommand struct {
+	log logger
+
+	path string
+
+	store fsqExportStorage
+}
+
+type fsqExportCheckins struct {
+	Items []json.RawMessage `json:"items"`
+}
+
+func (f *fsqExportImportCommand) run(ctx context.Context) error {
+	f.log.Printf("Importing foursquare export %s", f.path)
+
+	zr, err := zip.OpenReader(f.path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", f.path, err)
+	}
+	defer zr.Close()
+
+	var (
+		files    int
+		imported int
+		existing int
+	)
+	for _, zf := range zr.File {
+		name := path.Base(zf.Name)
+		if !strings.HasPrefix(name, "checkins") || path.Ext(name) != ".json" {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("opening %s: %v", zf.Name, err)
+		}
+		var cis fsqExportCheckins
+		err = json.NewDecoder(r).Decode(&cis)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("decoding %s: %v", zf.Name, err)
+		}
+
+		for i, raw := range cis.Items {
+			ci, err := parseFsqExportCheckin(raw)
+			if err != nil {
+				return fmt.Errorf("%s checkin %d: %v", zf.Name, i, err)
+			}
+			inserted, err := f.store.Add4sqExportCheckin(ctx, ci)
+			if err != nil {
+				return err
+			}
+			if inserted {
+				imported++
+			} else {
+				existing++
+			}
+		}
+		files++
+		f.log.Printf("Handled %s, %d checkins", zf.Name, len(cis.Items))
+	}
+	if files == 0 {
+		return fmt.Errorf("no checkins found in %s", f.path)
+	}
+
+	f.log.Print("Syncing Foursquare checkin user information")
+	if err := f.store.Sync4sqUsers(ctx); err != nil {
+		return fmt.Errorf("syncing users: %v", err)
+	}
+
+	f.log.Print("Syncing Foursquare checkin venue information")
+	if err := f.store.Sync4sqVenues(ctx); err != nil {
+		return fmt.Errorf("syncing venues: %v", err)
+	}
+
+	f.log.Printf("Foursquare export import complete, imported %d checkins, skipped %d already stored", imported, existing)
+
+	return nil
+}
+
+// parseFsqExportCheckin converts a checkin from an export to the API's format,
+// so it's stored the same way as synced checkins. Newer exports have
+// createdAt as a time string rather than seconds since the epoch, and only
+// the venue's id and name, with the coordinates on the checkin.
+func parseFsqExportCheckin(raw json.RawMessage) (fsqCheckin, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return fsqCheckin{}, fmt.Errorf("unmarshaling checkin: %v", err)
+	}
+
+	if ca, ok := m["createdAt"]; ok && len(ca) > 0 && ca[0] == '"' {
+		var s string
+		if err := json.Unmarshal(ca, &s); err != nil {
+			return fsqCheckin{}, fmt.Errorf("unmarshaling createdAt: %v", err)
+		}
+		ts, err := parseFsqExportTime(s)
+		if err != nil {
+			return fsqCheckin{}, err
+		}
+		m["createdAt"] = json.RawMessage(strconv.FormatInt(ts.Unix(), 10))
+	}
+
+	if v, ok := m["venue"]; ok && m["lat"] != nil && m["lng"] != nil {
+		var venue map[string]json.RawMessage
+		if err := json.Unmarshal(v, &venue); err != nil {
+			return fsqCheckin{}, fmt.Errorf("unmarshaling venue: %v", err)
+		}
+		if _, ok := venue["location"]; !ok {
+			loc, err := json.Marshal(map[string]json.RawMessage{"lat": m["lat"], "lng": m["lng"]})
+			if err != nil {
+				return fsqCheckin{}, err
+			}
+			venue["location"] = loc
+			if m["venue"], err = json.Marshal(venue); err != nil {
+				return fsqCheckin{}, err
+			}
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fsqCheckin{}, fmt.Errorf("marshaling checkin: %v", err)
+	}
+	var ci fsqCheckin
+	if err := json.Unmarshal(b, &ci); err != nil {
+		return fsqCheckin{}, fmt.Errorf("unmarshaling checkin: %v", err)
+	}
+	ci.raw = b
+	return ci, nil
+}
+
+// parseFsqExportTime parses an export's createdAt, which is UTC
+func parseFsqExportTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999", time.RFC3339} {
+		if ts, err := time.Parse(layout, s); err == nil {
+			return ts, nil
+		}
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid createdAt %q", s)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const egFsqAPICheckin = `{
+  "id": "api1",
+  "createdAt": 1560349364,
+  "type": "checkin",
+  "timeZoneOffset": 120,
+  "with": [{"id": "p1", "firstName": "Jane", "lastName": "Doe"}],
+  "venue": {
+    "id": "v1",
+    "name": "Cafe",
+    "location": {"address": "1 Main St", "lat": 52.52, "lng": 13.405, "city": "Berlin", "cc": "DE", "country": "Germany"},
+    "categories": [{"id": "c1", "name": "Coffee Shop", "primary": true}]
+  }
+}`
+
+const egFsqExportCheckins = `{
+  "count": 3,
+  "items": [
+    {"id": "api1", "createdAt": "2019-06-12 14:22:44.000000", "type": "checkin", "timeZoneOffset": 120, "venue": {"id": "v1", "name": "Cafe", "url": "https://foursquare.com/v/v1"}, "lat": 52.52, "lng": 13.405},
+    {"id": "exp1", "createdAt": "2019-06-13 09:00:00.000000", "type": "checkin", "timeZoneOffset": 120, "venue": {"id": "v1", "name": "Cafe", "url": "https://foursquare.com/v/v1"}, "lat": 52.5201, "lng": 13.4051, "shout": "again"},
+    {"id": "exp2", "createdAt": 1560499200, "type": "checkin", "timeZoneOffset": 120, "venue": {"id": "v2", "name": "Bar"}, "lat": 52.53, "lng": 13.41}
+  ]
+}`
+
+func TestFsqExportImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	// a checkin already synced from the API
+	var apiCi fsqCheckin
+	if err := json.Unmarshal([]byte(egFsqAPICheckin), &apiCi); err != nil {
+		t.Fatal(err)
+	}
+	apiCi.raw = json.RawMessage(egFsqAPICheckin)
+	if _, err := s.Upsert4sqCheckin(ctx, apiCi); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync4sqVenues(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "export.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("export/checkins1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(egFsqExportCheckins)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Create("export/tips.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &fsqExportImportCommand{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		path:  path,
+		store: s,
+	}
+	for i := 0; i < 2; i++ {
+		if err := cmd.run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from checkins`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("want 3 checkins, got %d", count)
+	}
+
+	var raw string
+	if err := s.db.QueryRowContext(ctx, `select fsq_raw from checkins where fsq_id = 'api1'`).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw != egFsqAPICheckin {
+		t.Errorf("checkin from the API was overwritten with: %s", raw)
+	}
+
+	var (
+		category, city string
+		lat            float64
+	)
+	if err := s.db.QueryRowContext(ctx, `select category, city, lat from venues where fsq_id = 'v1'`).Scan(&category, &city, &lat); err != nil {
+		t.Fatal(err)
+	}
+	if category != "Coffee Shop" || city != "Berlin" || lat != 52.52 {
+		t.Errorf("venue details from the API were lost, got category %q city %q lat %f", category, city, lat)
+	}
+
+	cis, err := s.GetCheckins(ctx, time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), ImportFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cis) != 3 {
+		t.Fatalf("want 3 checkins with venues, got %d", len(cis))
+	}
+	if !cis[1].Timestamp.Equal(time.Date(2019, 6, 13, 9, 0, 0, 0, time.UTC)) || cis[1].VenueName != "Cafe" {
+		t.Errorf("unexpected exported checkin: %#v", cis[1])
+	}
+	if cis[2].VenueName != "Bar" || cis[2].VenueLat != 52.53 || cis[2].VenueLng != 13.41 {
+		t.Errorf("want venue location from the exported checkin, got: %#v", cis[2])
+	}
+	if len(cis[0].With) != 1 || cis[0].With[0] != "Jane Doe" {
+		t.Errorf("want people from the API checkin, got %v", cis[0].With)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+)
+
+type activityBackfillStorage interface {
+	BackfillLocationActivities(ctx context.Context, afterID int64, limit int) (lastID int64, locations, activities int, _ error)
+}
+
+var _ activityBackfillStorage = (*Storage)(nil)
+
+// activitybackfillCommand populates the activities for google takeout
+// locations that were imported before they were stored, from the raw data.
+type activitybackfillCommand struct {
+	log logger
+
+	batchSize int
+
+	store activityBackfillStorage
+}
+
+func (a *activitybackfillCommand) run(ctx context.Context) error {
+	a.log.Print("Backfilling location activities")
+
+	var (
+		afterID    int64
+		locations  int
+		activities int
+	)
+	for {
+		lastID, l, n, err := a.store.BackfillLocationActivities(ctx, afterID, a.batchSize)
+		if err != nil {
+			return err
+		}
+		if lastID == 0 {
+			break
+		}
+		afterID = lastID
+		locations += l
+		activities += n
+		a.log.Printf("Handled locations up to id %d: %d locations updated with %d activities", afterID, locations, activities)
+	}
+
+	a.log.Printf("Backfill complete. %d locations updated with %d activities", locations, activities)
+	return nil
+}
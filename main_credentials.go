@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type credentialsStorage interface {
+	CreateDeviceCredential(ctx context.Context, username, device string) (credUsername, password string, _ error)
+	RotateDeviceCredential(ctx context.Context, credUsername string) (string, error)
+	RevokeDeviceCredential(ctx context.Context, credUsername string) error
+	ListDeviceCredentials(ctx context.Context) ([]DeviceCredential, error)
+}
+
+var _ credentialsStorage = (*Storage)(nil)
+
+// credentialsCommand manages the credentials devices publish locations with
+type credentialsCommand struct {
+	log logger
+	out io.Writer
+
+	action string
+
+	// for create
+	username string
+	device   string
+	// for rotate and revoke
+	credUsername string
+
+	store credentialsStorage
+}
+
+func (c *credentialsCommand) Validate() error {
+	var errs []string
+
+	switch c.action {
+	case "create":
+		if c.username == "" {
+			errs = append(errs, "user required")
+		}
+		if c.device == "" {
+			errs = append(errs, "device required")
+		}
+	case "rotate", "revoke":
+		if c.credUsername == "" {
+			errs = append(errs, "username required")
+		}
+	case "list":
+	default:
+		errs = append(errs, fmt.Sprintf("action must be one of create, list, rotate or revoke, not %q", c.action))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (c *credentialsCommand) run(ctx context.Context) error {
+	switch c.action {
+	case "create":
+		u, p, err := c.store.CreateDeviceCredential(ctx, c.username, c.device)
+		if err != nil {
+			return fmt.Errorf("creating credential: %v", err)
+		}
+		fmt.Fprintf(c.out, "Username: %s\nPassword: %s\n", u, p)
+	case "rotate":
+		p, err := c.store.RotateDeviceCredential(ctx, c.credUsername)
+		if err != nil {
+			return fmt.Errorf("rotating credential: %v", err)
+		}
+		fmt.Fprintf(c.out, "Username: %s\nPassword: %s\n", c.credUsername, p)
+	case "revoke":
+		if err := c.store.RevokeDeviceCredential(ctx, c.credUsername); err != nil {
+			return fmt.Errorf("revoking credential: %v", err)
+		}
+		c.log.Printf("Revoked %s", c.credUsername)
+	case "list":
+		creds, err := c.store.ListDeviceCredentials(ctx)
+		if err != nil {
+			return fmt.Errorf("listing credentials: %v", err)
+		}
+		tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USERNAME\tUSER\tDEVICE\tCREATED\tROTATED\tREVOKED")
+		for _, cr := range creds {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", cr.Username, cr.User, cr.Device, cr.CreatedAt.Format(time.RFC3339), fmtOptionalTime(cr.RotatedAt), fmtOptionalTime(cr.RevokedAt))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fmtOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
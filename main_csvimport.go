@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type csvStorage interface {
+	AddDeviceLocations(ctx context.Context, username, device string, locs []newDeviceLocation) (duplicates int, _ error)
+}
+
+var _ csvStorage = (*Storage)(nil)
+
+// csvColumns maps the fields of a location to the CSV's column names. Empty
+// optional columns aren't imported.
+type csvColumns struct {
+	Lat       string
+	Lng       string
+	Timestamp string
+	Accuracy  string // metres
+	Altitude  string // metres
+	Speed     string // in the speed unit
+	Course    string // degrees
+}
+
+// parseCSVColumns parses a mapping like lat=Latitude,lng=Longitude,timestamp=Time
+func parseCSVColumns(spec string) (csvColumns, error) {
+	var c csvColumns
+	fields := map[string]*string{
+		"lat":       &c.Lat,
+		"lng":       &c.Lng,
+		"timestamp": &c.Timestamp,
+		"accuracy":  &c.Accuracy,
+		"altitude":  &c.Altitude,
+		"speed":     &c.Speed,
+		"course":    &c.Course,
+	}
+	for _, m := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(m, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		f, known := fields[k]
+		if !ok || !known || v == "" {
+			return csvColumns{}, fmt.Errorf("invalid column mapping %q, want field=column where field is one of lat, lng, timestamp, accuracy, altitude, speed or course", m)
+		}
+		*f = v
+	}
+	if c.Lat == "" || c.Lng == "" || c.Timestamp == "" {
+		return csvColumns{}, fmt.Errorf("columns for lat, lng and timestamp are required")
+	}
+	return c, nil
+}
+
+// csvSpeedUnits converts speeds to km/h
+var csvSpeedUnits = map[string]float64{
+	"m/s":   3.6,
+	"km/h":  1,
+	"mph":   1.609344,
+	"knots": 1.852,
+}
+
+// Time formats that aren't Go layouts
+const (
+	csvTimeRFC3339 = "rfc3339"
+	csvTimeUnix    = "unix"
+	csvTimeUnixMs  = "unixms"
+)
+
+type csvimportCommand struct {
+	log logger
+	out io.Writer
+
+	path      string
+	source    string
+	username  string
+	device    string
+	columns   csvColumns
+	delimiter rune
+	// timeFormat is rfc3339, unix, unixms or a Go time layout
+	timeFormat string
+	// loc is the zone for times that don't include one
+	loc       *time.Location
+	speedUnit string
+	batchSize int
+
+	store csvStorage
+}
+
+// csvRejection is a row we couldn't import
+type csvRejection struct {
+	line   int
+	field  string
+	reason string
+}
+
+// maxCSVRejectionsShown limits how many rejected rows are listed, the rest are
+// just counted
+const maxCSVRejectionsShown = 20
+
+func (c *csvimportCommand) run(ctx context.Context) error {
+	c.log.Printf("Importing CSV from %s", c.path)
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", c.path, err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma = c.delimiter
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+	// spreadsheets like to start files with a byte order mark
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	idx := map[string]int{}
+	for i, h := range header {
+		idx[strings.TrimSpace(h)] = i
+	}
+	for _, col := range []string{c.columns.Lat, c.columns.Lng, c.columns.Timestamp, c.columns.Accuracy, c.columns.Altitude, c.columns.Speed, c.columns.Course} {
+		if _, ok := idx[col]; col != "" && !ok {
+			return fmt.Errorf("column %q not found in header %v", col, header)
+		}
+	}
+
+	var (
+		batch    []newDeviceLocation
+		imported int
+		dups     int
+		rejected []csvRejection
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		d, err := c.store.AddDeviceLocations(ctx, c.username, c.device, batch)
+		if err != nil {
+			return fmt.Errorf("importing locations: %v", err)
+		}
+		imported += len(batch) - d
+		dups += d
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return fmt.Errorf("reading %s: %v", c.path, err)
+			}
+			rejected = append(rejected, csvRejection{line: perr.Line, reason: perr.Err.Error()})
+			continue
+		}
+		line, _ := r.FieldPos(0)
+
+		loc, rej := c.parseRow(header, idx, rec)
+		if rej != nil {
+			rej.line = line
+			rejected = append(rejected, *rej)
+			continue
+		}
+		batch = append(batch, loc)
+
+		if len(batch) >= c.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	c.log.Printf("Done. Imported %d locations, skipped %d already imported and rejected %d rows", imported, dups, len(rejected))
+	if len(rejected) > 0 {
+		return c.printRejections(rejected)
+	}
+	return nil
+}
+
+// parseRow converts a row to a location, or returns why it was rejected
+func (c *csvimportCommand) parseRow(header []string, idx map[string]int, rec []string) (newDeviceLocation, *csvRejection) {
+	cell := func(col string) string {
+		i, ok := idx[col]
+		if col == "" || !ok || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+	reject := func(field, format string, args ...any) (newDeviceLocation, *csvRejection) {
+		return newDeviceLocation{}, &csvRejection{field: field, reason: fmt.Sprintf(format, args...)}
+	}
+	optional := func(field, col string) (*float64, *csvRejection) {
+		s := cell(col)
+		if s == "" {
+			return nil, nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		// ParseFloat accepts NaN and Inf, which can't be stored
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			_, rej := reject(field, "invalid %s %q", field, s)
+			return nil, rej
+		}
+		return &v, nil
+	}
+
+	lat, err := strconv.ParseFloat(cell(c.columns.Lat), 64)
+	if err != nil {
+		return reject("lat", "invalid lat %q", cell(c.columns.Lat))
+	}
+	lng, err := strconv.ParseFloat(cell(c.columns.Lng), 64)
+	if err != nil {
+		return reject("lng", "invalid lng %q", cell(c.columns.Lng))
+	}
+	if err := validLatLng(lat, lng); err != nil {
+		return reject("lat/lng", "%v", err)
+	}
+	ts, err := parseCSVTime(cell(c.columns.Timestamp), c.timeFormat, c.loc)
+	if err != nil {
+		return reject("timestamp", "%v", err)
+	}
+
+	acc, rej := optional("accuracy", c.columns.Accuracy)
+	if rej != nil {
+		return newDeviceLocation{}, rej
+	}
+	alt, rej := optional("altitude", c.columns.Altitude)
+	if rej != nil {
+		return newDeviceLocation{}, rej
+	}
+	speed, rej := optional("speed", c.columns.Speed)
+	if rej != nil {
+		return newDeviceLocation{}, rej
+	}
+	course, rej := optional("course", c.columns.Course)
+	if rej != nil {
+		return newDeviceLocation{}, rej
+	}
+
+	// keep the whole row, by column name
+	raw := map[string]string{}
+	for i, h := range header {
+		if i < len(rec) {
+			raw[h] = rec[i]
+		}
+	}
+	rawb, err := json.Marshal(raw)
+	if err != nil {
+		return reject("", "marshaling row: %v", err)
+	}
+
+	return newDeviceLocation{
+		Source: c.source,
+		Lat:    lat,
+		Lng:    lng,
+		// times can be in any zone, store them in UTC so they sort with
+		// everything else
+		Timestamp:        ts.UTC(),
+		Accuracy:         knownMeasurement(acc, 1),
+		Altitude:         scaledMeasurement(alt, 1),
+		Velocity:         knownMeasurement(speed, csvSpeedUnits[c.speedUnit]),
+		CourseOverGround: knownMeasurement(course, 1),
+		Raw:              rawb,
+	}, nil
+}
+
+// parseCSVTime parses a time in the given format. Times without a zone are in
+// loc.
+func parseCSVTime(s, format string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	}
+	switch format {
+	case csvTimeUnix, csvTimeUnixMs:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+		}
+		if format == csvTimeUnixMs {
+			return time.UnixMilli(int64(v)), nil
+		}
+		return time.UnixMilli(int64(v * 1000)), nil
+	case csvTimeRFC3339:
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+		}
+		return ts, nil
+	}
+	ts, err := time.ParseInLocation(format, s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q for format %q", s, format)
+	}
+	return ts, nil
+}
+
+// printRejections summarises why rows were rejected, and lists the first of
+// them
+func (c *csvimportCommand) printRejections(rejected []csvRejection) error {
+	byField := map[string]int{}
+	for _, r := range rejected {
+		f := r.field
+		if f == "" {
+			f = "row"
+		}
+		byField[f]++
+	}
+	var fields []string
+	for f := range byField {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REJECTED\tROWS")
+	for _, f := range fields {
+		fmt.Fprintf(tw, "%s\t%d\n", f, byField[f])
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "LINE\tREASON")
+	for i, r := range rejected {
+		if i == maxCSVRejectionsShown {
+			fmt.Fprintf(tw, "...\t%d more\n", len(rejected)-i)
+			break
+		}
+		fmt.Fprintf(tw, "%d\t%s\n", r.line, r.reason)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const egLocationCSV = "\ufeffDate;Latitude;Longitude;Accuracy (m);Elevation;Speed\n" +
+	"12.06.2019 16:22:44;52.52;13.405;8;34.5;10\n" +
+	"12.06.2019 16:23:44;52.521;13.406;;;\n" +
+	"12.06.2019 16:24:44;152.5;13.4;5;30;0\n" +
+	"not a date;52.5;13.4;5;30;0\n" +
+	"12.06.2019 16:25:44;north;13.4;5;30;0\n" +
+	"12.06.2019 16:26:44;52.522;13.407;about 5;30;0\n" +
+	"12.06.2019 16:27:44;52.523;13.408;-1;30;-1\n" +
+	"12.06.2019 16:28:44;NaN;13.408;5;30;0\n" +
+	"12.06.2019 16:29:44;52.524;13.409;5;Inf;0\n"
+
+func TestCSVImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	path := filepath.Join(t.TempDir(), "export.csv")
+	if err := os.WriteFile(path, []byte(egLocationCSV), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cols, err := parseCSVColumns("lat=Latitude, lng=Longitude, timestamp=Date, accuracy=Accuracy (m), altitude=Elevation, speed=Speed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd := &csvimportCommand{
+		log:        log.New(os.Stderr, "", log.LstdFlags),
+		out:        &out,
+		path:       path,
+		source:     "myapp",
+		username:   "jane",
+		device:     "phone",
+		columns:    cols,
+		delimiter:  ';',
+		timeFormat: "02.01.2006 15:04:05",
+		loc:        berlin,
+		speedUnit:  "m/s",
+		batchSize:  2,
+		store:      s,
+	}
+	for i := 0; i < 2; i++ {
+		out.Reset()
+		if err := cmd.run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"lat/lng    2", "timestamp  1", "lat        1", "accuracy   1", "altitude   1", "\n4     ", "\n5     ", "\n6     ", "\n7     ", "\n9     ", "\n10    "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want %q in rejection summary:\n%s", want, out.String())
+		}
+	}
+
+	locs, err := s.RecentLocations(ctx, time.Date(2019, 6, 12, 0, 0, 0, 0, time.UTC), time.Date(2019, 6, 13, 0, 0, 0, 0, time.UTC), LocationFilter{User: "jane", Device: "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 3 {
+		t.Fatalf("want 3 locations, got %d", len(locs))
+	}
+
+	first := locs[0]
+	if !first.Timestamp.Equal(time.Date(2019, 6, 12, 14, 22, 44, 0, time.UTC)) {
+		t.Errorf("want first location at 14:22:44 UTC, got %s", first.Timestamp)
+	}
+	if first.Source != "myapp" || first.Lat != 52.52 || first.Accuracy != 8 {
+		t.Errorf("unexpected first location: %#v", first)
+	}
+	if first.Altitude == nil || *first.Altitude != 35 || first.Velocity == nil || *first.Velocity != 36 {
+		t.Errorf("want altitude 35 and velocity 36 km/h, got %v and %v", first.Altitude, first.Velocity)
+	}
+	if locs[1].Altitude != nil || locs[1].Velocity != nil {
+		t.Errorf("want empty cells to be unset, got %#v", locs[1])
+	}
+	if locs[2].Velocity != nil || locs[2].Accuracy != 0 {
+		t.Errorf("want negative speed and accuracy to be unset, got %#v", locs[2])
+	}
+}
+
+func TestParseCSVColumns(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"lat=a,lng=b",
+		"lat=a,lng=b,timestamp=c,elevation=d",
+		"lat=a,lng,timestamp=c",
+	} {
+		if _, err := parseCSVColumns(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
+
+func TestParseCSVTime(t *testing.T) {
+	want := time.Date(2019, 6, 12, 14, 22, 44, 0, time.UTC)
+	for _, tc := range []struct {
+		s      string
+		format string
+	}{
+		{s: "2019-06-12T16:22:44+02:00", format: csvTimeRFC3339},
+		{s: "1560349364", format: csvTimeUnix},
+		{s: "1560349364000", format: csvTimeUnixMs},
+		{s: "2019-06-12 14:22:44", format: "2006-01-02 15:04:05"},
+	} {
+		got, err := parseCSVTime(tc.s, tc.format, time.UTC)
+		if err != nil {
+			t.Errorf("%s: %v", tc.s, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%s: want %s, got %s", tc.s, want, got)
+		}
+	}
+}
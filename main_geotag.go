@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type geotagStorage interface {
+	NearestLocations(ctx context.Context, at time.Time, window time.Duration, filter LocationFilter) (before, after *DeviceLocation, _ error)
+}
+
+var _ geotagStorage = (*Storage)(nil)
+
+// geotagExts are the photos we can geotag. As well as what photoimport reads,
+// this covers the TIFF based raw formats cameras without GPS tend to produce.
+var geotagExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".heic": true,
+	".heif": true,
+	".tif":  true,
+	".tiff": true,
+	".dng":  true,
+	".cr2":  true,
+	".nef":  true,
+	".arw":  true,
+	".pef":  true,
+}
+
+// geotagCommand finds where photos without a GPS position were taken from the
+// location history, and writes it to an XMP sidecar next to the photo. The
+// photos themselves are never modified, and existing sidecars aren't touched
+// as they'll have other metadata and edits in them.
+type geotagCommand struct {
+	log logger
+	out io.Writer
+
+	path string
+	// loc is the zone the camera's clock was set to, for photos that don't
+	// record it
+	loc *time.Location
+	// offset is added to the camera's time to correct it, e.g if the clock
+	// was a minute fast, -1m
+	offset time.Duration
+	// window is how far from the photo's time a location can be
+	window time.Duration
+	dryRun bool
+	filter LocationFilter
+
+	store geotagStorage
+}
+
+// geotagFix is where a photo was taken
+type geotagFix struct {
+	Lat      float64
+	Lng      float64
+	Altitude *float64
+	// Method describes how the position was found, for the report
+	Method string
+}
+
+func (g *geotagCommand) run(ctx context.Context) error {
+	if g.dryRun {
+		g.log.Printf("Dry run, finding locations for photos in %s without writing sidecars", g.path)
+	} else {
+		g.log.Printf("Geotagging photos in %s", g.path)
+	}
+
+	tw := tabwriter.NewWriter(g.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tTAKEN\tSTATUS\tLAT\tLNG\tFIX")
+
+	counts := map[string]int{}
+	err := filepath.WalkDir(g.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !geotagExts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		taken, status, fix, err := g.geotag(ctx, path)
+		if err != nil {
+			return err
+		}
+		counts[status]++
+
+		takenStr, lat, lng, method := "-", "-", "-", "-"
+		if !taken.IsZero() {
+			takenStr = taken.Format(time.RFC3339)
+		}
+		if fix != nil {
+			lat, lng, method = fmt.Sprintf("%.6f", fix.Lat), fmt.Sprintf("%.6f", fix.Lng), fix.Method
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", path, takenStr, status, lat, lng, method)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var summary []string
+	for _, s := range []string{geotagTagged, geotagWouldTag, geotagNoLocation, geotagHasGPS, geotagSidecarExists, geotagNoTime, geotagUnreadable} {
+		if counts[s] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[s], s))
+		}
+	}
+	if len(summary) == 0 {
+		summary = []string{"no photos found"}
+	}
+	g.log.Printf("Done: %s", strings.Join(summary, ", "))
+	return nil
+}
+
+// statuses for the report
+const (
+	geotagTagged        = "tagged"
+	geotagWouldTag      = "would tag"
+	geotagNoLocation    = "no location"
+	geotagHasGPS        = "already has GPS"
+	geotagSidecarExists = "sidecar exists"
+	geotagNoTime        = "no time"
+	geotagUnreadable    = "unreadable"
+)
+
+// geotag handles a single photo. Problems with the photo are reported in the
+// status, an error is only returned if we couldn't continue.
+func (g *geotagCommand) geotag(ctx context.Context, path string) (taken time.Time, status string, _ *geotagFix, _ error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	ex, err := readEXIF(b)
+	if err != nil {
+		g.log.Printf("reading EXIF from %s: %v", path, err)
+		return time.Time{}, geotagUnreadable, nil, nil
+	}
+	if _, _, ok := ex.latLng(); ok {
+		return time.Time{}, geotagHasGPS, nil, nil
+	}
+	taken, err = ex.takenAt(g.loc)
+	if err != nil {
+		return time.Time{}, geotagNoTime, nil, nil
+	}
+	taken = taken.Add(g.offset)
+
+	sidecar := xmpSidecarPath(path)
+	if _, err := os.Stat(sidecar); err == nil {
+		return taken, geotagSidecarExists, nil, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, "", nil, fmt.Errorf("checking for %s: %v", sidecar, err)
+	}
+
+	before, after, err := g.store.NearestLocations(ctx, taken, g.window, g.filter)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+	fix := interpolateFix(taken, before, after)
+	if fix == nil {
+		return taken, geotagNoLocation, nil, nil
+	}
+
+	if g.dryRun {
+		return taken, geotagWouldTag, fix, nil
+	}
+	if err := writeXMPSidecar(sidecar, taken, *fix); err != nil {
+		return time.Time{}, "", nil, err
+	}
+	return taken, geotagTagged, fix, nil
+}
+
+// interpolateFix estimates the position at a time, from the fixes either side
+// of it. If there's only one, that is used as is.
+func interpolateFix(at time.Time, before, after *DeviceLocation) *geotagFix {
+	fixFrom := func(l *DeviceLocation, method string) *geotagFix {
+		f := &geotagFix{Lat: l.Lat, Lng: l.Lng, Method: method}
+		if l.Altitude != nil {
+			alt := float64(*l.Altitude)
+			f.Altitude = &alt
+		}
+		return f
+	}
+
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case after == nil:
+		return fixFrom(before, fmt.Sprintf("fix %s before", at.Sub(before.Timestamp).Round(time.Second)))
+	case before == nil:
+		return fixFrom(after, fmt.Sprintf("fix %s after", after.Timestamp.Sub(at).Round(time.Second)))
+	case !before.Timestamp.Before(at):
+		return fixFrom(before, "exact fix")
+	}
+
+	frac := float64(at.Sub(before.Timestamp)) / float64(after.Timestamp.Sub(before.Timestamp))
+	f := &geotagFix{
+		Lat: before.Lat + (after.Lat-before.Lat)*frac,
+		Lng: before.Lng + (after.Lng-before.Lng)*frac,
+		Method: fmt.Sprintf("interpolated, fixes %s before and %s after",
+			at.Sub(before.Timestamp).Round(time.Second), after.Timestamp.Sub(at).Round(time.Second)),
+	}
+	if before.Altitude != nil && after.Altitude != nil {
+		alt := float64(*before.Altitude) + float64(*after.Altitude-*before.Altitude)*frac
+		f.Altitude = &alt
+	}
+	return f
+}
+
+// xmpSidecarPath is the photo's path with an .xmp extension, which is where
+// Lightroom, darktable and exiftool look for them
+func xmpSidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".xmp"
+}
+
+// writeXMPSidecar creates a sidecar with the GPS position, failing if it
+// already exists.
+func writeXMPSidecar(path string, taken time.Time, fix geotagFix) error {
+	attrs := []string{
+		`exif:GPSVersionID="2.2.0.0"`,
+		`exif:GPSMapDatum="WGS-84"`,
+		fmt.Sprintf(`exif:GPSLatitude="%s"`, xmpCoordinate(fix.Lat, "N", "S")),
+		fmt.Sprintf(`exif:GPSLongitude="%s"`, xmpCoordinate(fix.Lng, "E", "W")),
+		fmt.Sprintf(`exif:GPSTimeStamp="%s"`, taken.UTC().Format("2006-01-02T15:04:05Z")),
+	}
+	if fix.Altitude != nil {
+		ref := 0
+		if *fix.Altitude < 0 {
+			ref = 1
+		}
+		attrs = append(attrs,
+			fmt.Sprintf(`exif:GPSAltitudeRef="%d"`, ref),
+			fmt.Sprintf(`exif:GPSAltitude="%d/10"`, int(math.Round(math.Abs(*fix.Altitude)*10))))
+	}
+
+	xmp := `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    ` + strings.Join(attrs, "\n    ") + `/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating %s: %v", path, err)
+	}
+	if _, err := f.WriteString(xmp); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %s: %v", path, err)
+	}
+	return nil
+}
+
+// xmpCoordinate formats a coordinate as XMP's "DDD,MM.mmmmmmk"
+func xmpCoordinate(v float64, pos, neg string) string {
+	ref := pos
+	if v < 0 {
+		ref = neg
+	}
+	v = math.Abs(v)
+	deg := math.Floor(v)
+	return fmt.Sprintf("%d,%.6f%s", int(deg), (v-deg)*60, ref)
+}
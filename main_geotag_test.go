@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGeotag(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	alt := func(v int) *int { return &v }
+	if _, err := s.AddDeviceLocations(ctx, "jane", "phone", []newDeviceLocation{
+		{Source: sourceGPX, Lat: 52.0, Lng: 13.0, Altitude: alt(100), Timestamp: time.Date(2019, 6, 12, 8, 0, 0, 0, time.UTC)},
+		// recorded in a different zone, which sorts differently as a string
+		{Source: sourceGPX, Lat: 52.1, Lng: 13.2, Altitude: alt(120), Timestamp: time.Date(2019, 6, 12, 10, 1, 0, 0, time.FixedZone("CEST", 2*60*60))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	le := binary.LittleEndian
+	taken := func(dto string) []byte {
+		return testJPEG(testTIFF(le, []testTIFFField{testASCII(exifTagDateTimeOriginal, dto)}, nil))
+	}
+	dir := t.TempDir()
+	files := map[string][]byte{
+		// camera in local time, and 30 seconds fast. Half way between the
+		// fixes.
+		"between.jpg": taken("2019:06:12 10:01:00"),
+		// the same as the first fix
+		"exact.jpg": taken("2019:06:12 10:00:30"),
+		// a few minutes after the last fix
+		"after.jpg": taken("2019:06:12 10:05:30"),
+		// hours away from anything
+		"evening.jpg": taken("2019:06:12 20:00:00"),
+		"tagged.jpg": testJPEG(testTIFF(le,
+			[]testTIFFField{testASCII(exifTagDateTimeOriginal, "2019:06:12 10:01:00")},
+			[]testTIFFField{
+				testASCII(gpsTagLatitudeRef, "N"),
+				testRationals(le, gpsTagLatitude, [2]uint32{1, 1}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+				testASCII(gpsTagLongitudeRef, "E"),
+				testRationals(le, gpsTagLongitude, [2]uint32{1, 1}, [2]uint32{0, 1}, [2]uint32{0, 1}),
+			})),
+		"broken.jpg": []byte("not a jpeg"),
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an existing sidecar, e.g with edits from Lightroom
+	if err := os.WriteFile(filepath.Join(dir, "edited.jpg"), taken("2019:06:12 10:01:00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "edited.xmp"), []byte("edits"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cmd := &geotagCommand{
+		log:    log.New(os.Stderr, "", log.LstdFlags),
+		out:    &out,
+		path:   dir,
+		loc:    berlin,
+		offset: -30 * time.Second,
+		window: 5 * time.Minute,
+		dryRun: true,
+		filter: LocationFilter{User: "jane"},
+		store:  s,
+	}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecars, err := filepath.Glob(filepath.Join(dir, "*.xmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sidecars) != 1 {
+		t.Errorf("want dry run to write no sidecars, found %v", sidecars)
+	}
+
+	wantStatus := map[string]string{
+		"between.jpg": geotagWouldTag,
+		"exact.jpg":   geotagWouldTag,
+		"after.jpg":   geotagWouldTag,
+		"evening.jpg": geotagNoLocation,
+		"tagged.jpg":  geotagHasGPS,
+		"broken.jpg":  geotagUnreadable,
+		"edited.jpg":  geotagSidecarExists,
+	}
+	for _, l := range strings.Split(out.String(), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 0 {
+			continue
+		}
+		name := filepath.Base(f[0])
+		want, ok := wantStatus[name]
+		if !ok {
+			continue
+		}
+		if !strings.Contains(l, want) {
+			t.Errorf("%s: want status %q, got: %s", name, want, l)
+		}
+		delete(wantStatus, name)
+	}
+	if len(wantStatus) > 0 {
+		t.Errorf("photos missing from the report: %v", wantStatus)
+	}
+
+	cmd.dryRun = false
+	out.Reset()
+	for i := 0; i < 2; i++ {
+		if err := cmd.run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string][]string{
+		"between.xmp": {`exif:GPSLatitude="52,3.000000N"`, `exif:GPSLongitude="13,6.000000E"`, `exif:GPSAltitude="1100/10"`, `exif:GPSTimeStamp="2019-06-12T08:00:30Z"`},
+		"exact.xmp":   {`exif:GPSLatitude="52,0.000000N"`, `exif:GPSLongitude="13,0.000000E"`},
+		"after.xmp":   {`exif:GPSLatitude="52,6.000000N"`, `exif:GPSLongitude="13,12.000000E"`},
+		"edited.xmp":  {"edits"},
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range want {
+			if !strings.Contains(string(b), w) {
+				t.Errorf("%s: want %s in:\n%s", name, w, b)
+			}
+		}
+	}
+	for _, name := range []string{"evening.xmp", "tagged.xmp", "broken.xmp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s should not have been written", name)
+		}
+	}
+}
+
+func TestXMPCoordinate(t *testing.T) {
+	for _, tc := range []struct {
+		v    float64
+		want string
+	}{
+		{v: 52.52, want: "52,31.200000N"},
+		{v: -33.85, want: "33,51.000000S"},
+		{v: 0, want: "0,0.000000N"},
+	} {
+		if got := xmpCoordinate(tc.v, "N", "S"); got != tc.want {
+			t.Errorf("%f: want %s, got %s", tc.v, tc.want, got)
+		}
+	}
+}
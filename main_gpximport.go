@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type gpxStorage interface {
+	AddDeviceLocations(ctx context.Context, username, device string, locs []newDeviceLocation) (duplicates int, _ error)
+	AddPlaces(ctx context.Context, username, device string, places []newPlace) (duplicates int, _ error)
+}
+
+var _ gpxStorage = (*Storage)(nil)
+
+// gpxPoint is a trkpt, rtept or wpt element. GPX 1.0 has speed and course on
+// the point, 1.1 moved them to extensions.
+type gpxPoint struct {
+	Lat    float64  `xml:"lat,attr"`
+	Lon    float64  `xml:"lon,attr"`
+	Ele    *float64 `xml:"ele"`
+	Time   string   `xml:"time"`
+	Name   string   `xml:"name"`
+	Desc   string   `xml:"desc"`
+	Speed  *float64 `xml:"speed"`  // metres per second
+	Course *float64 `xml:"course"` // degrees
+	// Extensions covers the Garmin TrackPointExtension, and apps like OsmAnd
+	// and GPSLogger that put speed and course directly in extensions.
+	Extensions struct {
+		Speed               *float64 `xml:"speed"`
+		Course              *float64 `xml:"course"`
+		TrackPointExtension struct {
+			Speed  *float64 `xml:"speed"`
+			Course *float64 `xml:"course"`
+		} `xml:"TrackPointExtension"`
+	} `xml:"extensions"`
+
+	Inner string `xml:",innerxml"`
+}
+
+func (g *gpxPoint) speed() *float64 {
+	for _, s := range []*float64{g.Speed, g.Extensions.Speed, g.Extensions.TrackPointExtension.Speed} {
+		if s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func (g *gpxPoint) course() *float64 {
+	for _, c := range []*float64{g.Course, g.Extensions.Course, g.Extensions.TrackPointExtension.Course} {
+		if c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+type gpximportCommand struct {
+	log logger
+
+	path        string
+	source      string
+	username    string
+	device      string
+	batchSize   int
+	skipInvalid bool
+
+	store gpxStorage
+}
+
+func (g *gpximportCommand) run(ctx context.Context) error {
+	g.log.Printf("Importing GPX from %s", g.path)
+
+	var (
+		batch    []newDeviceLocation
+		files    int
+		imported int
+		dups     int
+		places   int
+		untimed  int
+		invalid  int
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		d, err := g.store.AddDeviceLocations(ctx, g.username, g.device, batch)
+		if err != nil {
+			return fmt.Errorf("importing locations: %v", err)
+		}
+		imported += len(batch) - d
+		dups += d
+		batch = batch[:0]
+		return nil
+	}
+
+	// path can be a single file, or a directory of them
+	err := filepath.WalkDir(g.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".gpx") {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("opening %s: %v", path, err)
+		}
+		defer f.Close()
+
+		var wpts []newPlace
+		dec := xml.NewDecoder(f)
+		for idx := 0; ; {
+			tok, err := dec.Token()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("reading %s: %v", path, err)
+			}
+			se, ok := tok.(xml.StartElement)
+			if !ok || (se.Name.Local != "trkpt" && se.Name.Local != "rtept" && se.Name.Local != "wpt") {
+				continue
+			}
+			var p gpxPoint
+			if err := dec.DecodeElement(&p, &se); err != nil {
+				return fmt.Errorf("reading %s point %d: %v", path, idx, err)
+			}
+			i := idx
+			idx++
+
+			if se.Name.Local == "wpt" {
+				var wpt newPlace
+				wpt, err = parseGPXWaypoint(se, p)
+				if err == nil {
+					wpt.Source = g.source
+					wpts = append(wpts, wpt)
+				}
+			} else {
+				var loc newDeviceLocation
+				loc, err = parseGPXPoint(se, p)
+				if err == nil && loc.Timestamp.IsZero() {
+					// e.g a planned route, which we can't place in time
+					untimed++
+					continue
+				}
+				if err == nil {
+					loc.Source = g.source
+					batch = append(batch, loc)
+				}
+			}
+			if err != nil {
+				if !g.skipInvalid {
+					return fmt.Errorf("%s point %d: %v (use -skip-invalid to skip invalid points)", path, i, err)
+				}
+				g.log.Printf("skipping invalid point %d in %s: %v", i, path, err)
+				invalid++
+				continue
+			}
+
+			if len(batch) >= g.batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		if len(wpts) > 0 {
+			d, err := g.store.AddPlaces(ctx, g.username, g.device, wpts)
+			if err != nil {
+				return fmt.Errorf("importing waypoints from %s: %v", path, err)
+			}
+			places += len(wpts) - d
+		}
+
+		files++
+		g.log.Printf("Handled %s. %d locations and %d places imported so far", path, imported, places)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	g.log.Printf("Done, %d files. Imported %d locations and %d places, skipped %d already imported, %d without a time and %d invalid points",
+		files, imported, places, dups, untimed, invalid)
+	return nil
+}
+
+// parseGPXPoint converts a trkpt or rtept to a location. Points without a time
+// have a zero Timestamp.
+func parseGPXPoint(se xml.StartElement, p gpxPoint) (newDeviceLocation, error) {
+	if err := validLatLng(p.Lat, p.Lon); err != nil {
+		return newDeviceLocation{}, err
+	}
+	loc := newDeviceLocation{
+		Lat:              p.Lat,
+		Lng:              p.Lon,
+		Altitude:         scaledMeasurement(p.Ele, 1),
+		Velocity:         knownMeasurement(p.speed(), 3.6),
+		CourseOverGround: knownMeasurement(p.course(), 1),
+		Raw:              gpxRaw(se, p),
+	}
+	if p.Time != "" {
+		ts, err := parseGPXTime(p.Time)
+		if err != nil {
+			return newDeviceLocation{}, err
+		}
+		loc.Timestamp = ts
+	}
+	return loc, nil
+}
+
+func parseGPXWaypoint(se xml.StartElement, p gpxPoint) (newPlace, error) {
+	if err := validLatLng(p.Lat, p.Lon); err != nil {
+		return newPlace{}, err
+	}
+	wpt := newPlace{
+		Name:        strings.TrimSpace(p.Name),
+		Description: strings.TrimSpace(p.Desc),
+		Lat:         p.Lat,
+		Lng:         p.Lon,
+		Elevation:   scaledMeasurement(p.Ele, 1),
+		Raw:         gpxRaw(se, p),
+	}
+	if p.Time != "" {
+		ts, err := parseGPXTime(p.Time)
+		if err != nil {
+			return newPlace{}, err
+		}
+		wpt.Timestamp = &ts
+	}
+	return wpt, nil
+}
+
+// parseGPXTime parses a point's time. GPX times are UTC, but some apps leave
+// off the zone.
+func parseGPXTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		var err2 error
+		if ts, err2 = time.Parse("2006-01-02T15:04:05.999999999", s); err2 != nil {
+			return time.Time{}, fmt.Errorf("parsing time: %v", err)
+		}
+	}
+	return ts, nil
+}
+
+// gpxRaw rebuilds the element as it was in the file, for storing as the raw
+// data
+func gpxRaw(se xml.StartElement, p gpxPoint) []byte {
+	var b strings.Builder
+	b.WriteString("<" + se.Name.Local)
+	for _, a := range se.Attr {
+		fmt.Fprintf(&b, ` %s="%s"`, a.Name.Local, html.EscapeString(a.Value))
+	}
+	b.WriteString(">" + p.Inner + "</" + se.Name.Local + ">")
+	return []byte(b.String())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const egGPX11 = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="Garmin" xmlns="http://www.topografix.com/GPX/1/1" xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v2">
+  <wpt lat="47.5" lon="11.1">
+    <ele>1200.4</ele>
+    <name>Summit</name>
+    <desc>Top of the hill</desc>
+  </wpt>
+  <trk>
+    <name>Hike</name>
+    <trkseg>
+      <trkpt lat="47.4" lon="11.0">
+        <ele>800.6</ele>
+        <time>2021-07-01T08:00:00Z</time>
+        <extensions><gpxtpx:TrackPointExtension><gpxtpx:speed>1.5</gpxtpx:speed><gpxtpx:course>90</gpxtpx:course></gpxtpx:TrackPointExtension></extensions>
+      </trkpt>
+      <trkpt lat="47.41" lon="11.01">
+        <ele>820</ele>
+        <time>2021-07-01T08:05:00Z</time>
+        <extensions><speed>2</speed><course>45.5</course></extensions>
+      </trkpt>
+    </trkseg>
+  </trk>
+  <rte>
+    <rtept lat="47.45" lon="11.05"><name>planned</name></rtept>
+  </rte>
+</gpx>`
+
+const egGPX10 = `<?xml version="1.0"?>
+<gpx version="1.0" creator="old phone" xmlns="http://www.topografix.com/GPX/1/0">
+  <trk><trkseg>
+    <trkpt lat="-33.8688" lon="151.2093"><ele>-2</ele><time>2012-03-04T05:06:07</time><speed>10</speed><course>180</course></trkpt>
+  </trkseg></trk>
+</gpx>`
+
+func TestGPXImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "old"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		"hike.gpx":      egGPX11,
+		"old/phone.GPX": egGPX10,
+		"old/notes.txt": "not a gpx file",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := &gpximportCommand{
+		log:       log.New(os.Stderr, "", log.LstdFlags),
+		path:      dir,
+		source:    sourceGPX,
+		username:  "jane",
+		device:    "etrex",
+		batchSize: 1,
+		store:     s,
+	}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// importing again shouldn't duplicate anything
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	locs, err := s.RecentLocations(ctx, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), LocationFilter{User: "jane", Device: "etrex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 3 {
+		t.Fatalf("want 3 locations, got %d", len(locs))
+	}
+
+	old := locs[0]
+	if !old.Timestamp.Equal(time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)) || old.Altitude == nil || *old.Altitude != -2 ||
+		old.Velocity == nil || *old.Velocity != 36 || old.CourseOverGround == nil || *old.CourseOverGround != 180 {
+		t.Errorf("unexpected gpx 1.0 location: %#v", old)
+	}
+	garmin := locs[1]
+	if garmin.Lat != 47.4 || garmin.Altitude == nil || *garmin.Altitude != 801 ||
+		garmin.Velocity == nil || *garmin.Velocity != 5 || garmin.CourseOverGround == nil || *garmin.CourseOverGround != 90 {
+		t.Errorf("unexpected garmin extension location: %#v", garmin)
+	}
+	if locs[2].Velocity == nil || *locs[2].Velocity != 7 || *locs[2].CourseOverGround != 46 {
+		t.Errorf("unexpected extension location: %#v", locs[2])
+	}
+
+	var (
+		count     int
+		name      string
+		elevation int
+	)
+	if err := s.db.QueryRowContext(ctx, `select count(*), name, elevation from places where source = ?`, sourceGPX).Scan(&count, &name, &elevation); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || name != "Summit" || elevation != 1200 {
+		t.Errorf("unexpected places: count %d name %s elevation %d", count, name, elevation)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type icalTripStorage interface {
+	UpsertICalTrips(ctx context.Context, trips []icalTrip, segments []icalSegment) error
+}
+
+var _ icalTripStorage = (*Storage)(nil)
+
+// icalEvent is a VEVENT. Properties are keyed by name, with their parameters
+// (e.g VALUE=DATE or TZID=...) and unescaped value.
+type icalEvent struct {
+	props map[string]icalProp
+	raw   string
+}
+
+type icalProp struct {
+	params map[string]string
+	value  string
+}
+
+func (e *icalEvent) get(name string) string {
+	return e.props[name].value
+}
+
+// time parses a DATE or DATE-TIME property, returning whether it is a date
+// only.
+func (e *icalEvent) time(name string) (t time.Time, date bool, _ error) {
+	p, ok := e.props[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	if p.params["VALUE"] == "DATE" || len(p.value) == len("20060102") {
+		t, err := time.Parse("20060102", p.value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("parsing %s: %v", name, err)
+		}
+		return t, true, nil
+	}
+	if strings.HasSuffix(p.value, "Z") {
+		t, err := time.Parse("20060102T150405Z", p.value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("parsing %s: %v", name, err)
+		}
+		return t, false, nil
+	}
+	// floating, or in the given zone
+	loc := time.UTC
+	if tzid := p.params["TZID"]; tzid != "" {
+		l, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("loading %s zone %s: %v", name, tzid, err)
+		}
+		loc = l
+	}
+	t, err := time.ParseInLocation("20060102T150405", p.value, loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("parsing %s: %v", name, err)
+	}
+	return t, false, nil
+}
+
+// icalTrip is a trip from a TripIt feed, an all day event spanning the trip
+type icalTrip struct {
+	UID             string
+	Name            string
+	StartDate       time.Time
+	EndDate         time.Time // inclusive
+	PrimaryLocation string
+	Description     string
+	Raw             string
+
+	// TripitID is the trip's id in TripIt, from its URL. Empty if it didn't
+	// have one.
+	TripitID string
+}
+
+// icalSegment is a part of a trip, e.g a flight or hotel stay
+type icalSegment struct {
+	UID         string
+	TripUID     string // empty if it couldn't be matched to a trip
+	Type        string
+	Summary     string
+	Description string
+	Location    string
+	Lat         *float64
+	Lng         *float64
+	StartTime   time.Time
+	EndTime     time.Time
+	Raw         string
+}
+
+// Types of trip segments
+const (
+	tripSegmentFlight  = "flight"
+	tripSegmentLodging = "lodging"
+	tripSegmentRail    = "rail"
+	tripSegmentOther   = "other"
+)
+
+var (
+	// TripIt links every event to its trip, e.g
+	// https://www.tripit.com/trip/show/id/123456
+	tripitTripURLRE = regexp.MustCompile(`tripit\.com/trip/show/id/(\d+)`)
+	// flight summaries start with the flight number, e.g "UA123 SFO to JFK"
+	flightSummaryRE = regexp.MustCompile(`^[A-Z0-9]{2}\s?\d{1,4}\b`)
+)
+
+// icalFetchTimeout limits how long fetching the feed can take
+const icalFetchTimeout = 2 * time.Minute
+
+type icsimportCommand struct {
+	log logger
+
+	// one of path or url
+	path string
+	url  string
+
+	httpClient *http.Client
+
+	store icalTripStorage
+}
+
+func (i *icsimportCommand) run(ctx context.Context) error {
+	var r io.Reader
+	if i.url != "" {
+		// the feed URL includes a token, so don't log it
+		i.log.Print("Fetching TripIt iCalendar feed")
+		hc := i.httpClient
+		if hc == nil {
+			// this runs in the background of serve, so a hung feed can't be
+			// allowed to stop the syncs
+			hc = &http.Client{Timeout: icalFetchTimeout}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, i.url, nil)
+		if err != nil {
+			return fmt.Errorf("creating request: %v", withoutURL(err))
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			return fmt.Errorf("fetching feed: %v", withoutURL(err))
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetching feed: unexpected status %d", resp.StatusCode)
+		}
+		r = resp.Body
+	} else {
+		i.log.Printf("Importing iCalendar file %s", i.path)
+		f, err := os.Open(i.path)
+		if err != nil {
+			return fmt.Errorf("opening %s: %v", i.path, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	events, err := parseICalEvents(r)
+	if err != nil {
+		return err
+	}
+	trips, segments, err := icalTripsAndSegments(events)
+	if err != nil {
+		return err
+	}
+
+	if err := i.store.UpsertICalTrips(ctx, trips, segments); err != nil {
+		return err
+	}
+
+	i.log.Printf("iCalendar import complete, %d trips and %d segments", len(trips), len(segments))
+	return nil
+}
+
+// withoutURL removes the URL from errors making a request, as the feed's URL
+// includes a token
+func withoutURL(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return fmt.Errorf("%s: %v", uerr.Op, uerr.Err)
+	}
+	return err
+}
+
+// parseICalEvents reads the VEVENTs from a calendar
+func parseICalEvents(r io.Reader) ([]icalEvent, error) {
+	// long lines are folded, with continuations starting with whitespace
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		l := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading calendar: %v", err)
+	}
+	if len(lines) == 0 || lines[0] != "BEGIN:VCALENDAR" {
+		return nil, fmt.Errorf("not an iCalendar file")
+	}
+
+	var (
+		events []icalEvent
+		ev     *icalEvent
+		raw    []string
+		// nested components in an event, e.g VALARM
+		depth int
+	)
+	for n, l := range lines {
+		switch {
+		case l == "BEGIN:VEVENT":
+			ev = &icalEvent{props: map[string]icalProp{}}
+			raw = []string{l}
+			continue
+		case ev == nil:
+			continue
+		case l == "END:VEVENT":
+			raw = append(raw, l)
+			ev.raw = strings.Join(raw, "\r\n")
+			events = append(events, *ev)
+			ev = nil
+			continue
+		}
+		raw = append(raw, l)
+
+		if strings.HasPrefix(l, "BEGIN:") {
+			depth++
+			continue
+		}
+		if strings.HasPrefix(l, "END:") {
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+
+		nameParams, value, ok := strings.Cut(l, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid line %d: %q", n+1, l)
+		}
+		params := strings.Split(nameParams, ";")
+		p := icalProp{params: map[string]string{}, value: icalUnescape(value)}
+		for _, pp := range params[1:] {
+			k, v, _ := strings.Cut(pp, "=")
+			p.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+		ev.props[strings.ToUpper(params[0])] = p
+	}
+
+	return events, nil
+}
+
+func icalUnescape(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// icalTripsAndSegments splits TripIt's events in to trips, which are all day
+// events, and their segments.
+func icalTripsAndSegments(events []icalEvent) ([]icalTrip, []icalSegment, error) {
+	var (
+		trips    []icalTrip
+		segments []icalSegment
+	)
+	for _, e := range events {
+		uid := e.get("UID")
+		if uid == "" {
+			return nil, nil, fmt.Errorf("event %q has no UID", e.get("SUMMARY"))
+		}
+		start, date, err := e.time("DTSTART")
+		if err != nil {
+			return nil, nil, fmt.Errorf("event %s: %v", uid, err)
+		}
+		end, _, err := e.time("DTEND")
+		if err != nil {
+			return nil, nil, fmt.Errorf("event %s: %v", uid, err)
+		}
+
+		if date {
+			t := icalTrip{
+				UID:             uid,
+				Name:            e.get("SUMMARY"),
+				StartDate:       start,
+				EndDate:         start,
+				PrimaryLocation: e.get("LOCATION"),
+				Description:     e.get("DESCRIPTION"),
+				Raw:             e.raw,
+			}
+			if !end.IsZero() {
+				// the end of an all day event is exclusive
+				t.EndDate = end.AddDate(0, 0, -1)
+			}
+			if m := tripitTripURLRE.FindStringSubmatch(e.get("URL") + " " + t.Description); m != nil {
+				t.TripitID = m[1]
+			}
+			trips = append(trips, t)
+			continue
+		}
+
+		s := icalSegment{
+			UID:         uid,
+			Type:        icalSegmentType(e.get("SUMMARY"), e.get("CATEGORIES")),
+			Summary:     e.get("SUMMARY"),
+			Description: e.get("DESCRIPTION"),
+			Location:    e.get("LOCATION"),
+			StartTime:   start,
+			EndTime:     end,
+			Raw:         e.raw,
+		}
+		if geo := e.get("GEO"); geo != "" {
+			latS, lngS, _ := strings.Cut(geo, ";")
+			lat, laterr := strconv.ParseFloat(latS, 64)
+			lng, lngerr := strconv.ParseFloat(lngS, 64)
+			if laterr != nil || lngerr != nil || validLatLng(lat, lng) != nil {
+				return nil, nil, fmt.Errorf("event %s: invalid GEO %q", uid, geo)
+			}
+			s.Lat, s.Lng = &lat, &lng
+		}
+		segments = append(segments, s)
+	}
+
+	// match segments to their trip by the TripIt trip link, or failing that
+	// the trip they happen during
+	for si, s := range segments {
+		var tripitID string
+		if m := tripitTripURLRE.FindStringSubmatch(s.Description); m != nil {
+			tripitID = m[1]
+		}
+		for _, t := range trips {
+			if tripitID != "" && t.TripitID == tripitID {
+				segments[si].TripUID = t.UID
+				break
+			}
+			day := time.Date(s.StartTime.Year(), s.StartTime.Month(), s.StartTime.Day(), 0, 0, 0, 0, time.UTC)
+			if tripitID == "" && !day.Before(t.StartDate) && !day.After(t.EndDate) {
+				segments[si].TripUID = t.UID
+				break
+			}
+		}
+	}
+
+	return trips, segments, nil
+}
+
+func icalSegmentType(summary, categories string) string {
+	s := strings.ToLower(summary + " " + categories)
+	switch {
+	case flightSummaryRE.MatchString(summary) || strings.Contains(s, "flight"):
+		return tripSegmentFlight
+	case strings.Contains(s, "check-in") || strings.Contains(s, "check-out") ||
+		strings.Contains(s, "hotel") || strings.Contains(s, "lodging"):
+		return tripSegmentLodging
+	case strings.Contains(s, "rail") || strings.Contains(s, "train"):
+		return tripSegmentRail
+	default:
+		return tripSegmentOther
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ancientlore/go-tripit"
+)
+
+var egTripitICal = strings.ReplaceAll(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//TripIt//Calendar//EN
+BEGIN:VEVENT
+UID:trip-1@tripit.com
+DTSTART;VALUE=DATE:20190610
+DTEND;VALUE=DATE:20190615
+SUMMARY:Berlin\, June 2019
+LOCATION:Berlin\, Germany
+URL:https://www.tripit.com/trip/show/id/123456
+DESCRIPTION:Summer trip
+END:VEVENT
+BEGIN:VEVENT
+UID:flight-1@tripit.com
+DTSTART:20190610T080000Z
+DTEND:20190610T100000Z
+SUMMARY:LH123 LHR to BER
+LOCATION:London Heathrow
+GEO:51.47;-0.4543
+DESCRIPTION:View and/or edit details in TripIt : https://www.tripit.com/tr
+ ip/show/id/123456
+BEGIN:VALARM
+ACTION:DISPLAY
+DESCRIPTION:Flight soon
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:hotel-1@tripit.com
+DTSTART;TZID=Europe/Berlin:20190610T150000
+DTEND;TZID=Europe/Berlin:20190611T110000
+SUMMARY:Check-in: Hotel Adlon
+LOCATION:Unter den Linden 77\, Berlin
+END:VEVENT
+BEGIN:VEVENT
+UID:rail-1@tripit.com
+DTSTART:20190612T090000
+DTEND:20190612T120000
+SUMMARY:Train to Hamburg
+END:VEVENT
+BEGIN:VEVENT
+UID:other-1@tripit.com
+DTSTART:20200101T090000Z
+SUMMARY:Dinner
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n")
+
+func TestICSImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	var requests int
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/calendar")
+		_, _ = w.Write([]byte(egTripitICal))
+	}))
+	t.Cleanup(svr.Close)
+
+	cmd := &icsimportCommand{
+		log:        log.New(os.Stderr, "", log.LstdFlags),
+		url:        svr.URL + "/feed/ical/private/token.ics",
+		httpClient: svr.Client(),
+		store:      s,
+	}
+	for i := 0; i < 2; i++ {
+		if err := cmd.run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("want 2 requests to the feed, got %d", requests)
+	}
+
+	var (
+		tripID, name, location string
+		start, end             time.Time
+		count                  int
+	)
+	if err := s.db.QueryRowContext(ctx, `select count(*) from trips`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("want 1 trip, got %d", count)
+	}
+	if err := s.db.QueryRowContext(ctx, `select id, name, primary_location, start_date, end_date from trips where ical_uid = 'trip-1@tripit.com'`).Scan(&tripID, &name, &location, &start, &end); err != nil {
+		t.Fatal(err)
+	}
+	if name != "Berlin, June 2019" || location != "Berlin, Germany" {
+		t.Errorf("unexpected trip name %q location %q", name, location)
+	}
+	if !start.Equal(time.Date(2019, 6, 10, 0, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2019, 6, 14, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("want trip from 2019-06-10 to 2019-06-14, got %s to %s", start, end)
+	}
+
+	if err := s.db.QueryRowContext(ctx, `select count(*) from trip_segments`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("want 4 segments, got %d", count)
+	}
+
+	for _, tc := range []struct {
+		uid      string
+		typ      string
+		tripID   string
+		start    time.Time
+		wantsGeo bool
+	}{
+		{uid: "flight-1@tripit.com", typ: tripSegmentFlight, tripID: tripID, start: time.Date(2019, 6, 10, 8, 0, 0, 0, time.UTC), wantsGeo: true},
+		{uid: "hotel-1@tripit.com", typ: tripSegmentLodging, tripID: tripID, start: time.Date(2019, 6, 10, 13, 0, 0, 0, time.UTC)},
+		{uid: "rail-1@tripit.com", typ: tripSegmentRail, tripID: tripID, start: time.Date(2019, 6, 12, 9, 0, 0, 0, time.UTC)},
+		{uid: "other-1@tripit.com", typ: tripSegmentOther, start: time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)},
+	} {
+		var (
+			typ       string
+			segTripID *string
+			segStart  time.Time
+			lat, lng  *float64
+		)
+		if err := s.db.QueryRowContext(ctx, `select type, trip_id, start_time, lat, lng from trip_segments where ical_uid = ?`, tc.uid).Scan(&typ, &segTripID, &segStart, &lat, &lng); err != nil {
+			t.Fatalf("%s: %v", tc.uid, err)
+		}
+		if typ != tc.typ {
+			t.Errorf("%s: want type %s, got %s", tc.uid, tc.typ, typ)
+		}
+		if (segTripID == nil) != (tc.tripID == "") || (segTripID != nil && *segTripID != tc.tripID) {
+			t.Errorf("%s: want trip %q, got %v", tc.uid, tc.tripID, segTripID)
+		}
+		if !segStart.Equal(tc.start) {
+			t.Errorf("%s: want start %s, got %s", tc.uid, tc.start, segStart)
+		}
+		if tc.wantsGeo && (lat == nil || lng == nil || *lat != 51.47 || *lng != -0.4543) {
+			t.Errorf("%s: want location from GEO, got %v %v", tc.uid, lat, lng)
+		}
+	}
+
+	// a downloaded file gives the same result
+	path := filepath.Join(t.TempDir(), "tripit.ics")
+	if err := os.WriteFile(path, []byte(egTripitICal), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd.url = ""
+	cmd.path = path
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from trip_segments`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("want 4 segments after importing the file, got %d", count)
+	}
+}
+
+func TestICSImportTripitTrips(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	// imported from the feed before TripIt IDs were stored, and then synced
+	// from the API
+	if _, err := s.db.ExecContext(ctx, `insert into trips(id, ical_uid, name) values ('legacy', 'trip-1@tripit.com', 'Berlin')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpsertTripitTrip(ctx, &tripit.Trip{Id: "123456", DisplayName: "Berlin", StartDate: "2019-06-10", EndDate: "2019-06-14"}, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tripit.ics")
+	if err := os.WriteFile(path, []byte(egTripitICal), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &icsimportCommand{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		path:  path,
+		store: s,
+	}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// and syncing from the API again
+	if err := s.UpsertTripitTrip(ctx, &tripit.Trip{Id: "123456", DisplayName: "Berlin", StartDate: "2019-06-10", EndDate: "2019-06-14"}, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		count          int
+		tripID, icalID string
+	)
+	if err := s.db.QueryRowContext(ctx, `select count(*), id, ifnull(ical_uid, '') from trips where tripit_id = '123456'`).Scan(&count, &tripID, &icalID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from trips`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || icalID != "trip-1@tripit.com" {
+		t.Errorf("want the feed's trip merged in to the API's, got %d trips and ical uid %q", count, icalID)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from trip_segments where trip_id = ?`, tripID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("want 3 segments on the merged trip, got %d", count)
+	}
+}
+
+func TestICSImportFetchErrorHidesURL(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	svr := httptest.NewServer(http.NotFoundHandler())
+	svr.Close()
+
+	cmd := &icsimportCommand{
+		log:        log.New(os.Stderr, "", log.LstdFlags),
+		url:        svr.URL + "/feed/ical/private/secrettoken.ics",
+		httpClient: svr.Client(),
+		store:      s,
+	}
+	err := cmd.run(ctx)
+	if err == nil {
+		t.Fatal("want error fetching from a closed server")
+	}
+	if strings.Contains(err.Error(), "secrettoken") {
+		t.Errorf("error should not include the feed URL: %v", err)
+	}
+}
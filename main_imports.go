@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Sources of imports that aren't also a device location source
+const (
+	importSourceFoursquareExport = "foursquare_export"
+	importSourceTripitICal       = "tripit_ical"
+)
+
+type importTracker interface {
+	StartImport(ctx context.Context, source, path, sha256 string) (string, error)
+	FinishImport(ctx context.Context, importID string, importErr error) error
+}
+
+var _ importTracker = (*Storage)(nil)
+
+// trackImport records a run of an import command, attributing everything it
+// stores to the import so it can be rolled back.
+func trackImport(ctx context.Context, l logger, store importTracker, source, path string, run func(ctx context.Context) error) error {
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	id, err := store.StartImport(ctx, source, path, sum)
+	if err != nil {
+		return err
+	}
+	l.Printf("Started import %s", id)
+
+	runErr := run(withImport(ctx, id))
+	if err := store.FinishImport(ctx, id, runErr); err != nil {
+		if runErr != nil {
+			return runErr
+		}
+		return err
+	}
+	if runErr != nil {
+		l.Printf("Import %s failed, rows it stored can be removed with: imports rollback -id %s", id, id)
+	}
+	return runErr
+}
+
+// fileSHA256 returns the hex encoded hash of the file. Empty if path isn't a
+// single file, e.g a directory.
+func fileSHA256(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("stat %s: %v", path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type importsStorage interface {
+	Imports(ctx context.Context) ([]Import, error)
+	RollbackImport(ctx context.Context, importID string) (deleted int, _ error)
+}
+
+var _ importsStorage = (*Storage)(nil)
+
+// importsCommand lists imports, and rolls them back
+type importsCommand struct {
+	log logger
+	out io.Writer
+
+	action string
+
+	// for rollback
+	id string
+
+	store importsStorage
+}
+
+func (i *importsCommand) Validate() error {
+	var errs []string
+
+	switch i.action {
+	case "list":
+	case "rollback":
+		if i.id == "" {
+			errs = append(errs, "id required")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("action must be one of list or rollback, not %q", i.action))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (i *importsCommand) run(ctx context.Context) error {
+	switch i.action {
+	case "list":
+		imps, err := i.store.Imports(ctx)
+		if err != nil {
+			return fmt.Errorf("listing imports: %v", err)
+		}
+		tw := tabwriter.NewWriter(i.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSOURCE\tSTARTED\tFINISHED\tROWS\tSTATUS\tPATH")
+		for _, im := range imps {
+			path := im.Path
+			if path == "" {
+				path = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", im.ID, im.Source, im.StartedAt.Format(time.RFC3339), fmtOptionalTime(im.FinishedAt), im.Rows, importStatus(im), path)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	case "rollback":
+		n, err := i.store.RollbackImport(ctx, i.id)
+		if err != nil {
+			return fmt.Errorf("rolling back import: %v", err)
+		}
+		i.log.Printf("Rolled back import %s, deleted %d rows", i.id, n)
+	}
+	return nil
+}
+
+func importStatus(im Import) string {
+	switch {
+	case im.RolledBackAt != nil:
+		return "rolled back " + im.RolledBackAt.Format(time.RFC3339)
+	case im.FinishedAt == nil:
+		return "running"
+	case im.Error != "":
+		return "failed: " + im.Error
+	default:
+		return "ok"
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImports(t *testing.T) {
+	ctx, s := setupDB(t)
+	l := log.New(os.Stderr, "", log.LstdFlags)
+
+	dir := t.TempDir()
+	csvImport := func(name, data string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := &csvimportCommand{
+			log:        l,
+			out:        io.Discard,
+			path:       path,
+			source:     sourceCSV,
+			username:   "jane",
+			device:     "phone",
+			columns:    csvColumns{Lat: "lat", Lng: "lng", Timestamp: "time"},
+			delimiter:  ',',
+			timeFormat: csvTimeRFC3339,
+			loc:        time.UTC,
+			batchSize:  100,
+			store:      s,
+		}
+		if err := trackImport(ctx, l, s, sourceCSV, path, cmd.run); err != nil {
+			t.Fatal(err)
+		}
+		imps, err := s.Imports(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return imps[0].ID
+	}
+
+	good := csvImport("good.csv", "lat,lng,time\n"+
+		"52.5,13.4,2019-06-12T10:00:00Z\n"+
+		"52.6,13.5,2019-06-12T11:00:00Z\n")
+	bad := csvImport("bad.csv", "lat,lng,time\n"+
+		"52.6,13.5,2019-06-12T11:00:00Z\n"+ // already imported by good
+		"0.1,0.1,2019-06-12T12:00:00Z\n"+
+		"0.2,0.2,2019-06-12T13:00:00Z\n")
+
+	imps, err := s.Imports(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imps) != 2 {
+		t.Fatalf("want 2 imports, got %d", len(imps))
+	}
+	for _, im := range imps {
+		wantRows := map[string]int{good: 2, bad: 2}[im.ID]
+		if im.Rows != wantRows || im.FinishedAt == nil || im.Error != "" || im.Source != sourceCSV || len(im.SHA256) != 64 {
+			t.Errorf("unexpected import: %#v", im)
+		}
+	}
+
+	from, to := time.Date(2019, 6, 12, 0, 0, 0, 0, time.UTC), time.Date(2019, 6, 13, 0, 0, 0, 0, time.UTC)
+	locCount := func(f ImportFilter) int {
+		t.Helper()
+		locs, err := s.RecentLocations(ctx, from, to, LocationFilter{ImportFilter: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(locs)
+	}
+	if n := locCount(ImportFilter{Import: bad}); n != 2 {
+		t.Errorf("want 2 locations from the bad import, got %d", n)
+	}
+	if n := locCount(ImportFilter{HideImport: bad}); n != 2 {
+		t.Errorf("want 2 locations hiding the bad import, got %d", n)
+	}
+
+	var out bytes.Buffer
+	cmd := &importsCommand{log: l, out: &out, action: "rollback", id: bad, store: s}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.run(ctx); err == nil {
+		t.Error("want error rolling back twice")
+	}
+	if n := locCount(ImportFilter{}); n != 2 {
+		t.Errorf("want the 2 locations from the good import left, got %d", n)
+	}
+
+	cmd.action = "list"
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{good, bad, "rolled back", "ok", "bad.csv"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want %q in list:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestTrackImportFailed(t *testing.T) {
+	ctx, s := setupDB(t)
+	l := log.New(os.Stderr, "", log.LstdFlags)
+
+	err := trackImport(ctx, l, s, sourceGPX, "", func(ctx context.Context) error {
+		if _, err := s.AddDeviceLocations(ctx, "jane", "phone", []newDeviceLocation{
+			{Source: sourceGPX, Lat: 52.5, Lng: 13.4, Timestamp: time.Date(2019, 6, 12, 10, 0, 0, 0, time.UTC)},
+		}); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("want the import's error, got %v", err)
+	}
+
+	imps, err := s.Imports(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imps) != 1 || imps[0].Error != io.ErrUnexpectedEOF.Error() || imps[0].Rows != 1 {
+		t.Fatalf("want failed import with the row it stored, got %#v", imps)
+	}
+	if importStatus(imps[0]) != "failed: "+io.ErrUnexpectedEOF.Error() {
+		t.Errorf("unexpected status %q", importStatus(imps[0]))
+	}
+
+	n, err := s.RollbackImport(ctx, imps[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 row deleted, got %d", n)
+	}
+}
+
+func TestImportKeepsExistingRows(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	start := time.Date(2019, 6, 12, 10, 0, 0, 0, time.UTC)
+	store := func(name string) string {
+		t.Helper()
+		id, err := s.StartImport(ctx, sourceGoogleSemantic, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ictx := withImport(ctx, id)
+		if err := s.AddVisits(ictx, "jane", "phone", []newVisit{
+			{Visit: Visit{Name: name, Lat: 52.5, Lng: 13.4, StartTime: start, EndTime: start.Add(time.Hour)}, Source: sourceGoogleSemantic},
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpsertICalTrips(ictx, []icalTrip{
+			{UID: "trip", Name: name, StartDate: start, EndDate: start},
+		}, []icalSegment{
+			{UID: "flight", TripUID: "trip", Type: tripSegmentFlight, Summary: name},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.FinishImport(ctx, id, nil); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	check := func(want string) {
+		t.Helper()
+		visits, err := s.Visits(ctx, start, start.Add(time.Hour), LocationFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(visits) != 1 || visits[0].Name != want {
+			t.Errorf("want visit %q, got %#v", want, visits)
+		}
+		var trip, segment string
+		if err := s.db.QueryRowContext(ctx, `select t.name, s.summary from trips t join trip_segments s on s.trip_id = t.id`).Scan(&trip, &segment); err != nil {
+			t.Fatal(err)
+		}
+		if trip != want || segment != want {
+			t.Errorf("want trip and segment %q, got %q and %q", want, trip, segment)
+		}
+	}
+
+	store("first")
+	second := store("second")
+	check("first")
+
+	if _, err := s.RollbackImport(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	check("first")
+}
+
+func TestRollbackImportSharedPhotoLocation(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	// burst shots, taken at the same time and place, imported separately
+	loc := newDeviceLocation{Source: sourcePhoto, Lat: 52.5, Lng: 13.4, Timestamp: time.Date(2019, 6, 12, 10, 0, 0, 0, time.UTC)}
+	store := func(sha string) string {
+		t.Helper()
+		id, err := s.StartImport(ctx, sourcePhoto, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.AddPhoto(withImport(ctx, id), "jane", "camera", newPhoto{SHA256: sha, Path: sha + ".jpg", Location: loc}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.FinishImport(ctx, id, nil); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	first, second := store("aaaa"), store("bbbb")
+
+	photoCount := func() int {
+		t.Helper()
+		phs, err := s.Photos(ctx, loc.Timestamp.Add(-time.Minute), loc.Timestamp.Add(time.Minute), LocationFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(phs)
+	}
+
+	if _, err := s.RollbackImport(ctx, first); err == nil || !strings.Contains(err.Error(), second) {
+		t.Errorf("want rolling back the first import refused while the second uses its location, got %v", err)
+	}
+	if n := photoCount(); n != 2 {
+		t.Fatalf("want both photos kept after a refused rollback, got %d", n)
+	}
+
+	if _, err := s.RollbackImport(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if n := photoCount(); n != 1 {
+		t.Errorf("want the first import's photo left, got %d", n)
+	}
+	if _, err := s.RollbackImport(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if n := photoCount(); n != 0 {
+		t.Errorf("want no photos left, got %d", n)
+	}
+}
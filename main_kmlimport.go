@@ -0,0 +1,431 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type kmlStorage interface {
+	AddDeviceLocations(ctx context.Context, username, device string, locs []newDeviceLocation) (duplicates int, _ error)
+	AddVisits(ctx context.Context, username, device string, visits []newVisit, segments []newActivitySegment) error
+	AddPlaces(ctx context.Context, username, device string, places []newPlace) (duplicates int, _ error)
+}
+
+var _ kmlStorage = (*Storage)(nil)
+
+// kmlPlacemark is a Placemark element. We handle Point, LineString and
+// gx:Track geometries, directly or in a MultiGeometry or gx:MultiTrack.
+type kmlPlacemark struct {
+	Name        string `xml:"name"`
+	Address     string `xml:"address"`
+	Description string `xml:"description"`
+	TimeStamp   struct {
+		When string `xml:"when"`
+	} `xml:"TimeStamp"`
+	TimeSpan struct {
+		Begin string `xml:"begin"`
+		End   string `xml:"end"`
+	} `xml:"TimeSpan"`
+	kmlGeometries
+	MultiGeometry kmlGeometries `xml:"MultiGeometry"`
+	MultiTrack    struct {
+		Tracks []kmlTrack `xml:"Track"`
+	} `xml:"MultiTrack"`
+
+	Inner string `xml:",innerxml"`
+}
+
+type kmlGeometries struct {
+	Points []struct {
+		Coordinates string `xml:"coordinates"`
+	} `xml:"Point"`
+	LineStrings []struct {
+		Coordinates string `xml:"coordinates"`
+	} `xml:"LineString"`
+	Tracks []kmlTrack `xml:"Track"`
+}
+
+// kmlTrack is a gx:Track, with a when for each gx:coord
+type kmlTrack struct {
+	When  []string `xml:"when"`
+	Coord []string `xml:"coord"`
+}
+
+// kmlCoord is a point, altitude is optional
+type kmlCoord struct {
+	Lat float64
+	Lng float64
+	Alt *float64
+}
+
+// kmlItems is what we import from placemarks
+type kmlItems struct {
+	locations []newDeviceLocation
+	visits    []newVisit
+	segments  []newActivitySegment
+	places    []newPlace
+	// untimed is the number of lines without a time, which we can't import
+	untimed int
+}
+
+type kmlimportCommand struct {
+	log logger
+
+	path        string
+	source      string
+	username    string
+	device      string
+	batchSize   int
+	skipInvalid bool
+
+	store kmlStorage
+}
+
+func (k *kmlimportCommand) run(ctx context.Context) error {
+	k.log.Printf("Importing KML from %s", k.path)
+
+	var (
+		batch    []newDeviceLocation
+		files    int
+		imported int
+		dups     int
+		visits   int
+		segments int
+		places   int
+		untimed  int
+		invalid  int
+	)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		d, err := k.store.AddDeviceLocations(ctx, k.username, k.device, batch)
+		if err != nil {
+			return fmt.Errorf("importing locations: %v", err)
+		}
+		imported += len(batch) - d
+		dups += d
+		batch = batch[:0]
+		return nil
+	}
+
+	importKML := func(name string, r io.Reader) error {
+		var items kmlItems
+		dec := xml.NewDecoder(r)
+		for idx := 0; ; idx++ {
+			pm, err := nextKMLPlacemark(dec)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("reading %s: %v", name, err)
+			}
+
+			var pmItems kmlItems
+			if err := pmItems.add(k.source, pm); err != nil {
+				if !k.skipInvalid {
+					return fmt.Errorf("%s placemark %d: %v (use -skip-invalid to skip invalid placemarks)", name, idx, err)
+				}
+				k.log.Printf("skipping invalid placemark %d in %s: %v", idx, name, err)
+				invalid++
+				continue
+			}
+			items.visits = append(items.visits, pmItems.visits...)
+			items.segments = append(items.segments, pmItems.segments...)
+			items.places = append(items.places, pmItems.places...)
+			untimed += pmItems.untimed
+
+			for _, l := range pmItems.locations {
+				batch = append(batch, l)
+				if len(batch) >= k.batchSize {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		if len(items.visits) > 0 || len(items.segments) > 0 {
+			if err := k.store.AddVisits(ctx, k.username, k.device, items.visits, items.segments); err != nil {
+				return fmt.Errorf("importing visits from %s: %v", name, err)
+			}
+			visits += len(items.visits)
+			segments += len(items.segments)
+		}
+		if len(items.places) > 0 {
+			d, err := k.store.AddPlaces(ctx, k.username, k.device, items.places)
+			if err != nil {
+				return fmt.Errorf("importing places from %s: %v", name, err)
+			}
+			places += len(items.places) - d
+		}
+
+		files++
+		k.log.Printf("Handled %s. %d locations, %d visits and %d places imported so far", name, imported, visits, places)
+		return nil
+	}
+
+	// path can be a single file, or a directory of them
+	err := filepath.WalkDir(k.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".kml":
+			f, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("opening %s: %v", path, err)
+			}
+			defer f.Close()
+			return importKML(path, f)
+		case ".kmz":
+			// a zip, with the document (usually doc.kml) and any resources
+			// it uses
+			zr, err := zip.OpenReader(path)
+			if err != nil {
+				return fmt.Errorf("opening %s: %v", path, err)
+			}
+			defer zr.Close()
+			for _, zf := range zr.File {
+				if !strings.EqualFold(filepath.Ext(zf.Name), ".kml") {
+					continue
+				}
+				f, err := zf.Open()
+				if err != nil {
+					return fmt.Errorf("opening %s in %s: %v", zf.Name, path, err)
+				}
+				err = importKML(path+"/"+zf.Name, f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	k.log.Printf("Done, %d files. Imported %d locations, %d visits, %d activity segments and %d places, skipped %d locations already imported, %d lines without a time and %d invalid placemarks",
+		files, imported, visits, segments, places, dups, untimed, invalid)
+	return nil
+}
+
+// nextKMLPlacemark reads the next placemark in the document, returning io.EOF
+// when there are no more.
+func nextKMLPlacemark(dec *xml.Decoder) (kmlPlacemark, error) {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return kmlPlacemark{}, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "Placemark" {
+			continue
+		}
+		var pm kmlPlacemark
+		if err := dec.DecodeElement(&pm, &se); err != nil {
+			return kmlPlacemark{}, err
+		}
+		return pm, nil
+	}
+}
+
+// add converts the placemark's geometries. Tracks become locations. Lines are
+// activity segments, if they have a time span. Points are visits if they have a
+// time span, otherwise places.
+func (k *kmlItems) add(source string, pm kmlPlacemark) error {
+	var begin, end time.Time
+	if pm.TimeSpan.Begin != "" && pm.TimeSpan.End != "" {
+		var err error
+		if begin, err = parseKMLTime(pm.TimeSpan.Begin); err != nil {
+			return fmt.Errorf("time span begin: %v", err)
+		}
+		if end, err = parseKMLTime(pm.TimeSpan.End); err != nil {
+			return fmt.Errorf("time span end: %v", err)
+		}
+	}
+	var stamp *time.Time
+	if pm.TimeStamp.When != "" {
+		ts, err := parseKMLTime(pm.TimeStamp.When)
+		if err != nil {
+			return fmt.Errorf("time stamp: %v", err)
+		}
+		stamp = &ts
+	}
+	raw := []byte("<Placemark>" + pm.Inner + "</Placemark>")
+
+	var tracks []kmlTrack
+	tracks = append(tracks, pm.Tracks...)
+	tracks = append(tracks, pm.MultiGeometry.Tracks...)
+	tracks = append(tracks, pm.MultiTrack.Tracks...)
+	for ti, t := range tracks {
+		if len(t.When) != len(t.Coord) {
+			return fmt.Errorf("track %d has %d times for %d coordinates", ti, len(t.When), len(t.Coord))
+		}
+		for i := range t.When {
+			ts, err := parseKMLTime(t.When[i])
+			if err != nil {
+				return fmt.Errorf("track %d point %d: %v", ti, i, err)
+			}
+			c, err := parseKMLTrackCoord(t.Coord[i])
+			if err != nil {
+				return fmt.Errorf("track %d point %d: %v", ti, i, err)
+			}
+			k.locations = append(k.locations, newDeviceLocation{
+				Source:    source,
+				Lat:       c.Lat,
+				Lng:       c.Lng,
+				Timestamp: ts,
+				Altitude:  scaledMeasurement(c.Alt, 1),
+				Raw:       []byte("<when>" + t.When[i] + "</when><gx:coord>" + t.Coord[i] + "</gx:coord>"),
+			})
+		}
+	}
+
+	for li, l := range append(pm.LineStrings, pm.MultiGeometry.LineStrings...) {
+		coords, err := parseKMLCoordinates(l.Coordinates)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", li, err)
+		}
+		if begin.IsZero() || len(coords) == 0 {
+			// we don't know when the line was travelled
+			k.untimed++
+			continue
+		}
+		first, last := coords[0], coords[len(coords)-1]
+		a := newActivitySegment{
+			Source:    source,
+			StartLat:  first.Lat,
+			StartLng:  first.Lng,
+			EndLat:    last.Lat,
+			EndLng:    last.Lng,
+			StartTime: begin,
+			EndTime:   end,
+			Raw:       raw,
+		}
+		for _, c := range coords {
+			a.Waypoints = append(a.Waypoints, [2]float64{c.Lng, c.Lat})
+		}
+		// the span is when the whole line was travelled, we don't know when
+		// any point on it was passed so it doesn't make any locations
+		k.segments = append(k.segments, a)
+	}
+
+	for pi, p := range append(pm.Points, pm.MultiGeometry.Points...) {
+		coords, err := parseKMLCoordinates(p.Coordinates)
+		if err != nil {
+			return fmt.Errorf("point %d: %v", pi, err)
+		}
+		if len(coords) != 1 {
+			return fmt.Errorf("point %d has %d coordinates", pi, len(coords))
+		}
+		c := coords[0]
+		if !begin.IsZero() {
+			k.visits = append(k.visits, newVisit{
+				Visit: Visit{
+					Name:      strings.TrimSpace(pm.Name),
+					Address:   strings.TrimSpace(pm.Address),
+					Lat:       c.Lat,
+					Lng:       c.Lng,
+					StartTime: begin,
+					EndTime:   end,
+				},
+				Source: source,
+				Raw:    raw,
+			})
+			continue
+		}
+		k.places = append(k.places, newPlace{
+			Source:      source,
+			Name:        strings.TrimSpace(pm.Name),
+			Description: strings.TrimSpace(pm.Description),
+			Lat:         c.Lat,
+			Lng:         c.Lng,
+			Elevation:   scaledMeasurement(c.Alt, 1),
+			Timestamp:   stamp,
+			Raw:         raw,
+		})
+	}
+
+	return nil
+}
+
+// parseKMLCoordinates parses the coordinates of a Point or LineString, which
+// are whitespace separated lng,lat[,alt] tuples.
+func parseKMLCoordinates(s string) ([]kmlCoord, error) {
+	var ret []kmlCoord
+	for _, t := range strings.Fields(s) {
+		c, err := parseKMLCoord(strings.Split(t, ","))
+		if err != nil {
+			return nil, fmt.Errorf("coordinate %q: %v", t, err)
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// parseKMLTrackCoord parses a gx:coord, which is "lng lat [alt]"
+func parseKMLTrackCoord(s string) (kmlCoord, error) {
+	c, err := parseKMLCoord(strings.Fields(s))
+	if err != nil {
+		return kmlCoord{}, fmt.Errorf("coordinate %q: %v", s, err)
+	}
+	return c, nil
+}
+
+func parseKMLCoord(parts []string) (kmlCoord, error) {
+	if len(parts) < 2 || len(parts) > 3 {
+		return kmlCoord{}, fmt.Errorf("want lng, lat and optionally altitude")
+	}
+	var (
+		c   kmlCoord
+		err error
+	)
+	if c.Lng, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return kmlCoord{}, fmt.Errorf("invalid longitude")
+	}
+	if c.Lat, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return kmlCoord{}, fmt.Errorf("invalid latitude")
+	}
+	if len(parts) == 3 {
+		alt, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return kmlCoord{}, fmt.Errorf("invalid altitude")
+		}
+		c.Alt = &alt
+	}
+	return c, validLatLng(c.Lat, c.Lng)
+}
+
+// parseKMLTime parses a KML time, which can be a full time with or without a
+// zone (UTC is assumed), or just a date. Times are returned in UTC, tracks can
+// mix zones and we want them stored in order.
+func parseKMLTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05.999999999", "2006-01-02", "2006-01", "2006"} {
+		if ts, err := time.Parse(layout, s); err == nil {
+			return ts.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const egKMLTimeline = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+  <Document>
+    <Placemark>
+      <name>Cafe</name>
+      <address>1 Main St</address>
+      <TimeSpan><begin>2019-05-01T09:00:00.000Z</begin><end>2019-05-01T10:00:00.000Z</end></TimeSpan>
+      <Point><coordinates>13.405,52.52,0</coordinates></Point>
+    </Placemark>
+    <Placemark>
+      <name>Driving</name>
+      <TimeSpan><begin>2019-05-01T10:00:00.000Z</begin><end>2019-05-01T10:30:00.000Z</end></TimeSpan>
+      <LineString><coordinates>13.405,52.52,0 13.41,52.53,0
+        13.42,52.54,0</coordinates></LineString>
+    </Placemark>
+    <Placemark>
+      <name>Planned</name>
+      <LineString><coordinates>1,2 3,4</coordinates></LineString>
+    </Placemark>
+    <Placemark>
+      <name>Museum</name>
+      <TimeSpan><begin>2019-05-01</begin><end>2019-05-02</end></TimeSpan>
+      <Point><coordinates>13.39,52.51</coordinates></Point>
+    </Placemark>
+    <Placemark>
+      <name>Parks</name>
+      <TimeSpan><begin>2019-05-01</begin><end>2019-05-02</end></TimeSpan>
+      <MultiGeometry>
+        <Point><coordinates>13.37,52.51</coordinates></Point>
+        <Point><coordinates>13.38,52.515</coordinates></Point>
+      </MultiGeometry>
+    </Placemark>
+    <Placemark>
+      <name>Favourite spot</name>
+      <description>nice view</description>
+      <Point><coordinates>13.5,52.6</coordinates></Point>
+    </Placemark>
+  </Document>
+</kml>`
+
+const egKMLTrack = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+  <Folder>
+    <Placemark>
+      <name>Trip</name>
+      <gx:Track>
+        <when>2010-07-01T08:00:00Z</when>
+        <when>2010-07-01T08:01:00+02:00</when>
+        <gx:coord>-122.207881 37.371915 156.0</gx:coord>
+        <gx:coord>-122.205712 37.373288 152.0</gx:coord>
+      </gx:Track>
+    </Placemark>
+  </Folder>
+</kml>`
+
+func TestKMLImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "timeline.kml"), []byte(egKMLTimeline), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "trips"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "trips", "2010.kmz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("doc.kml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(egKMLTrack)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &kmlimportCommand{
+		log:       log.New(os.Stderr, "", log.LstdFlags),
+		path:      dir,
+		source:    sourceKML,
+		batchSize: 10,
+		store:     s,
+	}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// importing again shouldn't duplicate anything
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	locs, err := s.RecentLocations(ctx, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// just the track points, lines don't say when each point was passed
+	if len(locs) != 2 {
+		t.Fatalf("want 2 locations, got %d", len(locs))
+	}
+	// the second track point is earlier, because of its zone
+	if locs[0].Lat != 37.373288 || locs[0].Altitude == nil || *locs[0].Altitude != 152 || !locs[0].Timestamp.Equal(time.Date(2010, 7, 1, 6, 1, 0, 0, time.UTC)) {
+		t.Errorf("unexpected track location: %#v", locs[0])
+	}
+
+	vs, err := s.Visits(ctx, time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 5, 2, 0, 0, 0, 0, time.UTC), LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// placemarks sharing a time span, and points in one placemark, are all
+	// kept
+	if len(vs) != 4 {
+		t.Fatalf("want 4 visits, got %#v", vs)
+	}
+	var names []string
+	for _, v := range vs {
+		names = append(names, v.Name)
+	}
+	if got := strings.Join(names, ","); got != "Museum,Parks,Parks,Cafe" {
+		t.Errorf("want the museum, both parks and the cafe, got %s", got)
+	}
+	if vs[3].Address != "1 Main St" || vs[3].Lat != 52.52 {
+		t.Errorf("unexpected visit: %#v", vs[3])
+	}
+
+	var (
+		count     int
+		waypoints string
+	)
+	if err := s.db.QueryRowContext(ctx, `select count(*), waypoints from activity_segments`).Scan(&count, &waypoints); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || waypoints != "[[13.405,52.52],[13.41,52.53],[13.42,52.54]]" {
+		t.Errorf("unexpected activity segments: count %d waypoints %s", count, waypoints)
+	}
+
+	var name, desc string
+	if err := s.db.QueryRowContext(ctx, `select count(*), name, description from places`).Scan(&count, &name, &desc); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || name != "Favourite spot" || desc != "nice view" {
+		t.Errorf("unexpected places: count %d name %s description %s", count, name, desc)
+	}
+}
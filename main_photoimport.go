@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type photoStorage interface {
+	AddPhoto(ctx context.Context, username, device string, p newPhoto) (inserted bool, _ error)
+}
+
+var _ photoStorage = (*Storage)(nil)
+
+// photoExts are the files we look in for EXIF
+var photoExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".heic": true,
+	".heif": true,
+}
+
+type photoimportCommand struct {
+	log logger
+
+	path     string
+	username string
+	device   string
+	// loc is used for photos that don't record their time zone
+	loc *time.Location
+
+	store photoStorage
+}
+
+// photoRaw is what we stored as the location's raw data, the EXIF fields it
+// came from
+type photoRaw struct {
+	Path               string  `json:"path"`
+	SHA256             string  `json:"sha256"`
+	Lat                float64 `json:"lat"`
+	Lng                float64 `json:"lng"`
+	DateTimeOriginal   string  `json:"date_time_original,omitempty"`
+	OffsetTimeOriginal string  `json:"offset_time_original,omitempty"`
+	GPSDateStamp       string  `json:"gps_date_stamp,omitempty"`
+}
+
+func (p *photoimportCommand) run(ctx context.Context) error {
+	p.log.Printf("Importing photo locations from %s", p.path)
+
+	var (
+		files    int
+		imported int
+		existing int
+		noFix    int
+		invalid  int
+	)
+
+	err := filepath.WalkDir(p.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !photoExts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		files++
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", path, err)
+		}
+
+		// a library will have the odd broken file, that shouldn't stop the
+		// rest being imported
+		photo, err := parsePhoto(path, b, p.loc)
+		if errors.Is(err, errNoEXIF) || errors.Is(err, errNoPhotoFix) {
+			noFix++
+			return nil
+		}
+		if err != nil {
+			p.log.Printf("skipping %s: %v", path, err)
+			invalid++
+			return nil
+		}
+
+		inserted, err := p.store.AddPhoto(ctx, p.username, p.device, photo)
+		if err != nil {
+			return err
+		}
+		if inserted {
+			imported++
+		} else {
+			existing++
+		}
+
+		if files%1000 == 0 {
+			p.log.Printf("Handled %d photos, %d imported so far", files, imported)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.log.Printf("Done, %d photos. Imported %d, skipped %d already imported, %d without a location and %d unreadable",
+		files, imported, existing, noFix, invalid)
+	return nil
+}
+
+var errNoPhotoFix = fmt.Errorf("photo has no GPS position")
+
+// parsePhoto reads the location the photo was taken at from its EXIF data
+func parsePhoto(path string, b []byte, loc *time.Location) (newPhoto, error) {
+	ex, err := readEXIF(b)
+	if err != nil {
+		return newPhoto{}, err
+	}
+	lat, lng, ok := ex.latLng()
+	if !ok {
+		return newPhoto{}, errNoPhotoFix
+	}
+	if err := validLatLng(lat, lng); err != nil {
+		return newPhoto{}, err
+	}
+	ts, err := ex.takenAt(loc)
+	if err != nil {
+		return newPhoto{}, err
+	}
+
+	sum := sha256.Sum256(b)
+	raw := photoRaw{
+		Path:               path,
+		SHA256:             hex.EncodeToString(sum[:]),
+		Lat:                lat,
+		Lng:                lng,
+		DateTimeOriginal:   ex.exif[exifTagDateTimeOriginal].string(),
+		OffsetTimeOriginal: ex.exif[exifTagOffsetTimeOriginal].string(),
+		GPSDateStamp:       ex.gps[gpsTagDateStamp].string(),
+	}
+	rawb, err := json.Marshal(raw)
+	if err != nil {
+		return newPhoto{}, fmt.Errorf("marshaling raw: %v", err)
+	}
+
+	return newPhoto{
+		SHA256: raw.SHA256,
+		Path:   path,
+		Location: newDeviceLocation{
+			Source: sourcePhoto,
+			Lat:    lat,
+			Lng:    lng,
+			// photos are in the zone they were taken in, store them in UTC
+			// so they sort with everything else
+			Timestamp:        ts.UTC(),
+			Accuracy:         knownMeasurement(ex.accuracy(), 1),
+			Altitude:         scaledMeasurement(ex.altitude(), 1),
+			Velocity:         knownMeasurement(ex.speed(), 1),
+			CourseOverGround: knownMeasurement(ex.course(), 1),
+			Raw:              rawb,
+		},
+	}, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testTIFFField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func testASCII(tag uint16, s string) testTIFFField {
+	return testTIFFField{tag: tag, typ: exifTypeASCII, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func testRationals(order binary.ByteOrder, tag uint16, vals ...[2]uint32) testTIFFField {
+	f := testTIFFField{tag: tag, typ: exifTypeRational, count: uint32(len(vals))}
+	for _, v := range vals {
+		f.data = append(f.data, testUint32(order, v[0])...)
+		f.data = append(f.data, testUint32(order, v[1])...)
+	}
+	return f
+}
+
+func testUint32(order binary.ByteOrder, v uint32) []byte {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return b
+}
+
+// testTIFF builds EXIF data with IFD0 pointing to the EXIF and GPS IFDs
+func testTIFF(order binary.ByteOrder, exif, gps []testTIFFField) []byte {
+	ifdSize := func(n int) int { return 2 + n*12 + 4 }
+	exifOff := 8 + ifdSize(2)
+	gpsOff := exifOff + ifdSize(len(exif))
+	dataOff := gpsOff + ifdSize(len(gps))
+
+	b := make([]byte, dataOff)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8)
+
+	var data []byte
+	writeIFD := func(off int, fields []testTIFFField) {
+		order.PutUint16(b[off:], uint16(len(fields)))
+		for i, f := range fields {
+			e := b[off+2+i*12:]
+			order.PutUint16(e, f.tag)
+			order.PutUint16(e[2:], f.typ)
+			order.PutUint32(e[4:], f.count)
+			if len(f.data) <= 4 {
+				copy(e[8:], f.data)
+			} else {
+				order.PutUint32(e[8:], uint32(dataOff+len(data)))
+				data = append(data, f.data...)
+			}
+		}
+	}
+	writeIFD(8, []testTIFFField{
+		{tag: exifTagExifIFD, typ: exifTypeLong, count: 1, data: testUint32(order, uint32(exifOff))},
+		{tag: exifTagGPSIFD, typ: exifTypeLong, count: 1, data: testUint32(order, uint32(gpsOff))},
+	})
+	writeIFD(exifOff, exif)
+	writeIFD(gpsOff, gps)
+
+	return append(b, data...)
+}
+
+func testJPEG(tiff []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xff, 0xd8})
+	// a JFIF segment to skip over
+	jfif := []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	b.Write([]byte{0xff, 0xe0})
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(jfif)+2))
+	b.Write(jfif)
+	if tiff != nil {
+		b.Write([]byte{0xff, 0xe1})
+		_ = binary.Write(&b, binary.BigEndian, uint16(len(tiff)+8))
+		b.WriteString("Exif\x00\x00")
+		b.Write(tiff)
+	}
+	b.Write([]byte{0xff, 0xda, 0x00, 0x02, 0x01, 0x02, 0xff, 0xd9})
+	return b.Bytes()
+}
+
+func testBox(typ string, data ...[]byte) []byte {
+	b := bytes.Join(data, nil)
+	return append(binary.BigEndian.AppendUint32([]byte(nil), uint32(len(b)+8)), append([]byte(typ), b...)...)
+}
+
+// testHEIC builds a HEIC file with just the Exif item, stored in the mdat box
+func testHEIC(tiff []byte) []byte {
+	ftyp := testBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	infe := testBox("infe", []byte{2, 0, 0, 0}, []byte{0, 7, 0, 0}, []byte("Exif\x00"))
+	iinf := testBox("iinf", []byte{0, 0, 0, 0, 0, 1}, infe)
+	item := append([]byte{0, 0, 0, 6}, append([]byte("Exif\x00\x00"), tiff...)...)
+
+	iloc := func(off uint32) []byte {
+		d := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 1, 0, 7, 0, 0, 0, 1}
+		d = binary.BigEndian.AppendUint32(d, off)
+		d = binary.BigEndian.AppendUint32(d, uint32(len(item)))
+		return testBox("iloc", d)
+	}
+	meta := func(off uint32) []byte {
+		return testBox("meta", []byte{0, 0, 0, 0}, testBox("hdlr", make([]byte, 24)), iinf, iloc(off))
+	}
+	off := uint32(len(ftyp) + len(meta(0)) + 8)
+	return bytes.Join([][]byte{ftyp, meta(off), testBox("mdat", item)}, nil)
+}
+
+func TestPhotoImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	le, be := binary.LittleEndian, binary.BigEndian
+	dir := t.TempDir()
+	files := map[string][]byte{
+		// Berlin, with the offset from UTC recorded
+		"2019/berlin.jpg": testJPEG(testTIFF(le,
+			[]testTIFFField{
+				testASCII(exifTagDateTimeOriginal, "2019:06:12 16:22:44"),
+				testASCII(exifTagOffsetTimeOriginal, "+02:00"),
+			},
+			[]testTIFFField{
+				testASCII(gpsTagLatitudeRef, "N"),
+				testRationals(le, gpsTagLatitude, [2]uint32{52, 1}, [2]uint32{31, 1}, [2]uint32{1200, 100}),
+				testASCII(gpsTagLongitudeRef, "E"),
+				testRationals(le, gpsTagLongitude, [2]uint32{13, 1}, [2]uint32{24, 1}, [2]uint32{1800, 100}),
+				{tag: gpsTagAltitudeRef, typ: exifTypeByte, count: 1, data: []byte{0}},
+				testRationals(le, gpsTagAltitude, [2]uint32{345, 10}),
+				testASCII(gpsTagSpeedRef, "K"),
+				testRationals(le, gpsTagSpeed, [2]uint32{5, 1}),
+				testRationals(le, gpsTagHPositioningError, [2]uint32{8, 1}),
+			})),
+		// Sydney, only the GPS time is in UTC
+		"2019/sydney.heic": testHEIC(testTIFF(be,
+			[]testTIFFField{
+				testASCII(exifTagDateTimeOriginal, "2019:06:14 19:30:00"),
+			},
+			[]testTIFFField{
+				testASCII(gpsTagLatitudeRef, "S"),
+				testRationals(be, gpsTagLatitude, [2]uint32{33, 1}, [2]uint32{51, 1}, [2]uint32{0, 1}),
+				testASCII(gpsTagLongitudeRef, "E"),
+				testRationals(be, gpsTagLongitude, [2]uint32{151, 1}, [2]uint32{12, 1}, [2]uint32{0, 1}),
+				testASCII(gpsTagDateStamp, "2019:06:14"),
+				testRationals(be, gpsTagTimeStamp, [2]uint32{9, 1}, [2]uint32{30, 1}, [2]uint32{0, 1}),
+			})),
+		// no position
+		"2019/indoors.JPG": testJPEG(testTIFF(le,
+			[]testTIFFField{testASCII(exifTagDateTimeOriginal, "2019:06:13 10:00:00")},
+			nil)),
+		"2019/stripped.jpg": testJPEG(nil),
+		"2019/broken.jpg":   []byte("not a jpeg"),
+		"2019/notes.txt":    []byte("not a photo"),
+	}
+	// the same photo in two places
+	files["backup/berlin-copy.jpg"] = files["2019/berlin.jpg"]
+
+	for name, b := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := &photoimportCommand{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		path:  dir,
+		loc:   time.UTC,
+		store: s,
+	}
+	for i := 0; i < 2; i++ {
+		if err := cmd.run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations where source = ?`, sourcePhoto).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("want 2 photo locations, got %d", count)
+	}
+
+	// the copy is walked after the original, so the path is updated to it
+	phs, err := s.Photos(ctx, time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(phs) != 2 {
+		t.Fatalf("want 2 photos, got %d", len(phs))
+	}
+
+	berlin, sydney := phs[0], phs[1]
+	if filepath.Base(berlin.Path) != "berlin-copy.jpg" {
+		t.Errorf("want path of the last copy imported, got %s", berlin.Path)
+	}
+	if !berlin.TakenAt.Equal(time.Date(2019, 6, 12, 14, 22, 44, 0, time.UTC)) {
+		t.Errorf("want berlin photo taken at 14:22:44 UTC, got %s", berlin.TakenAt)
+	}
+	if berlin.Lat < 52.519 || berlin.Lat > 52.521 || berlin.Lng < 13.404 || berlin.Lng > 13.406 {
+		t.Errorf("unexpected berlin position %f,%f", berlin.Lat, berlin.Lng)
+	}
+	if !sydney.TakenAt.Equal(time.Date(2019, 6, 14, 9, 30, 0, 0, time.UTC)) {
+		t.Errorf("want sydney photo at the GPS time, got %s", sydney.TakenAt)
+	}
+	if sydney.Lat != -33.85 || sydney.Lng != 151.2 {
+		t.Errorf("unexpected sydney position %f,%f", sydney.Lat, sydney.Lng)
+	}
+
+	var alt, vel, acc int
+	if err := s.db.QueryRowContext(ctx, `select altitude, velocity, accuracy from device_locations where source = ? order by timestamp limit 1`, sourcePhoto).Scan(&alt, &vel, &acc); err != nil {
+		t.Fatal(err)
+	}
+	if alt != 35 || vel != 5 || acc != 8 {
+		t.Errorf("want altitude 35, velocity 5 and accuracy 8, got %d, %d and %d", alt, vel, acc)
+	}
+}
+
+func TestReadEXIFMalformedHEIC(t *testing.T) {
+	ftyp := testBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	infe := testBox("infe", []byte{2, 0, 0, 0}, []byte{0, 7, 0, 0}, []byte("Exif\x00"))
+	iinf := testBox("iinf", []byte{0, 0, 0, 0, 0, 1}, infe)
+	// an iloc box locating the exif item with 8 byte offsets, lengths and
+	// base offsets
+	heic := func(base, off, l uint64) []byte {
+		d := []byte{0, 0, 0, 0, 0x88, 0x80, 0, 1, 0, 7, 0, 0}
+		d = binary.BigEndian.AppendUint64(d, base)
+		d = append(d, 0, 1)
+		d = binary.BigEndian.AppendUint64(d, off)
+		d = binary.BigEndian.AppendUint64(d, l)
+		meta := testBox("meta", []byte{0, 0, 0, 0}, testBox("hdlr", make([]byte, 24)), iinf, testBox("iloc", d))
+		return bytes.Join([][]byte{ftyp, meta, testBox("mdat", make([]byte, 64))}, nil)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		base, off, l uint64
+	}{
+		{name: "offset plus length overflows", off: math.MaxUint64 - 3, l: 8},
+		{name: "base plus offset overflows", base: math.MaxUint64, off: 2, l: 8},
+		{name: "length past the end", off: 8, l: math.MaxUint64},
+		{name: "offset past the end", off: 1 << 40, l: 8},
+	} {
+		if _, err := readEXIF(heic(tc.base, tc.off, tc.l)); err == nil {
+			t.Errorf("%s: want error", tc.name)
+		}
+	}
+}
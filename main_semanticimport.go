@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type semanticHistoryStorage interface {
+	AddVisits(ctx context.Context, username, device string, visits []newVisit, segments []newActivitySegment) error
+}
+
+var _ semanticHistoryStorage = (*Storage)(nil)
+
+// semanticHistoryFile is a month of takeout's Semantic Location History, e.g
+// Semantic Location History/2020/2020_JUNE.json. Each timeline object has one
+// of a placeVisit or activitySegment.
+type semanticHistoryFile struct {
+	TimelineObjects []json.RawMessage `json:"timelineObjects"`
+}
+
+type semanticTimelineObject struct {
+	PlaceVisit      json.RawMessage `json:"placeVisit"`
+	ActivitySegment json.RawMessage `json:"activitySegment"`
+}
+
+type semanticPlaceVisit struct {
+	Location struct {
+		LatitudeE7   int    `json:"latitudeE7"`
+		LongitudeE7  int    `json:"longitudeE7"`
+		PlaceID      string `json:"placeId"`
+		Address      string `json:"address"`
+		Name         string `json:"name"`
+		SemanticType string `json:"semanticType"`
+	} `json:"location"`
+	Duration semanticDuration `json:"duration"`
+	// where the visit was centered, used when the location has no coordinates
+	CenterLatE7 int `json:"centerLatE7"`
+	CenterLngE7 int `json:"centerLngE7"`
+}
+
+type semanticActivitySegment struct {
+	StartLocation semanticLocation `json:"startLocation"`
+	EndLocation   semanticLocation `json:"endLocation"`
+	Duration      semanticDuration `json:"duration"`
+	// metres
+	Distance     *float64 `json:"distance"`
+	ActivityType string   `json:"activityType"`
+	WaypointPath struct {
+		Waypoints []struct {
+			LatE7 int `json:"latE7"`
+			LngE7 int `json:"lngE7"`
+		} `json:"waypoints"`
+	} `json:"waypointPath"`
+}
+
+type semanticLocation struct {
+	LatitudeE7  int `json:"latitudeE7"`
+	LongitudeE7 int `json:"longitudeE7"`
+}
+
+// semanticDuration is when something happened. Older exports use the Ms
+// fields, newer ones ISO 8601.
+type semanticDuration struct {
+	StartTimestampMs string `json:"startTimestampMs"`
+	StartTimestamp   string `json:"startTimestamp"`
+	EndTimestampMs   string `json:"endTimestampMs"`
+	EndTimestamp     string `json:"endTimestamp"`
+}
+
+func (d semanticDuration) times() (start, end time.Time, _ error) {
+	start, err := parseTakeoutTimestamp(d.StartTimestampMs, d.StartTimestamp)
+	if err != nil {
+		return start, end, fmt.Errorf("start: %v", err)
+	}
+	end, err = parseTakeoutTimestamp(d.EndTimestampMs, d.EndTimestamp)
+	if err != nil {
+		return start, end, fmt.Errorf("end: %v", err)
+	}
+	return start, end, nil
+}
+
+type semanticimportCommand struct {
+	log logger
+
+	path     string
+	username string
+	device   string
+
+	store semanticHistoryStorage
+}
+
+func (s *semanticimportCommand) run(ctx context.Context) error {
+	s.log.Printf("Importing semantic location history from %s", s.path)
+
+	var (
+		files    int
+		visits   int
+		segments int
+	)
+
+	// path can be a single month, or the whole directory
+	err := filepath.WalkDir(s.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".json") {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("opening %s: %v", path, err)
+		}
+		defer f.Close()
+
+		vs, as, skipped, err := parseSemanticHistory(f)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", path, err)
+		}
+		if skipped > 0 {
+			s.log.Printf("Skipped %d visits without a location in %s", skipped, path)
+		}
+
+		if err := s.store.AddVisits(ctx, s.username, s.device, vs, as); err != nil {
+			return fmt.Errorf("importing %s: %v", path, err)
+		}
+
+		files++
+		visits += len(vs)
+		segments += len(as)
+		s.log.Printf("Imported %s: %d visits, %d activity segments", path, len(vs), len(as))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.log.Printf("Import complete. %d files, %d visits, %d activity segments", files, visits, segments)
+	return nil
+}
+
+// parseSemanticHistory reads the visits and activity segments from a month of
+// semantic location history. Visits without a location are skipped, and
+// counted.
+func parseSemanticHistory(r io.Reader) (_ []newVisit, _ []newActivitySegment, skipped int, _ error) {
+	var f semanticHistoryFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, nil, 0, fmt.Errorf("decoding: %v", err)
+	}
+	if f.TimelineObjects == nil {
+		return nil, nil, 0, fmt.Errorf("no timelineObjects found in file")
+	}
+
+	var (
+		visits   []newVisit
+		segments []newActivitySegment
+	)
+	for i, raw := range f.TimelineObjects {
+		var to semanticTimelineObject
+		if err := json.Unmarshal(raw, &to); err != nil {
+			return nil, nil, 0, fmt.Errorf("timeline object %d: %v", i, err)
+		}
+
+		switch {
+		case to.PlaceVisit != nil:
+			v, err := parseSemanticPlaceVisit(to.PlaceVisit)
+			if errors.Is(err, errNoVisitLocation) {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return nil, nil, 0, fmt.Errorf("timeline object %d: place visit: %v", i, err)
+			}
+			visits = append(visits, v)
+		case to.ActivitySegment != nil:
+			a, err := parseSemanticActivitySegment(to.ActivitySegment)
+			if err != nil {
+				return nil, nil, 0, fmt.Errorf("timeline object %d: activity segment: %v", i, err)
+			}
+			segments = append(segments, a)
+		}
+	}
+
+	return visits, segments, skipped, nil
+}
+
+// errNoVisitLocation is returned for visits with no coordinates, which would
+// otherwise be stored at 0,0
+var errNoVisitLocation = fmt.Errorf("place visit has no location")
+
+func parseSemanticPlaceVisit(raw json.RawMessage) (newVisit, error) {
+	var pv semanticPlaceVisit
+	if err := json.Unmarshal(raw, &pv); err != nil {
+		return newVisit{}, err
+	}
+
+	start, end, err := pv.Duration.times()
+	if err != nil {
+		return newVisit{}, err
+	}
+
+	latE7, lngE7 := pv.Location.LatitudeE7, pv.Location.LongitudeE7
+	if latE7 == 0 && lngE7 == 0 {
+		latE7, lngE7 = pv.CenterLatE7, pv.CenterLngE7
+	}
+	if latE7 == 0 && lngE7 == 0 {
+		return newVisit{}, errNoVisitLocation
+	}
+	v := newVisit{
+		Visit: Visit{
+			PlaceID:      pv.Location.PlaceID,
+			Name:         pv.Location.Name,
+			Address:      pv.Location.Address,
+			SemanticType: pv.Location.SemanticType,
+			Lat:          e7ToNormal(latE7),
+			Lng:          e7ToNormal(lngE7),
+			StartTime:    start,
+			EndTime:      end,
+		},
+		Source: sourceGoogleSemantic,
+		Raw:    raw,
+	}
+	return v, validLatLng(v.Lat, v.Lng)
+}
+
+func parseSemanticActivitySegment(raw json.RawMessage) (newActivitySegment, error) {
+	var as semanticActivitySegment
+	if err := json.Unmarshal(raw, &as); err != nil {
+		return newActivitySegment{}, err
+	}
+
+	start, end, err := as.Duration.times()
+	if err != nil {
+		return newActivitySegment{}, err
+	}
+
+	a := newActivitySegment{
+		Source:       sourceGoogleSemantic,
+		ActivityType: as.ActivityType,
+		Distance:     knownMeasurement(as.Distance, 1),
+		StartLat:     e7ToNormal(as.StartLocation.LatitudeE7),
+		StartLng:     e7ToNormal(as.StartLocation.LongitudeE7),
+		EndLat:       e7ToNormal(as.EndLocation.LatitudeE7),
+		EndLng:       e7ToNormal(as.EndLocation.LongitudeE7),
+		StartTime:    start,
+		EndTime:      end,
+		Raw:          raw,
+	}
+	if err := validLatLng(a.StartLat, a.StartLng); err != nil {
+		return newActivitySegment{}, fmt.Errorf("start: %v", err)
+	}
+	if err := validLatLng(a.EndLat, a.EndLng); err != nil {
+		return newActivitySegment{}, fmt.Errorf("end: %v", err)
+	}
+	for i, w := range as.WaypointPath.Waypoints {
+		lat, lng := e7ToNormal(w.LatE7), e7ToNormal(w.LngE7)
+		if err := validLatLng(lat, lng); err != nil {
+			return newActivitySegment{}, fmt.Errorf("waypoint %d: %v", i, err)
+		}
+		a.Waypoints = append(a.Waypoints, [2]float64{lng, lat})
+	}
+
+	return a, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const egSemanticHistory = `{
+  "timelineObjects": [
+    {
+      "activitySegment": {
+        "startLocation": {"latitudeE7": 361000000, "longitudeE7": 867000000},
+        "endLocation": {"latitudeE7": 362000000, "longitudeE7": 868000000},
+        "duration": {"startTimestampMs": "1592691300000", "endTimestampMs": "1592692200000"},
+        "distance": 2300,
+        "activityType": "IN_BUS",
+        "confidence": "HIGH",
+        "waypointPath": {"waypoints": [{"latE7": 361000000, "lngE7": 867000000}, {"latE7": 361500000, "lngE7": 867500000}]}
+      }
+    },
+    {
+      "placeVisit": {
+        "location": {"latitudeE7": 362000000, "longitudeE7": 868000000, "placeId": "ChIJabc", "address": "1 Main St", "name": "Coffee Shop", "semanticType": "TYPE_SEARCHED_ADDRESS"},
+        "duration": {"startTimestamp": "2020-06-20T22:30:00Z", "endTimestamp": "2020-06-20T23:15:00.000Z"},
+        "placeConfidence": "HIGH_CONFIDENCE"
+      }
+    },
+    {
+      "placeVisit": {
+        "location": {"placeId": "ChIJdef"},
+        "centerLatE7": 363000000,
+        "centerLngE7": 869000000,
+        "duration": {"startTimestampMs": "1592696700000", "endTimestampMs": "1592700300000"}
+      }
+    },
+    {
+      "placeVisit": {
+        "location": {"placeId": "ChIJghi", "name": "Nowhere"},
+        "duration": {"startTimestampMs": "1592701000000", "endTimestampMs": "1592702000000"}
+      }
+    }
+  ]
+}`
+
+func TestSemanticImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	dir := filepath.Join(t.TempDir(), "Semantic Location History", "2020")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2020_JUNE.json"), []byte(egSemanticHistory), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &semanticimportCommand{
+		log:      log.New(os.Stderr, "", log.LstdFlags),
+		path:     filepath.Dir(dir),
+		username: "jane",
+		device:   "pixel",
+		store:    s,
+	}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// importing again should update, not duplicate
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := s.Visits(ctx, time.Date(2020, 6, 20, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 22, 0, 0, 0, 0, time.UTC), LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 {
+		t.Fatalf("want 2 visits, got %d", len(vs))
+	}
+	v := vs[0]
+	if v.Name != "Coffee Shop" || v.Address != "1 Main St" || v.PlaceID != "ChIJabc" || v.Lat != 36.2 || v.Lng != 86.8 {
+		t.Errorf("unexpected visit: %#v", v)
+	}
+	if !v.StartTime.Equal(time.Date(2020, 6, 20, 22, 30, 0, 0, time.UTC)) || !v.EndTime.Equal(time.Date(2020, 6, 20, 23, 15, 0, 0, time.UTC)) {
+		t.Errorf("unexpected visit times: %s - %s", v.StartTime, v.EndTime)
+	}
+	if vs[1].Lat != 36.3 || vs[1].Lng != 86.9 {
+		t.Errorf("want visit without location coordinates to use the center, got %f,%f", vs[1].Lat, vs[1].Lng)
+	}
+
+	var (
+		count     int
+		actType   string
+		distance  int
+		waypoints string
+	)
+	if err := s.db.QueryRowContext(ctx, `select count(*), activity_type, distance, waypoints from activity_segments`).Scan(&count, &actType, &distance, &waypoints); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || actType != "IN_BUS" || distance != 2300 || waypoints != "[[86.7,36.1],[86.75,36.15]]" {
+		t.Errorf("unexpected activity segment: count %d type %s distance %d waypoints %s", count, actType, distance, waypoints)
+	}
+
+	if err := s.db.QueryRowContext(ctx, `select count(*) from visits v join devices d on (v.device_id = d.id) where d.name = 'pixel'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("want visits attributed to the device, got %d", count)
+	}
+
+	// someone else importing the same history keeps their own copy
+	cmd.username, cmd.device = "bob", "iphone"
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from visits v join devices d on (v.device_id = d.id) where d.name = 'pixel'`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("want jane's visits left attributed to her device, got %d", count)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from activity_segments`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("want an activity segment for each device, got %d", count)
+	}
+
+	from, to := time.Date(2020, 6, 20, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 22, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		filter LocationFilter
+		want   int
+	}{
+		{filter: LocationFilter{}, want: 4},
+		{filter: LocationFilter{User: "jane"}, want: 2},
+		{filter: LocationFilter{User: "bob", Device: "iphone"}, want: 2},
+		{filter: LocationFilter{User: "bob", Device: "pixel"}, want: 0},
+	} {
+		vs, err := s.Visits(ctx, from, to, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vs) != tc.want {
+			t.Errorf("filter %#v: want %d visits, got %d", tc.filter, tc.want, len(vs))
+		}
+	}
+}
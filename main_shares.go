@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type sharesStorage interface {
+	ShareLocations(ctx context.Context, username, withUsername string) error
+	UnshareLocations(ctx context.Context, username, withUsername string) error
+	LocationShares(ctx context.Context) ([]LocationShare, error)
+}
+
+var _ sharesStorage = (*Storage)(nil)
+
+// sharesCommand manages which users can see each other's devices as OwnTracks
+// friends
+type sharesCommand struct {
+	log logger
+	out io.Writer
+
+	action string
+
+	// for add and remove
+	username string
+	with     string
+
+	store sharesStorage
+}
+
+func (s *sharesCommand) Validate() error {
+	var errs []string
+
+	switch s.action {
+	case "add", "remove":
+		if s.username == "" {
+			errs = append(errs, "user required")
+		}
+		if s.with == "" {
+			errs = append(errs, "with required")
+		}
+	case "list":
+	default:
+		errs = append(errs, fmt.Sprintf("action must be one of add, list or remove, not %q", s.action))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *sharesCommand) run(ctx context.Context) error {
+	switch s.action {
+	case "add":
+		if err := s.store.ShareLocations(ctx, s.username, s.with); err != nil {
+			return fmt.Errorf("adding share: %v", err)
+		}
+		s.log.Printf("%s's devices can now see %s's", s.with, s.username)
+	case "remove":
+		if err := s.store.UnshareLocations(ctx, s.username, s.with); err != nil {
+			return fmt.Errorf("removing share: %v", err)
+		}
+		s.log.Printf("%s's devices can no longer see %s's", s.with, s.username)
+	case "list":
+		shares, err := s.store.LocationShares(ctx)
+		if err != nil {
+			return fmt.Errorf("listing shares: %v", err)
+		}
+		tw := tabwriter.NewWriter(s.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER\tSHARED WITH\tCREATED")
+		for _, ls := range shares {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", ls.User, ls.With, ls.CreatedAt.Format(time.RFC3339))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
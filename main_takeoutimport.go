@@ -3,13 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
+	"strconv"
+	"time"
 )
 
 type takeoutLocationStorage interface {
-	AddGoogleTakeoutLocations(ctx context.Context, locs []takeoutLocation) error
+	AddGoogleTakeoutLocations(ctx context.Context, username, device string, locs []takeoutLocation) (duplicates int, _ error)
+	AddDeviceLocations(ctx context.Context, username, device string, locs []newDeviceLocation) (duplicates int, _ error)
 }
 
 var _ takeoutLocationStorage = (*Storage)(nil)
@@ -25,6 +30,8 @@ type takeoutLocation struct {
 	LatitudeE7  int    `json:"latitudeE7"`
 	LongitudeE7 int    `json:"longitudeE7"`
 	TimestampMS string `json:"timestampMs"`
+	// ISO 8601, newer exports use this instead of timestampMs
+	TimestampISO string `json:"timestamp"`
 	// Metres per second https://gis.stackexchange.com/a/294505
 	Velocity *int `json:"velocity"`
 	// assuming metres
@@ -33,9 +40,53 @@ type takeoutLocation struct {
 	Raw json.RawMessage `json:"-"`
 }
 
+// Timestamp returns the time the location was recorded at
+func (t *takeoutLocation) Timestamp() (time.Time, error) {
+	return parseTakeoutTimestamp(t.TimestampMS, t.TimestampISO)
+}
+
+// parseTakeoutTimestamp parses a takeout time, which older exports set as
+// milliseconds since the epoch and newer ones as ISO 8601.
+func parseTakeoutTimestamp(ms, iso string) (time.Time, error) {
+	if ms != "" {
+		tsms, err := strconv.ParseInt(ms, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing timestamp %s to int64: %v", ms, err)
+		}
+		return time.Unix(0, tsms*int64(1000000)), nil
+	}
+	if iso != "" {
+		ts, err := time.Parse(time.RFC3339, iso)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing timestamp %s: %v", iso, err)
+		}
+		return ts, nil
+	}
+	return time.Time{}, fmt.Errorf("no timestamp")
+}
+
+// Validate checks the location can be stored
+func (t *takeoutLocation) Validate() error {
+	if len(t.Raw) < 1 {
+		return fmt.Errorf("location missing raw data")
+	}
+	// check for https://support.google.com/maps/thread/4595364?hl=en
+	if err := validLatLng(e7ToNormal(t.LatitudeE7), e7ToNormal(t.LongitudeE7)); err != nil {
+		return fmt.Errorf("%v (e7 %d, %d)", err, t.LatitudeE7, t.LongitudeE7)
+	}
+	if _, err := t.Timestamp(); err != nil {
+		return err
+	}
+	if _, err := t.LocationActivities(); err != nil {
+		return err
+	}
+	return nil
+}
+
 type takeoutLocationActivity struct {
-	TimestampMs string            `json:"timestampMs"`
-	Activities  []takeoutActivity `json:"activity"`
+	TimestampMs  string            `json:"timestampMs"`
+	TimestampISO string            `json:"timestamp"`
+	Activities   []takeoutActivity `json:"activity"`
 }
 
 type takeoutActivity struct {
@@ -43,69 +94,353 @@ type takeoutActivity struct {
 	Confidence int    `json:"confidence"`
 }
 
-type takeoutFile struct {
-	// use a raw message, so we can parse each one individually and also capture
-	// their raw value
-	Locations []json.RawMessage `json:"locations"`
+// LocationActivities returns the activity classifications recorded with the
+// location
+func (t *takeoutLocation) LocationActivities() ([]locationActivity, error) {
+	var ret []locationActivity
+	for _, la := range t.Activity {
+		ts, err := parseTakeoutTimestamp(la.TimestampMs, la.TimestampISO)
+		if err != nil {
+			return nil, fmt.Errorf("activity: %v", err)
+		}
+		for _, a := range la.Activities {
+			ret = append(ret, locationActivity{
+				Timestamp:  ts,
+				Type:       a.Type,
+				Confidence: a.Confidence,
+			})
+		}
+	}
+	return ret, nil
 }
 
 type takeoutimportCommand struct {
 	log logger
 
-	filePath string
+	filePath       string
+	username       string
+	device         string
+	batchSize      int
+	checkpointPath string
+	skipInvalid    bool
 
 	store takeoutLocationStorage
 }
 
+// takeoutCheckpoint records how far through a file an import got, so it can be
+// resumed.
+type takeoutCheckpoint struct {
+	Path string `json:"path"`
+	// Records is the number of records in the file that have been handled
+	Records int `json:"records"`
+}
+
 func (t *takeoutimportCommand) run(ctx context.Context) error {
-	t.log.Printf("Importing google takeout location history file %s", t.filePath)
+	t.log.Printf("Importing google location history file %s", t.filePath)
+
+	f, err := os.Open(t.filePath)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", t.filePath, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %v", t.filePath, err)
+	}
 
-	tlocs, err := parseLocationFile(t.filePath)
+	resumeFrom, err := t.readCheckpoint()
 	if err != nil {
 		return err
 	}
-	_ = tlocs
+	if resumeFrom > 0 {
+		t.log.Printf("Resuming after record %d", resumeFrom)
+	}
+
+	var (
+		rr = newTakeoutRecordReader(f)
+
+		// legacy records keep their own format, timeline records are
+		// converted to locations
+		batch    []takeoutLocation
+		tlBatch  []newDeviceLocation
+		records  int
+		imported int
+		dups     int
+		invalid  int
+		started  = time.Now()
+	)
+
+	flush := func() error {
+		if len(batch) == 0 && len(tlBatch) == 0 {
+			return nil
+		}
+		if len(batch) > 0 {
+			d, err := t.store.AddGoogleTakeoutLocations(ctx, t.username, t.device, batch)
+			if err != nil {
+				return fmt.Errorf("importing takeout locations before record %d: %v", records, err)
+			}
+			imported += len(batch) - d
+			dups += d
+			batch = batch[:0]
+		}
+		if len(tlBatch) > 0 {
+			d, err := t.store.AddDeviceLocations(ctx, t.username, t.device, tlBatch)
+			if err != nil {
+				return fmt.Errorf("importing timeline locations before record %d: %v", records, err)
+			}
+			imported += len(tlBatch) - d
+			dups += d
+			tlBatch = tlBatch[:0]
+		}
+
+		if err := t.writeCheckpoint(records); err != nil {
+			return err
+		}
 
-	if err := t.store.AddGoogleTakeoutLocations(ctx, tlocs); err != nil {
-		return fmt.Errorf("importing takeout locations: %v", err)
+		rate := float64(records-resumeFrom) / time.Since(started).Seconds()
+		t.log.Printf("Handled %d records (%.0f/s, %.1f%% of file): %d locations imported, %d already imported, %d invalid records",
+			records, rate, float64(rr.InputOffset())/float64(fi.Size())*100, imported, dups, invalid)
+		return nil
+	}
+
+	for {
+		kind, raw, err := rr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading record %d: %v", records, err)
+		}
+		idx := records
+		records++
+		if idx < resumeFrom {
+			continue
+		}
+
+		if kind == takeoutKindLocations {
+			var tl takeoutLocation
+			tl, err = parseTakeoutLocation(raw)
+			if err == nil {
+				batch = append(batch, tl)
+			}
+		} else {
+			var locs []newDeviceLocation
+			locs, err = timelineLocations(kind, raw)
+			if err == nil {
+				tlBatch = append(tlBatch, locs...)
+			}
+		}
+		if err != nil {
+			if !t.skipInvalid {
+				return fmt.Errorf("record %d: %v (use -skip-invalid to skip invalid records)", idx, err)
+			}
+			t.log.Printf("skipping invalid record %d: %v", idx, err)
+			invalid++
+			continue
+		}
+
+		if len(batch)+len(tlBatch) >= t.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if t.checkpointPath != "" {
+		// we're done, so a future run should start from the beginning
+		if err := os.Remove(t.checkpointPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing checkpoint: %v", err)
+		}
 	}
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
-	t.log.Printf("Done, Alloc %dMiB TotalAlloc %dMiB", m.Alloc/1024/1024, m.TotalAlloc/1024/1024)
+	t.log.Printf("Done, imported %d locations, skipped %d already imported and %d invalid records. Alloc %dMiB TotalAlloc %dMiB",
+		imported, dups, invalid, m.Alloc/1024/1024, m.TotalAlloc/1024/1024)
 
 	return nil
 }
 
-func parseLocationFile(path string) ([]takeoutLocation, error) {
-	// this is pretty inefficent, but it's intended to be a one-time application
-	// so w/e
+// readCheckpoint returns the number of records to skip, from the checkpoint if
+// there is one.
+func (t *takeoutimportCommand) readCheckpoint() (int, error) {
+	if t.checkpointPath == "" {
+		return 0, nil
+	}
+	b, err := os.ReadFile(t.checkpointPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading checkpoint: %v", err)
+	}
+	var cp takeoutCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return 0, fmt.Errorf("decoding checkpoint %s: %v", t.checkpointPath, err)
+	}
+	if cp.Path != t.filePath {
+		return 0, fmt.Errorf("checkpoint %s is for %s, not %s", t.checkpointPath, cp.Path, t.filePath)
+	}
+	return cp.Records, nil
+}
 
-	f, err := os.Open(path)
+func (t *takeoutimportCommand) writeCheckpoint(records int) error {
+	if t.checkpointPath == "" {
+		return nil
+	}
+	b, err := json.Marshal(takeoutCheckpoint{Path: t.filePath, Records: records})
 	if err != nil {
-		return nil, fmt.Errorf("opening %s: %v", path, err)
+		return err
 	}
-	defer f.Close()
+	// write then rename, so an interrupted write doesn't lose our place
+	tmp := t.checkpointPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("writing checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, t.checkpointPath); err != nil {
+		return fmt.Errorf("writing checkpoint: %v", err)
+	}
+	return nil
+}
+
+// parseTakeoutLocation decodes and validates a single record
+func parseTakeoutLocation(raw json.RawMessage) (takeoutLocation, error) {
+	tl := takeoutLocation{}
+	if err := json.Unmarshal(raw, &tl); err != nil {
+		return takeoutLocation{}, fmt.Errorf("unmarshaling location %v", err)
+	}
+	tl.Raw = raw
+	if err := tl.Validate(); err != nil {
+		return takeoutLocation{}, err
+	}
+	return tl, nil
+}
+
+// Keys of the arrays in a location history file that we import records from
+const (
+	// legacy Records.json
+	takeoutKindLocations = "locations"
+	// on-device Timeline exports. The iOS export is a top level array of
+	// segments, which is read as this kind too.
+	takeoutKindSemanticSegments = "semanticSegments"
+	takeoutKindRawSignals       = "rawSignals"
+)
 
-	tf := takeoutFile{}
+// takeoutRecordReader streams the records from a location history file,
+// without loading the whole file in to memory. It handles the legacy takeout
+// Records.json and the Android and iOS Timeline exports.
+type takeoutRecordReader struct {
+	dec     *json.Decoder
+	started bool
+	// kind of the array being read, empty when between arrays in the top level
+	// object
+	kind string
+	// topArray is set if the file is a top level array
+	topArray bool
+	found    bool
+	done     bool
+}
 
-	if err := json.NewDecoder(f).Decode(&tf); err != nil {
-		return nil, fmt.Errorf("decoding takeout file %s: %v", path, err)
+func newTakeoutRecordReader(r io.Reader) *takeoutRecordReader {
+	return &takeoutRecordReader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next record and the kind of array it's from, or io.EOF when
+// there are no more.
+func (t *takeoutRecordReader) Next() (kind string, _ json.RawMessage, _ error) {
+	if t.done {
+		return "", nil, io.EOF
+	}
+	if !t.started {
+		tok, err := t.dec.Token()
+		if err != nil {
+			return "", nil, err
+		}
+		switch tok {
+		case json.Delim('['):
+			t.topArray = true
+			t.kind = takeoutKindSemanticSegments
+			t.found = true
+		case json.Delim('{'):
+		default:
+			return "", nil, fmt.Errorf("want object or array, got %v", tok)
+		}
+		t.started = true
 	}
 
-	var ret []takeoutLocation
+	for {
+		if t.kind == "" {
+			if !t.dec.More() {
+				t.done = true
+				if !t.found {
+					return "", nil, fmt.Errorf("no location history found in file")
+				}
+				return "", nil, io.EOF
+			}
+			if err := t.nextArray(); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+
+		if t.dec.More() {
+			var raw json.RawMessage
+			if err := t.dec.Decode(&raw); err != nil {
+				return "", nil, err
+			}
+			return t.kind, raw, nil
+		}
 
-	for _, rl := range tf.Locations {
-		tl := takeoutLocation{}
-		if err := json.Unmarshal(rl, &tl); err != nil {
-			return nil, fmt.Errorf("unmarshaling location %v", err)
+		// consume the closing ]
+		if _, err := t.dec.Token(); err != nil {
+			return "", nil, err
+		}
+		if t.topArray {
+			t.done = true
+			return "", nil, io.EOF
 		}
-		tl.Raw = rl
-		ret = append(ret, tl)
+		t.kind = ""
 	}
+}
 
-	return ret, nil
+// InputOffset returns how far through the input the reader is, in bytes
+func (t *takeoutRecordReader) InputOffset() int64 {
+	return t.dec.InputOffset()
+}
+
+// nextArray reads the next key in the top level object. If it's an array we
+// import, the reader moves in to it, otherwise the value is skipped.
+func (t *takeoutRecordReader) nextArray() error {
+	tok, err := t.dec.Token()
+	if err != nil {
+		return err
+	}
+	switch key, _ := tok.(string); key {
+	case takeoutKindLocations, takeoutKindSemanticSegments, takeoutKindRawSignals:
+		if err := t.expectDelim('['); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		t.kind = key
+		t.found = true
+		return nil
+	}
+	var skip json.RawMessage
+	return t.dec.Decode(&skip)
+}
+
+func (t *takeoutRecordReader) expectDelim(want json.Delim) error {
+	tok, err := t.dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("want %s, got %v", want, tok)
+	}
+	return nil
 }
 
 func e7ToNormal(e7 int) float64 {
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const egTakeoutRecords = `{
+  "deviceSettings": [{"deviceTag": 1}],
+  "locations": [
+    {"latitudeE7": 361000000, "longitudeE7": 867000000, "accuracy": 10, "timestampMs": "1592691300000"},
+    {"latitudeE7": 1361000000, "longitudeE7": 867000000, "accuracy": 10, "timestampMs": "1592691400000"},
+    {"latitudeE7": 362000000, "longitudeE7": 868000000, "accuracy": 10, "timestamp": "2020-06-20T22:16:40.000Z"},
+    {"latitudeE7": 363000000, "longitudeE7": 869000000, "accuracy": 10, "timestampMs": "1592691600000"},
+    {"latitudeE7": 364000000, "longitudeE7": 869000000, "accuracy": 10, "timestampMs": "1592691700000"}
+  ],
+  "other": {}
+}`
+
+func TestTakeoutImport(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Records.json")
+	if err := os.WriteFile(path, []byte(egTakeoutRecords), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &takeoutimportCommand{
+		log:            log.New(os.Stderr, "", log.LstdFlags),
+		filePath:       path,
+		batchSize:      2,
+		checkpointPath: filepath.Join(dir, "checkpoint.json"),
+		store:          s,
+	}
+
+	countLocs := func() int {
+		t.Helper()
+		var count int
+		if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// the out of range record fails the import, but what was committed before
+	// it is kept
+	err := cmd.run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "record 1") {
+		t.Fatalf("want error for record 1, got: %v", err)
+	}
+	if c := countLocs(); c != 0 {
+		t.Errorf("want nothing committed before the first batch, got %d", c)
+	}
+
+	cmd.skipInvalid = true
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c := countLocs(); c != 4 {
+		t.Errorf("want the 4 valid records imported, got %d", c)
+	}
+	if _, err := os.Stat(cmd.checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("checkpoint should be removed after a complete import, got: %v", err)
+	}
+
+	// resuming should skip everything before the checkpoint
+	if _, err := s.db.ExecContext(ctx, `delete from device_locations`); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := json.Marshal(takeoutCheckpoint{Path: path, Records: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cmd.checkpointPath, cp, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c := countLocs(); c != 2 {
+		t.Errorf("want the 2 records after the checkpoint imported, got %d", c)
+	}
+}
+
+func TestTakeoutRecordReaderNoLocations(t *testing.T) {
+	rr := newTakeoutRecordReader(strings.NewReader(`{"userLocationProfile": {}}`))
+	if _, _, err := rr.Next(); err == nil {
+		t.Error("want error for file without locations")
+	}
+}
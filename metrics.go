@@ -19,6 +19,42 @@ var (
 		Help: "Number of errors served at the OwnTracks publishing endpoint",
 	})
 
+	metricOTMQTTSuccessCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "owntracks_mqtt_messages_success",
+		Help: "Number of OwnTracks messages successfully processed from the MQTT broker",
+	})
+	metricOTMQTTErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "owntracks_mqtt_errors",
+		Help: "Number of errors processing OwnTracks messages or talking to the MQTT broker",
+	})
+
+	metricOverlandSubmitSuccessCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "overland_publish_endpoint_success",
+		Help: "Number of successful requests served at the Overland publishing endpoint",
+	})
+	metricOverlandSubmitErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "overland_publish_endpoint_errors",
+		Help: "Number of errors served at the Overland publishing endpoint",
+	})
+
+	metricOsmAndSubmitSuccessCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "osmand_publish_endpoint_success",
+		Help: "Number of successful requests served at the OsmAnd publishing endpoint",
+	})
+	metricOsmAndSubmitErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "osmand_publish_endpoint_errors",
+		Help: "Number of errors served at the OsmAnd publishing endpoint",
+	})
+
+	metricGPSLoggerSubmitSuccessCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gpslogger_publish_endpoint_success",
+		Help: "Number of successful requests served at the GPSLogger publishing endpoint",
+	})
+	metricGPSLoggerSubmitErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gpslogger_publish_endpoint_errors",
+		Help: "Number of errors served at the GPSLogger publishing endpoint",
+	})
+
 	metric4sqSyncSuccessCount = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "foursquare_sync_success_count",
 		Help: "Number of successful syncs with foursquare",
@@ -36,6 +72,15 @@ var (
 		Name: "tripit_sync_error_count",
 		Help: "Number of syncs that failed with TripIt",
 	})
+
+	metricTripitICalSyncSuccessCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tripit_ical_sync_success_count",
+		Help: "Number of successful syncs of the TripIt iCalendar feed",
+	})
+	metricTripitICalSyncErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tripit_ical_sync_error_count",
+		Help: "Number of syncs of the TripIt iCalendar feed that failed",
+	})
 )
 
 var _ prometheus.Collector = (*metricsCollector)(nil)
@@ -45,6 +90,7 @@ type metricsCollector struct {
 	s *Storage
 
 	lastDeviceLocationTime  *prometheus.Desc
+	perDeviceLocationTime   *prometheus.Desc
 	latestFoursquareCheckin *prometheus.Desc
 }
 
@@ -56,6 +102,9 @@ func newMetricsCollector(l logger, s *Storage) *metricsCollector {
 		lastDeviceLocationTime: prometheus.NewDesc(
 			"last_device_location_at",
 			"Unix timestamp when of the last device location reported", nil, nil),
+		perDeviceLocationTime: prometheus.NewDesc(
+			"device_last_location_at",
+			"Unix timestamp of the last location reported by each device", []string{"user", "device"}, nil),
 		latestFoursquareCheckin: prometheus.NewDesc(
 			"last_foursquare_checkin_at",
 			"Unix time timestamp when the last foursquare checkin was recorded into the DB", nil, nil),
@@ -64,6 +113,7 @@ func newMetricsCollector(l logger, s *Storage) *metricsCollector {
 
 func (m *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- m.lastDeviceLocationTime
+	ch <- m.perDeviceLocationTime
 	ch <- m.latestFoursquareCheckin
 }
 
@@ -80,6 +130,15 @@ func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
 		ch <- prometheus.NewInvalidMetric(m.lastDeviceLocationTime, fmt.Errorf("get latest device location timestamp: %v", err))
 	}
 
+	dls, err := m.s.LatestDeviceLocationTimestamps(ctx)
+	if err == nil {
+		for _, dl := range dls {
+			ch <- prometheus.MustNewConstMetric(m.perDeviceLocationTime, prometheus.GaugeValue, float64(dl.Timestamp.Unix()), dl.User, dl.Device)
+		}
+	} else {
+		ch <- prometheus.NewInvalidMetric(m.perDeviceLocationTime, fmt.Errorf("get latest device location timestamps: %v", err))
+	}
+
 	lfsq, err := m.s.Last4sqCheckinTime(ctx)
 	if err == nil {
 		ch <- prometheus.MustNewConstMetric(m.latestFoursquareCheckin, prometheus.GaugeValue, float64(lfsq.Unix()))
@@ -33,6 +33,7 @@ func TestMetrics(t *testing.T) {
 	if err := json.Unmarshal([]byte(egOwntracksLocation), &om); err != nil {
 		t.Fatal(err)
 	}
+	om.Topic = "owntracks/jane/phone"
 	if err := st.AddOTLocation(ctx, om); err != nil {
 		t.Fatalf("AddOTLocation: %v", err)
 	}
@@ -40,7 +41,8 @@ func TestMetrics(t *testing.T) {
 		t.Fatalf("Upsert4sqCheckin: %v", err)
 	}
 
-	if want, got := 2, testutil.CollectAndCount(c); got != want {
+	// one more for the device
+	if want, got := 3, testutil.CollectAndCount(c); got != want {
 		t.Fatalf("want %d metrics, got %d", want, got)
 	}
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// osmandServer handles locations sent with the OsmAnd protocol, which is
+// supported by the Traccar client and many dedicated GPS trackers. Each
+// request is a single location, as query or form parameters.
+//
+// https://www.traccar.org/osmand/
+type osmandServer struct {
+	log   logger
+	store deviceLocationStore
+}
+
+func (o *osmandServer) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		metricOsmAndSubmitErrorCount.Inc()
+		o.log.Printf("parsing osmand request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, device := osmandPublishDevice(r)
+	if user == "" || device == "" {
+		metricOsmAndSubmitErrorCount.Inc()
+		o.log.Print("can't identify the device for osmand location")
+		http.Error(w, "device could not be identified, use device credentials or set the id", http.StatusBadRequest)
+		return
+	}
+
+	loc, err := parseOsmAndLocation(r.Form, time.Now())
+	if err != nil {
+		metricOsmAndSubmitErrorCount.Inc()
+		o.log.Printf("parsing osmand location (%s): %v", r.Form.Encode(), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dups, err := o.store.AddDeviceLocations(r.Context(), user, device, []newDeviceLocation{loc})
+	if err != nil {
+		metricOsmAndSubmitErrorCount.Inc()
+		o.log.Printf("persisting osmand location: %v", err)
+		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if dups > 0 {
+		o.log.Printf("skipped already stored location from osmand %s/%s", user, device)
+	}
+
+	metricOsmAndSubmitSuccessCount.Inc()
+}
+
+// osmandPublishDevice identifies the device a location is from. The device's
+// own credentials are authoritative, otherwise it's the basic auth user and the
+// id the device sends.
+func osmandPublishDevice(r *http.Request) (user, device string) {
+	if d := authenticatedDevice(r.Context()); d != nil {
+		return d.User, d.Name
+	}
+	user, _, _ = r.BasicAuth()
+	return user, r.Form.Get("id")
+}
+
+// parseOsmAndLocation converts the parameters to a location. If there is no
+// timestamp, now is used.
+func parseOsmAndLocation(v url.Values, now time.Time) (newDeviceLocation, error) {
+	loc := newDeviceLocation{
+		Source:    sourceOsmAnd,
+		Timestamp: now.UTC(),
+		Raw:       []byte(v.Encode()),
+	}
+
+	var err error
+	if loc.Lat, err = strconv.ParseFloat(v.Get("lat"), 64); err != nil {
+		return newDeviceLocation{}, fmt.Errorf("invalid lat %q", v.Get("lat"))
+	}
+	if loc.Lng, err = strconv.ParseFloat(v.Get("lon"), 64); err != nil {
+		return newDeviceLocation{}, fmt.Errorf("invalid lon %q", v.Get("lon"))
+	}
+
+	if v.Get("timestamp") != "" {
+		if loc.Timestamp, err = parseOsmAndTimestamp(v.Get("timestamp")); err != nil {
+			return newDeviceLocation{}, err
+		}
+	}
+
+	if err := parseMeasurementParams(v, []measurementParam{
+		// knots
+		{param: "speed", scale: 1.852, known: true, dest: &loc.Velocity},
+		{param: "bearing", scale: 1, known: true, dest: &loc.CourseOverGround},
+		{param: "altitude", scale: 1, dest: &loc.Altitude},
+		{param: "accuracy", scale: 1, known: true, dest: &loc.Accuracy},
+		{param: "batt", scale: 1, known: true, dest: &loc.Batt},
+	}); err != nil {
+		return newDeviceLocation{}, err
+	}
+
+	return loc, nil
+}
+
+// measurementParam is an optional numeric parameter, that is scaled and
+// stored in dest if it is set.
+type measurementParam struct {
+	param string
+	scale float64
+	// known treats negative values as unknown
+	known bool
+	dest  **int
+}
+
+func parseMeasurementParams(v url.Values, params []measurementParam) error {
+	for _, p := range params {
+		if v.Get(p.param) == "" {
+			continue
+		}
+		fv, err := strconv.ParseFloat(v.Get(p.param), 64)
+		// ParseFloat accepts NaN and Inf, which aren't measurements
+		if err != nil || math.IsNaN(fv) || math.IsInf(fv, 0) {
+			return fmt.Errorf("invalid %s %q", p.param, v.Get(p.param))
+		}
+		if p.known {
+			*p.dest = knownMeasurement(&fv, p.scale)
+		} else {
+			*p.dest = scaledMeasurement(&fv, p.scale)
+		}
+	}
+	return nil
+}
+
+// parseOsmAndTimestamp parses the timestamp, which trackers send as unix
+// seconds, unix milliseconds or a date time. It's returned in UTC.
+func parseOsmAndTimestamp(s string) (time.Time, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		// seconds won't be this large for a very long time
+		if i > 1e11 {
+			return time.UnixMilli(i).UTC(), nil
+		}
+		return time.Unix(i, 0).UTC(), nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.UnixMilli(int64(f * 1000)).UTC(), nil
+	}
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02 15:04:05",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOsmAndHandlePublish(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	oas := &osmandServer{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		store: s,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/osmand?id=tracker1&lat=52.52&lon=13.405&timestamp=1592691300&speed=10&bearing=90.4&altitude=-5&accuracy=12&batt=77", nil)
+	req.SetBasicAuth("jane", "pw")
+	rec := httptest.NewRecorder()
+	oas.HandlePublish(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// traccar client posts the same parameters as a form
+	form := url.Values{"id": {"tracker1"}, "lat": {"52.53"}, "lon": {"13.406"}, "timestamp": {"2020-06-20T22:16:00Z"}}
+	req = httptest.NewRequest(http.MethodPost, "/osmand", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("jane", "pw")
+	rec = httptest.NewRecorder()
+	oas.HandlePublish(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	locs, err := s.RecentLocations(ctx, time.Unix(1592691000, 0), time.Unix(1592700000, 0), LocationFilter{User: "jane", Device: "tracker1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 {
+		t.Fatalf("want 2 locations for jane/tracker1, got %d", len(locs))
+	}
+	l := locs[0]
+	if l.Lat != 52.52 || l.Lng != 13.405 || l.Accuracy != 12 || !l.Timestamp.Equal(time.Unix(1592691300, 0)) {
+		t.Errorf("unexpected location: %#v", l)
+	}
+	if l.Velocity == nil || *l.Velocity != 19 {
+		t.Errorf("want speed converted from knots to 19km/h, got %v", l.Velocity)
+	}
+	if l.CourseOverGround == nil || *l.CourseOverGround != 90 {
+		t.Errorf("want bearing 90, got %v", l.CourseOverGround)
+	}
+	if l.Altitude == nil || *l.Altitude != -5 {
+		t.Errorf("want altitude -5, got %v", l.Altitude)
+	}
+	if l.Batt == nil || *l.Batt != 77 {
+		t.Errorf("want batt 77, got %v", l.Batt)
+	}
+
+	var raw string
+	if err := s.db.QueryRowContext(ctx, `select raw_source from device_locations where source = ? order by timestamp limit 1`, sourceOsmAnd).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(raw, "speed=10") {
+		t.Errorf("want raw request stored, got %s", raw)
+	}
+
+	for _, q := range []string{
+		"id=tracker1&lat=nope&lon=13.405",
+		"id=tracker1&lat=152.52&lon=13.405",
+		"id=tracker1&lat=NaN&lon=13.405",
+		"id=tracker1&lat=52.52&lon=13.405&speed=NaN",
+		"id=tracker1&lat=52.52&lon=13.405&altitude=-Inf",
+		"lat=52.52&lon=13.405",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/osmand?"+q, nil)
+		req.SetBasicAuth("jane", "pw")
+		rec := httptest.NewRecorder()
+		oas.HandlePublish(rec, req)
+		if rec.Code == http.StatusOK {
+			t.Errorf("want %s to be rejected", q)
+		}
+	}
+}
+
+func TestParseOsmAndTimestamp(t *testing.T) {
+	want := time.Date(2020, 6, 20, 22, 15, 0, 0, time.UTC)
+	for _, ts := range []string{
+		"1592691300",
+		"1592691300000",
+		"1592691300.0",
+		"2020-06-20T22:15:00Z",
+		"2020-06-21T08:15:00+10:00",
+		"2020-06-20 22:15:00",
+	} {
+		got, err := parseOsmAndTimestamp(ts)
+		if err != nil {
+			t.Errorf("parsing %s: %v", ts, err)
+			continue
+		}
+		if !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("parsing %s: want %s, got %s", ts, want, got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// deviceLocationStore is used by the endpoints for loggers that only send
+// locations
+type deviceLocationStore interface {
+	// AddDeviceLocations persists the locations for the user's device, in a
+	// single transaction, returning the number skipped as they were already
+	// stored.
+	AddDeviceLocations(ctx context.Context, username, device string, locs []newDeviceLocation) (duplicates int, _ error)
+}
+
+// overlandServer handles the batches of locations the Overland GPS logger
+// posts.
+//
+// https://github.com/aaronpk/Overland-iOS#api
+type overlandServer struct {
+	log   logger
+	store deviceLocationStore
+}
+
+// overlandBatch is the body Overland posts. It also sends the current trip,
+// which we don't use.
+type overlandBatch struct {
+	Locations []overlandLocation `json:"locations"`
+}
+
+// overlandLocation is a GeoJSON point feature
+type overlandLocation struct {
+	Type     string `json:"type"`
+	Geometry struct {
+		Type string `json:"type"`
+		// lng, lat
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Timestamp string `json:"timestamp"`
+		// metres
+		Altitude *float64 `json:"altitude"`
+		// metres/second, -1 if unknown
+		Speed *float64 `json:"speed"`
+		// degrees, -1 if unknown
+		Course *float64 `json:"course"`
+		// metres, -1 if unknown
+		HorizontalAccuracy *float64 `json:"horizontal_accuracy"`
+		// metres, -1 if unknown
+		VerticalAccuracy *float64 `json:"vertical_accuracy"`
+		Motion           []string `json:"motion"`
+		// 0-1
+		BatteryLevel *float64 `json:"battery_level"`
+		BatteryState string   `json:"battery_state"`
+		DeviceID     string   `json:"device_id"`
+	} `json:"properties"`
+
+	raw json.RawMessage
+	// err is why the feature couldn't be decoded. It's kept rather than
+	// failing the whole batch, so the feature can be skipped on its own.
+	err error
+}
+
+func (o *overlandLocation) UnmarshalJSON(b []byte) error {
+	type alias overlandLocation
+	var a alias
+	if err := json.Unmarshal(b, &a); err != nil {
+		*o = overlandLocation{err: err}
+		return nil
+	}
+	*o = overlandLocation(a)
+	o.raw = append(json.RawMessage{}, b...)
+	return nil
+}
+
+// LatLng returns the position of the location, erroring if it is not a point
+func (o *overlandLocation) LatLng() (lat, lng float64, _ error) {
+	if o.Geometry.Type != "Point" || len(o.Geometry.Coordinates) < 2 {
+		return 0, 0, fmt.Errorf("location geometry must be a point, got %s", o.Geometry.Type)
+	}
+	return o.Geometry.Coordinates[1], o.Geometry.Coordinates[0], nil
+}
+
+// deviceLocation converts the feature to a location to persist
+func (o *overlandLocation) deviceLocation() (newDeviceLocation, error) {
+	if o.err != nil {
+		return newDeviceLocation{}, o.err
+	}
+	lat, lng, err := o.LatLng()
+	if err != nil {
+		return newDeviceLocation{}, err
+	}
+	if err := validLatLng(lat, lng); err != nil {
+		return newDeviceLocation{}, err
+	}
+	ts, err := o.Time()
+	if err != nil {
+		return newDeviceLocation{}, err
+	}
+	p := o.Properties
+
+	return newDeviceLocation{
+		Source:           sourceOverland,
+		Lat:              lat,
+		Lng:              lng,
+		Timestamp:        ts,
+		Accuracy:         knownMeasurement(p.HorizontalAccuracy, 1),
+		Altitude:         scaledMeasurement(p.Altitude, 1),
+		VerticalAccuracy: knownMeasurement(p.VerticalAccuracy, 1),
+		Velocity:         knownMeasurement(p.Speed, 3.6),
+		CourseOverGround: knownMeasurement(p.Course, 1),
+		Batt:             knownMeasurement(p.BatteryLevel, 100),
+		Raw:              o.raw,
+	}, nil
+}
+
+// Time parses the timestamp, which is ISO 8601
+func (o *overlandLocation) Time() (time.Time, error) {
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05Z0700",
+	} {
+		if t, err := time.Parse(layout, o.Properties.Timestamp); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", o.Properties.Timestamp)
+}
+
+func (o *overlandServer) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rawBatch, err := io.ReadAll(r.Body)
+	if err != nil {
+		metricOverlandSubmitErrorCount.Inc()
+		o.log.Printf("read overland batch: %v", err)
+		http.Error(w, fmt.Sprintf("read overland batch: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var batch overlandBatch
+	if err := json.Unmarshal(rawBatch, &batch); err != nil {
+		metricOverlandSubmitErrorCount.Inc()
+		o.log.Printf("decoding overland batch (%s): %v", string(rawBatch), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, device := overlandPublishDevice(r, batch)
+	if user == "" || device == "" {
+		metricOverlandSubmitErrorCount.Inc()
+		o.log.Print("can't identify the device for overland batch")
+		http.Error(w, "device could not be identified, use device credentials or set the device id", http.StatusBadRequest)
+		return
+	}
+
+	// Overland retries a batch until it's accepted, so invalid locations are
+	// skipped rather than failing it, as retrying them won't help.
+	var locs []newDeviceLocation
+	for i, ol := range batch.Locations {
+		loc, err := ol.deviceLocation()
+		if err != nil {
+			o.log.Printf("skipping invalid overland location %d from %s/%s: %v", i, user, device, err)
+			continue
+		}
+		locs = append(locs, loc)
+	}
+
+	if len(locs) > 0 {
+		dups, err := o.store.AddDeviceLocations(r.Context(), user, device, locs)
+		if err != nil {
+			metricOverlandSubmitErrorCount.Inc()
+			o.log.Printf("persisting overland locations: %v", err)
+			http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if dups > 0 {
+			o.log.Printf("skipped %d already stored locations from overland %s/%s", dups, user, device)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"result":"ok"}`))
+	metricOverlandSubmitSuccessCount.Inc()
+}
+
+// overlandPublishDevice identifies the device a batch is from. The device's
+// own credentials are authoritative, otherwise it's the basic auth user and the
+// device ID configured in the app.
+func overlandPublishDevice(r *http.Request, batch overlandBatch) (user, device string) {
+	if d := authenticatedDevice(r.Context()); d != nil {
+		return d.User, d.Name
+	}
+	user, _, _ = r.BasicAuth()
+	for _, l := range batch.Locations {
+		if l.Properties.DeviceID != "" {
+			return user, l.Properties.DeviceID
+		}
+	}
+	return user, ""
+}
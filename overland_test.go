@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const egOverlandBatch = `{
+  "locations": [
+    {
+      "type": "Feature",
+      "geometry": {"type": "Point", "coordinates": [-122.030581, 37.331800]},
+      "properties": {
+        "timestamp": "2020-06-20T10:15:00Z",
+        "altitude": -2,
+        "speed": 4,
+        "horizontal_accuracy": 30,
+        "vertical_accuracy": -1,
+        "motion": ["driving", "stationary"],
+        "battery_state": "charging",
+        "battery_level": 0.89,
+        "device_id": "iphone",
+        "wifi": ""
+      }
+    },
+    {
+      "type": "Feature",
+      "geometry": {"type": "Point", "coordinates": [-122.031, 37.332]},
+      "properties": {
+        "timestamp": "2020-06-20T10:16:00-0700",
+        "speed": -1,
+        "horizontal_accuracy": 10,
+        "device_id": "iphone"
+      }
+    }
+  ],
+  "current": {"type": "Feature"}
+}`
+
+func TestOverlandHandlePublish(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	ols := &overlandServer{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		store: s,
+	}
+
+	publish := func(user, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/overland", strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, "pw")
+		}
+		rec := httptest.NewRecorder()
+		ols.HandlePublish(rec, req)
+		return rec
+	}
+
+	rec := publish("jane", egOverlandBatch)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"result":"ok"}` {
+		t.Fatalf("want ok result, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	locs, err := s.RecentLocations(ctx, time.Date(2020, 6, 20, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC), LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 {
+		t.Fatalf("want 2 locations, got %d", len(locs))
+	}
+	l := locs[0]
+	if l.User != "jane" || l.Device != "iphone" {
+		t.Errorf("want location attributed to jane/iphone, got %s/%s", l.User, l.Device)
+	}
+	if l.Lat != 37.3318 || l.Lng != -122.030581 || l.Accuracy != 30 {
+		t.Errorf("unexpected position: %#v", l)
+	}
+	if l.Velocity == nil || *l.Velocity != 14 {
+		t.Errorf("want speed converted to 14km/h, got %v", l.Velocity)
+	}
+	if l.Altitude == nil || *l.Altitude != -2 {
+		t.Errorf("want altitude -2, got %v", l.Altitude)
+	}
+	if l.Batt == nil || *l.Batt != 89 {
+		t.Errorf("want batt 89, got %v", l.Batt)
+	}
+	if locs[1].Velocity != nil {
+		t.Errorf("unknown speed should be unset, got %v", *locs[1].Velocity)
+	}
+
+	var source, raw string
+	if err := s.db.QueryRowContext(ctx, `select source, raw_source from device_locations order by timestamp limit 1`).Scan(&source, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if source != sourceOverland || !strings.Contains(raw, `"battery_state": "charging"`) {
+		t.Errorf("want raw overland feature stored, got source %s raw %s", source, raw)
+	}
+
+	// bad locations are skipped, the rest of the batch is still stored
+	rec = publish("jane", `{"locations":[
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{"timestamp":"2020-06-21T10:00:00Z","device_id":"iphone"}},
+		{"type":"Feature","geometry":{"type":"LineString"},"properties":{"timestamp":"2020-06-21T10:00:00Z"}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[1,200]},"properties":{"timestamp":"2020-06-21T10:01:00Z"}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":"1,2"},"properties":{"timestamp":"2020-06-21T10:02:00Z"}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{"timestamp":"yesterday"}}
+	]}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"result":"ok"}` {
+		t.Errorf("want batch with bad locations accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var count int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("want only the valid location from the batch stored, have %d", count)
+	}
+
+	// nothing valid at all is still accepted, so the app moves on
+	rec = publish("jane", `{"locations":[{"type":"Feature","geometry":{"type":"LineString"},"properties":{"timestamp":"2020-06-21T10:00:00Z","device_id":"iphone"}}]}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"result":"ok"}` {
+		t.Errorf("want batch with only bad locations accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := publish("", egOverlandBatch); rec.Code != http.StatusBadRequest {
+		t.Errorf("want unidentified device to be rejected, got %d", rec.Code)
+	}
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 type owntracksStore interface {
-	// AddOTLocation persists the message, of type location
-	AddOTLocation(context.Context, owntracksMessage) error
+	// AddOTMessages persists the location, transition, waypoint(s) and card
+	// messages in a single transaction, returning the number of locations
+	// skipped as they were already stored.
+	AddOTMessages(ctx context.Context, msgs []owntracksMessage) (duplicates int, _ error)
+	// OTFriendMessages returns the latest location and card messages for the
+	// other devices the device with the given topic is allowed to see
+	OTFriendMessages(ctx context.Context, topic string) ([]json.RawMessage, error)
 }
 
 // owntracksServer can handle receiving and persisting owntracks events from a
@@ -20,6 +27,10 @@ type owntracksStore interface {
 type owntracksServer struct {
 	log   logger
 	store owntracksStore
+
+	// encryptionKeys maps device topics to the secret they encrypt their
+	// payloads with, if any.
+	encryptionKeys map[string]string
 }
 
 func (o *owntracksServer) HandlePublish(w http.ResponseWriter, r *http.Request) {
@@ -38,8 +49,6 @@ func (o *owntracksServer) HandlePublish(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// parse message
-	msg := owntracksMessage{}
 	rawMsg, err := io.ReadAll(r.Body)
 	if err != nil {
 		metricOTSubmitErrorCount.Inc()
@@ -47,31 +56,290 @@ func (o *owntracksServer) HandlePublish(w http.ResponseWriter, r *http.Request)
 		http.Error(w, fmt.Sprintf("read owntracks message: %v", err), http.StatusInternalServerError)
 		return
 	}
+
+	if isJSONArray(rawMsg) {
+		o.handlePublishBatch(w, r, rawMsg)
+		return
+	}
+
+	// parse message
+	msg := owntracksMessage{}
 	if err := json.Unmarshal(rawMsg, &msg); err != nil {
 		metricOTSubmitErrorCount.Inc()
 		o.log.Printf("decoding owntracks message (%s): %v", string(rawMsg), err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	msg.Topic = publishTopic(r)
 
-	// ignore if not location
-	if !msg.IsLocation() {
-		o.log.Printf("ignoring payload type %s", msg.Type)
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `[]`)
+	// the apps retry non-2xx responses until they succeed, which would block
+	// the device's queue on a message that will never be valid. Reject those
+	// as bad requests, like the batch path does.
+	pm, ok, err := o.prepareMessage(msg)
+	if err != nil {
+		metricOTSubmitErrorCount.Inc()
+		o.log.Printf("rejected owntracks message from %s: %v", msg.Topic, err)
+		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusBadRequest)
 		return
 	}
+	if ok {
+		if err := o.persistMessage(r.Context(), pm); err != nil {
+			metricOTSubmitErrorCount.Inc()
+			o.log.Print(err.Error())
+			http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	if err := o.store.AddOTLocation(r.Context(), msg); err != nil {
+	if err := o.writeFriends(w, r, msg.Topic); err != nil {
 		metricOTSubmitErrorCount.Inc()
-		o.log.Printf("persisting device location: %v", err)
-		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+		o.log.Printf("writing friends response: %v", err)
+		return
+	}
+	metricOTSubmitSuccessCount.Inc()
+}
+
+// otBatchResponse is returned for array payloads
+type otBatchResponse struct {
+	Accepted int `json:"accepted"`
+	// Duplicates is how many of the accepted locations were already stored
+	Duplicates int               `json:"duplicates"`
+	Rejected   []otBatchRejected `json:"rejected"`
+}
+
+// otBatchRejected is a message in a batch that was invalid, identified by its
+// index in the array
+type otBatchRejected struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// handlePublishBatch handles an array of messages, as sent by relays and
+// devices flushing their queue. Each message is validated on its own, the valid
+// ones are persisted in a single transaction. Invalid messages are reported in
+// the response rather than failing the request, as retrying them won't help.
+func (o *owntracksServer) handlePublishBatch(w http.ResponseWriter, r *http.Request, rawBatch []byte) {
+	var rawMsgs []json.RawMessage
+	if err := json.Unmarshal(rawBatch, &rawMsgs); err != nil {
+		metricOTSubmitErrorCount.Inc()
+		o.log.Printf("decoding owntracks batch (%s): %v", string(rawBatch), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// return empty json array. Eventually we should support reading/publishing
-	// from a MQTT endpoint
+	resp := otBatchResponse{Rejected: []otBatchRejected{}}
+	var msgs []owntracksMessage
+	for i, rm := range rawMsgs {
+		msg := owntracksMessage{}
+		if err := json.Unmarshal(rm, &msg); err != nil {
+			resp.Rejected = append(resp.Rejected, otBatchRejected{Index: i, Error: err.Error()})
+			continue
+		}
+		msg.Topic = publishTopic(r)
+
+		pm, ok, err := o.prepareMessage(msg)
+		if err != nil {
+			resp.Rejected = append(resp.Rejected, otBatchRejected{Index: i, Error: err.Error()})
+			continue
+		}
+		resp.Accepted++
+		if ok {
+			msgs = append(msgs, pm)
+		}
+	}
+	for _, rj := range resp.Rejected {
+		o.log.Printf("rejected owntracks message %d in batch: %s", rj.Index, rj.Error)
+	}
+
+	if len(msgs) > 0 {
+		dups, err := o.store.AddOTMessages(r.Context(), msgs)
+		if err != nil {
+			metricOTSubmitErrorCount.Inc()
+			o.log.Printf("persisting owntracks batch: %v", err)
+			http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if dups > 0 {
+			o.log.Printf("skipped %d already stored locations in owntracks batch", dups)
+		}
+		resp.Duplicates = dups
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		metricOTSubmitErrorCount.Inc()
+		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `[]`)
+	_, _ = w.Write(b)
 	metricOTSubmitSuccessCount.Inc()
 }
+
+// publishTopic returns the topic a message published over HTTP should be
+// attributed to. Any topic in the message itself is ignored, otherwise a
+// client could publish as, and see the friends of, any other device.
+func publishTopic(r *http.Request) string {
+	if d := authenticatedDevice(r.Context()); d != nil {
+		// the device's own credentials are authoritative
+		return fmt.Sprintf("owntracks/%s/%s", d.User, d.Name)
+	}
+	return httpPublishTopic(r)
+}
+
+// handleMessage persists the message, based on its type. Messages of types we
+// don't handle are logged and ignored.
+func (o *owntracksServer) handleMessage(ctx context.Context, msg owntracksMessage) error {
+	pm, ok, err := o.prepareMessage(msg)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return o.persistMessage(ctx, pm)
+}
+
+// persistMessage stores a message returned by prepareMessage
+func (o *owntracksServer) persistMessage(ctx context.Context, pm owntracksMessage) error {
+	dups, err := o.store.AddOTMessages(ctx, []owntracksMessage{pm})
+	if err != nil {
+		return fmt.Errorf("persisting %s message: %v", pm.Type, err)
+	}
+	if dups > 0 {
+		o.log.Printf("skipped already stored location from %s", pm.Topic)
+	}
+	return nil
+}
+
+// prepareMessage decrypts and validates the message, returning what should be
+// persisted. Messages of types we don't handle are logged, and false is
+// returned for them.
+func (o *owntracksServer) prepareMessage(msg owntracksMessage) (_ owntracksMessage, ok bool, _ error) {
+	if msg.IsEncrypted() {
+		dm, err := o.decrypt(msg)
+		if err != nil {
+			return owntracksMessage{}, false, fmt.Errorf("decrypting message from %s: %v", msg.Topic, err)
+		}
+		msg = dm
+	}
+
+	switch {
+	case msg.IsLocation(), msg.IsTransition(), msg.IsWaypoint(), msg.IsWaypoints():
+	case msg.IsCard() && msg.Topic != "":
+	default:
+		o.log.Printf("ignoring payload type %s", msg.Type)
+		return msg, false, nil
+	}
+
+	if err := msg.Validate(); err != nil {
+		return owntracksMessage{}, false, fmt.Errorf("invalid %s message: %v", msg.Type, err)
+	}
+	return msg, true, nil
+}
+
+// decrypt opens an encrypted message with the key for the topic it was
+// published to.
+func (o *owntracksServer) decrypt(msg owntracksMessage) (owntracksMessage, error) {
+	secret, ok := o.encryptionKeys[msg.Topic]
+	if !ok {
+		return owntracksMessage{}, fmt.Errorf("no encryption key configured for topic %q", msg.Topic)
+	}
+	enc, err := msg.AsEncrypted()
+	if err != nil {
+		return owntracksMessage{}, err
+	}
+	dm, err := enc.Decrypt(secret)
+	if err != nil {
+		return owntracksMessage{}, err
+	}
+	if dm.IsEncrypted() {
+		return owntracksMessage{}, fmt.Errorf("encrypted message contains another encrypted message")
+	}
+	// the transport's attribution is what we found the key with, so it
+	// should stick.
+	dm.Topic = msg.Topic
+	return dm, nil
+}
+
+// writeFriends responds with the latest location and card for the other
+// devices the publishing device can see, so the apps can show them as friends.
+// An error is returned to the client if this fails.
+//
+// https://owntracks.org/booklet/tech/http/#response
+func (o *owntracksServer) writeFriends(w http.ResponseWriter, r *http.Request, topic string) error {
+	friends, err := o.store.OTFriendMessages(r.Context(), topic)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+		return err
+	}
+	// if the device encrypts what it sends us, it'll want the same for what
+	// we send it.
+	if secret, ok := o.encryptionKeys[topic]; ok {
+		for i := range friends {
+			friends[i], err = encryptOTMessage(secret, friends[i])
+			if err != nil {
+				http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+				return err
+			}
+		}
+	}
+	b, err := json.Marshal(friends)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error: %s", err), http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+	return nil
+}
+
+// isJSONArray reports if the JSON value in b is an array
+func isJSONArray(b []byte) bool {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	return len(b) > 0 && b[0] == '['
+}
+
+// httpPublishTopic builds the topic the device would have published to in MQTT
+// mode, from the headers the apps send in HTTP mode. If the app doesn't send a
+// user, the basic auth user is used. Returns an empty string if the device
+// can't be identified.
+func httpPublishTopic(r *http.Request) string {
+	u, d := r.Header.Get("X-Limit-U"), r.Header.Get("X-Limit-D")
+	if u == "" {
+		u, _, _ = r.BasicAuth()
+	}
+	if u == "" || d == "" {
+		return ""
+	}
+	return fmt.Sprintf("owntracks/%s/%s", u, d)
+}
+
+// otTopicUserDevice returns the user and device a topic in the form
+// <base>/<user>/<device> belongs to.
+func otTopicUserDevice(topic string) (user, device string, ok bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[len(parts)-2] == "" || parts[len(parts)-1] == "" {
+		return "", "", false
+	}
+	return parts[len(parts)-2], parts[len(parts)-1], true
+}
+
+// parseOTEncryptionKeys parses a list of topic=secret pairs, separated by commas
+// or newlines, in to a map of topic to secret.
+func parseOTEncryptionKeys(s string) (map[string]string, error) {
+	ret := map[string]string{}
+	for i, kv := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		topic, secret, ok := strings.Cut(kv, "=")
+		if !ok || topic == "" || secret == "" {
+			// don't include the value, it might be the secret
+			return nil, fmt.Errorf("encryption key %d should be in the form topic=secret", i+1)
+		}
+		ret[topic] = secret
+	}
+	return ret, nil
+}
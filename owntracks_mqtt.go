@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// owntracksMQTTSubscriber subscribes to the MQTT broker the OwnTracks apps
+// publish to, and persists the messages the same way as the HTTP publish
+// endpoint.
+//
+// https://owntracks.org/booklet/tech/mqtt/
+type owntracksMQTTSubscriber struct {
+	log logger
+	ots *owntracksServer
+
+	broker   string
+	username string
+	password string
+	clientID string
+	// topics is a comma separated list of topic filters
+	topics string
+	qos    int
+}
+
+// defaultMQTTTopics are what the apps publish that we handle. Locations are
+// published to owntracks/<user>/<device>, and transitions to the event subtopic
+// of it. Other subtopics like cmd and dump aren't subscribed to.
+const defaultMQTTTopics = "owntracks/+/+,owntracks/+/+/event"
+
+func (m *owntracksMQTTSubscriber) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&m.broker, "mqtt-broker", getEnvDefault("MQTT_BROKER", ""), "If set, subscribe to owntracks messages on this MQTT broker (e.g tcp://localhost:1883)")
+	fs.StringVar(&m.username, "mqtt-username", getEnvDefault("MQTT_USERNAME", ""), "Username for the MQTT broker")
+	fs.StringVar(&m.password, "mqtt-password", "", "Password for the MQTT broker")
+	fs.StringVar(&m.clientID, "mqtt-client-id", getEnvDefault("MQTT_CLIENT_ID", "wherewasi"), "Client ID to connect to the MQTT broker with")
+	fs.StringVar(&m.topics, "mqtt-topic", getEnvDefault("MQTT_TOPIC", defaultMQTTTopics), "Comma separated topic filters to subscribe to")
+	fs.IntVar(&m.qos, "mqtt-qos", 1, "QoS level to subscribe with (0, 1 or 2)")
+}
+
+func (m *owntracksMQTTSubscriber) Validate() error {
+	var errs []string
+
+	if m.ots == nil {
+		errs = append(errs, "owntracks server is required")
+	}
+
+	if m.broker == "" {
+		errs = append(errs, "mqtt-broker is required")
+	}
+
+	if m.qos < 0 || m.qos > 2 {
+		errs = append(errs, "mqtt-qos must be 0, 1 or 2")
+	}
+
+	if len(m.topicFilters()) == 0 {
+		errs = append(errs, "mqtt-topic is required")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// topicFilters returns the topic filters to subscribe to
+func (m *owntracksMQTTSubscriber) topicFilters() []string {
+	var ret []string
+	for _, f := range strings.Split(m.topics, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// run connects to the broker and processes messages until the context is
+// canceled. The initial connection is retried with backoff, after that the
+// client automatically reconnects and resubscribes.
+func (m *owntracksMQTTSubscriber) run(ctx context.Context) error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.broker).
+		SetClientID(m.clientID).
+		SetUsername(m.username).
+		SetPassword(m.password).
+		// keep the session, so the broker queues messages for us while
+		// we're disconnected
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(5 * time.Minute).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			metricOTMQTTErrorCount.Inc()
+			m.log.Printf("lost connection to mqtt broker %s: %v", m.broker, err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			// (re)subscribe every time we connect, in case the broker lost
+			// our session
+			m.log.Printf("connected to mqtt broker %s, subscribing to %s", m.broker, m.topics)
+			filters := map[string]byte{}
+			for _, f := range m.topicFilters() {
+				filters[f] = byte(m.qos)
+			}
+			tok := c.SubscribeMultiple(filters, m.handleMessage(ctx))
+			if tok.Wait() && tok.Error() != nil {
+				metricOTMQTTErrorCount.Inc()
+				m.log.Printf("subscribing to %s: %v", m.topics, tok.Error())
+			}
+		})
+
+	client := mqtt.NewClient(opts)
+
+	connect := func() error {
+		tok := client.Connect()
+		tok.Wait()
+		return tok.Error()
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = 0
+	bo.MaxInterval = 5 * time.Minute
+	nf := func(err error, d time.Duration) {
+		m.log.Printf("Backing off for %s connecting to mqtt broker, received error %v", d.String(), err)
+	}
+	if err := backoff.RetryNotify(connect, backoff.WithContext(bo, ctx), nf); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("connecting to mqtt broker %s: %v", m.broker, err)
+	}
+
+	<-ctx.Done()
+	client.Disconnect(250)
+	return nil
+}
+
+func (m *owntracksMQTTSubscriber) handleMessage(ctx context.Context) mqtt.MessageHandler {
+	return func(_ mqtt.Client, mm mqtt.Message) {
+		if len(mm.Payload()) == 0 {
+			// retained messages are cleared with an empty payload, nothing
+			// for us to do with them.
+			return
+		}
+
+		msg := owntracksMessage{}
+		if err := json.Unmarshal(mm.Payload(), &msg); err != nil {
+			metricOTMQTTErrorCount.Inc()
+			m.log.Printf("decoding owntracks message on %s (%s): %v", mm.Topic(), string(mm.Payload()), err)
+			return
+		}
+		// the topic is authoritative for which device the message belongs
+		// to. Messages like events are published to a subtopic, so only use
+		// the device part
+		msg.Topic = mqttDeviceTopic(mm.Topic())
+
+		if err := m.ots.handleMessage(ctx, msg); err != nil {
+			metricOTMQTTErrorCount.Inc()
+			m.log.Printf("handling message on %s: %v", mm.Topic(), err)
+			return
+		}
+		metricOTMQTTSuccessCount.Inc()
+	}
+}
+
+// mqttDeviceTopic returns the owntracks/<user>/<device> part of the topic a
+// message was published on.
+func mqttDeviceTopic(topic string) string {
+	parts := strings.SplitN(topic, "/", 4)
+	if len(parts) < 3 {
+		return topic
+	}
+	return strings.Join(parts[:3], "/")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+func TestMQTTSubscriber(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	broker := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP("t1", "127.0.0.1:0", nil)
+	if err := broker.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+
+	// retain the messages, so they are delivered whenever the subscriber gets
+	// around to subscribing
+	if err := broker.Publish("owntracks/jane/phone", []byte(egOwntracksLocation), true, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish("owntracks/jane/phone/event", []byte(egOwntracksTransition), true, 1); err != nil {
+		t.Fatal(err)
+	}
+	// not subscribed to, the location shouldn't be stored
+	if err := broker.Publish("owntracks/jane/phone/dump", []byte(`{"_type":"location","tst":1592691000,"lat":1,"lon":1}`), true, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	lg := log.New(os.Stderr, "", log.LstdFlags)
+	sub := &owntracksMQTTSubscriber{
+		log: lg,
+		ots: &owntracksServer{
+			log:   lg,
+			store: s,
+		},
+		broker:   "tcp://" + tcp.Address(),
+		clientID: "wherewasi-test",
+		topics:   defaultMQTTTopics,
+		qos:      1,
+	}
+	if err := sub.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	errC := make(chan error, 1)
+	go func() { errC <- sub.run(runCtx) }()
+
+	var locTopic, trTopic string
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		_ = s.db.QueryRowContext(ctx, `select ifnull(max(topic), '') from device_locations`).Scan(&locTopic)
+		_ = s.db.QueryRowContext(ctx, `select ifnull(max(topic), '') from region_transitions`).Scan(&trTopic)
+		if locTopic != "" && trTopic != "" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if locTopic != "owntracks/jane/phone" {
+		t.Errorf("want location attributed to owntracks/jane/phone, got: %q", locTopic)
+	}
+	if trTopic != "owntracks/jane/phone" {
+		t.Errorf("want transition attributed to owntracks/jane/phone, got: %q", trTopic)
+	}
+	var count int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("want only the location published to the device topic, got %d", count)
+	}
+
+	cancel()
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Errorf("subscriber returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("subscriber did not shut down")
+	}
+}
+
+func TestMQTTDeviceTopic(t *testing.T) {
+	for in, want := range map[string]string{
+		"owntracks/jane/phone":          "owntracks/jane/phone",
+		"owntracks/jane/phone/event":    "owntracks/jane/phone",
+		"owntracks/jane/phone/cmd/card": "owntracks/jane/phone",
+		"owntracks/jane":                "owntracks/jane",
+	} {
+		if got := mqttDeviceTopic(in); got != want {
+			t.Errorf("mqttDeviceTopic(%q): want %q, got %q", in, want, got)
+		}
+	}
+}
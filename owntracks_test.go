@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandlePublishFriends(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	ots := &owntracksServer{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		store: s,
+	}
+
+	publish := func(user, device, body string) []map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/pub", strings.NewReader(body))
+		req.Header.Set("X-Limit-U", user)
+		req.Header.Set("X-Limit-D", device)
+		rec := httptest.NewRecorder()
+		ots.HandlePublish(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("publish as %s/%s: want status 200, got %d: %s", user, device, rec.Code, rec.Body.String())
+		}
+		var resp []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding response %s: %v", rec.Body.String(), err)
+		}
+		return resp
+	}
+
+	if resp := publish("jane", "phone", egOwntracksLocation); len(resp) != 0 {
+		t.Errorf("want no friends with nobody else publishing, got: %v", resp)
+	}
+
+	publish("bob", "pixel", `{"_type":"card","name":"Bob","tid":"BB"}`)
+	publish("bob", "pixel", `{"tst":1592691300,"acc":10,"_type":"location","lon":86.7,"lat":36.1,"tid":"BB"}`)
+	resp := publish("bob", "pixel", `{"tst":1592691400,"acc":10,"_type":"location","lon":86.8,"lat":36.2,"tid":"BB"}`)
+	if len(resp) != 0 {
+		t.Errorf("bob should not see jane before she shares with him, got: %v", resp)
+	}
+	if resp := publish("jane", "phone", egOwntracksLocation); len(resp) != 0 {
+		t.Errorf("jane should not see bob before he shares with her, got: %v", resp)
+	}
+
+	// a user's own devices can see each other
+	resp = publish("jane", "tablet", `{"tst":1592691500,"acc":10,"_type":"location","lon":86.9,"lat":36.3,"tid":"JT"}`)
+	if len(resp) != 1 || resp[0]["topic"] != "owntracks/jane/phone" {
+		t.Errorf("jane's tablet should see her phone, got: %v", resp)
+	}
+
+	if err := s.ShareLocations(ctx, "jane", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	resp = publish("bob", "pixel", `{"tst":1592691600,"acc":10,"_type":"location","lon":86.8,"lat":36.2,"tid":"BB"}`)
+	if len(resp) != 2 {
+		t.Errorf("bob should see jane's phone and tablet, got: %v", resp)
+	}
+	if resp := publish("jane", "tablet", `{"tst":1592691700,"acc":10,"_type":"location","lon":86.9,"lat":36.3,"tid":"JT"}`); len(resp) != 1 {
+		t.Errorf("sharing should be one way, jane should only see her phone, got: %v", resp)
+	}
+
+	if err := s.ShareLocations(ctx, "bob", "jane"); err != nil {
+		t.Fatal(err)
+	}
+	resp = publish("jane", "phone", egOwntracksLocation)
+	var types []string
+	for _, m := range resp {
+		if m["topic"] == "owntracks/jane/tablet" {
+			continue
+		}
+		if m["topic"] != "owntracks/bob/pixel" {
+			t.Errorf("want friend message for bob, got topic %v", m["topic"])
+		}
+		if m["_type"] == "location" && m["lat"] != 36.2 {
+			t.Errorf("want bob's latest location, got lat %v", m["lat"])
+		}
+		types = append(types, m["_type"].(string))
+	}
+	if strings.Join(types, ",") != "location,card" {
+		t.Errorf("want bob's location and card, got: %v", types)
+	}
+
+	// the topic in the message can't be used to publish as someone else
+	resp = publish("mallory", "laptop", `{"tst":1592691800,"acc":10,"_type":"location","lon":1,"lat":1,"topic":"owntracks/bob/pixel"}`)
+	if len(resp) != 0 {
+		t.Errorf("mallory should not see bob's friends by claiming his topic, got: %v", resp)
+	}
+	var topic string
+	if err := s.db.QueryRowContext(ctx, `select topic from device_locations where lat = 1`).Scan(&topic); err != nil {
+		t.Fatal(err)
+	}
+	if topic != "owntracks/mallory/laptop" {
+		t.Errorf("want location attributed to mallory's device, got %s", topic)
+	}
+}
+
+func TestHandlePublishEncrypted(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	ots := &owntracksServer{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		store: s,
+		encryptionKeys: map[string]string{
+			"owntracks/jane/phone": "s3cret",
+		},
+	}
+
+	enc, err := encryptOTMessage("s3cret", []byte(egOwntracksLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user, device string
+		wantStatus   int
+	}{
+		{user: "jane", device: "phone", wantStatus: http.StatusOK},
+		{user: "bob", device: "pixel", wantStatus: http.StatusBadRequest}, // no key
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/pub", strings.NewReader(string(enc)))
+		req.Header.Set("X-Limit-U", tc.user)
+		req.Header.Set("X-Limit-D", tc.device)
+		rec := httptest.NewRecorder()
+		ots.HandlePublish(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("publish as %s/%s: want status %d, got %d: %s", tc.user, tc.device, tc.wantStatus, rec.Code, rec.Body.String())
+		}
+	}
+
+	var topic string
+	if err := s.db.QueryRowContext(ctx, `select topic from device_locations`).Scan(&topic); err != nil {
+		t.Fatal(err)
+	}
+	if topic != "owntracks/jane/phone" {
+		t.Errorf("want location stored for jane, got: %s", topic)
+	}
+
+	// bob publishes in the clear, jane should get his location encrypted
+	req := httptest.NewRequest(http.MethodPost, "/pub", strings.NewReader(egOwntracksLocation))
+	req.Header.Set("X-Limit-U", "bob")
+	req.Header.Set("X-Limit-D", "pixel")
+	ots.HandlePublish(httptest.NewRecorder(), req)
+	if err := s.ShareLocations(ctx, "bob", "jane"); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/pub", strings.NewReader(string(enc)))
+	req.Header.Set("X-Limit-U", "jane")
+	req.Header.Set("X-Limit-D", "phone")
+	rec := httptest.NewRecorder()
+	ots.HandlePublish(rec, req)
+
+	var resp []owntracksMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || !resp[0].IsEncrypted() {
+		t.Fatalf("want one encrypted friend message, got: %s", rec.Body.String())
+	}
+	e, err := resp[0].AsEncrypted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm, err := e.Decrypt("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fm.IsLocation() || fm.Topic != "owntracks/bob/pixel" {
+		t.Errorf("want bob's location, got type %s topic %s", fm.Type, fm.Topic)
+	}
+}
+
+func TestParseOTEncryptionKeys(t *testing.T) {
+	keys, err := parseOTEncryptionKeys("owntracks/jane/phone=s3cret, owntracks/bob/pixel=a=b\nowntracks/jane/ipad=other\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"owntracks/jane/phone": "s3cret",
+		"owntracks/bob/pixel":  "a=b",
+		"owntracks/jane/ipad":  "other",
+	}
+	if len(keys) != len(want) {
+		t.Errorf("want %d keys, got: %d", len(want), len(keys))
+	}
+	for k, v := range want {
+		if keys[k] != v {
+			t.Errorf("key %s: want %q, got %q", k, v, keys[k])
+		}
+	}
+
+	if _, err := parseOTEncryptionKeys("s3cret"); err == nil {
+		t.Error("want error for key without topic")
+	}
+}
+
+func TestHandlePublishDeviceAuth(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	lg := log.New(os.Stderr, "", log.LstdFlags)
+	ots := &owntracksServer{
+		log:   lg,
+		store: s,
+	}
+	h := wrapPublishAuth(lg, s, "shared", "sharedpw", http.HandlerFunc(ots.HandlePublish))
+
+	u, p, err := s.CreateDeviceCredential(ctx, "bob", "pixel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user, pass string
+		wantStatus int
+	}{
+		{user: u, pass: p, wantStatus: http.StatusOK},
+		{user: "shared", pass: "sharedpw", wantStatus: http.StatusOK},
+		{user: u, pass: "sharedpw", wantStatus: http.StatusUnauthorized},
+		{user: "", pass: "", wantStatus: http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/pub", strings.NewReader(egOwntracksLocation))
+		req.SetBasicAuth(tc.user, tc.pass)
+		// the device's credentials should win over what it claims to be
+		req.Header.Set("X-Limit-U", "jane")
+		req.Header.Set("X-Limit-D", "phone")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("publish as %q: want status %d, got %d", tc.user, tc.wantStatus, rec.Code)
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `select topic from device_locations order by rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var topics []string
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			t.Fatal(err)
+		}
+		topics = append(topics, topic)
+	}
+	if strings.Join(topics, ",") != "owntracks/bob/pixel,owntracks/jane/phone" {
+		t.Errorf("want locations attributed to bob/pixel then jane/phone, got: %v", topics)
+	}
+}
+
+func TestHandlePublishBatch(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	ots := &owntracksServer{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		store: s,
+	}
+
+	publish := func(body string) otBatchResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/pub", strings.NewReader(body))
+		req.Header.Set("X-Limit-U", "jane")
+		req.Header.Set("X-Limit-D", "phone")
+		rec := httptest.NewRecorder()
+		ots.HandlePublish(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("want status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp otBatchResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding response %s: %v", rec.Body.String(), err)
+		}
+		return resp
+	}
+
+	batch := `[
+		{"_type":"location","tst":1592691300,"acc":10,"lon":86.7,"lat":36.1},
+		{"_type":"location","tst":"yesterday","lon":86.7,"lat":36.1},
+		"not an object",
+		{"_type":"location","tst":1592691400,"acc":10,"lon":86.8,"lat":136.2},
+		{"_type":"card","name":"Jane"},
+		{"_type":"lwt","tst":1592691400},
+		{"_type":"location","tst":1592691500,"acc":10,"lon":86.9,"lat":36.3}
+	]`
+	resp := publish(batch)
+
+	if resp.Accepted != 4 {
+		t.Errorf("want 4 messages accepted, got %d", resp.Accepted)
+	}
+	var rejected []int
+	for _, rj := range resp.Rejected {
+		rejected = append(rejected, rj.Index)
+		if rj.Error == "" {
+			t.Errorf("message %d rejected without an error", rj.Index)
+		}
+	}
+	if fmt.Sprint(rejected) != "[1 2 3]" {
+		t.Errorf("want messages 1, 2 and 3 rejected, got %v", rejected)
+	}
+
+	var locCount, cardCount int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations where topic = 'owntracks/jane/phone'`).Scan(&locCount); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from cards where topic = 'owntracks/jane/phone'`).Scan(&cardCount); err != nil {
+		t.Fatal(err)
+	}
+	if locCount != 2 || cardCount != 1 {
+		t.Errorf("want the 2 valid locations and card persisted, got %d locations and %d cards", locCount, cardCount)
+	}
+
+	// a retried batch shouldn't duplicate anything
+	if resp := publish(batch); resp.Duplicates != 2 {
+		t.Errorf("want the 2 locations reported as duplicates on retry, got %d", resp.Duplicates)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&locCount); err != nil {
+		t.Fatal(err)
+	}
+	if locCount != 2 {
+		t.Errorf("want 2 locations after retry, got %d", locCount)
+	}
+}
+
+func TestHandlePublishInvalid(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	ots := &owntracksServer{
+		log:   log.New(os.Stderr, "", log.LstdFlags),
+		store: s,
+	}
+
+	for _, body := range []string{
+		`{"_type":"location","tst":1592691400,"acc":10,"lon":86.8,"lat":136.2}`,
+		`{"_type":"location","tst":"yesterday","lon":86.7,"lat":36.1}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/pub", strings.NewReader(body))
+		req.Header.Set("X-Limit-U", "jane")
+		req.Header.Set("X-Limit-D", "phone")
+		rec := httptest.NewRecorder()
+		ots.HandlePublish(rec, req)
+		// anything else and the apps will retry it forever
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: want status 400, got %d: %s", body, rec.Code, rec.Body.String())
+		}
+	}
+
+	var locCount int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&locCount); err != nil {
+		t.Fatal(err)
+	}
+	if locCount != 0 {
+		t.Errorf("want no locations persisted, got %d", locCount)
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 // https://owntracks.org/booklet/tech/json/
@@ -12,16 +17,22 @@ import (
 type owntracksMessage struct {
 	Type string `json:"_type"`
 	Data json.RawMessage
+	// Topic identifies the device that sent the message (e.g
+	// owntracks/jane/phone). It is populated from the payload if present, but
+	// transports may set it from information they have.
+	Topic string
 }
 
 func (o *owntracksMessage) UnmarshalJSON(b []byte) error {
 	var into struct {
-		Type string `json:"_type"`
+		Type  string `json:"_type"`
+		Topic string `json:"topic"`
 	}
 	if err := json.Unmarshal(b, &into); err != nil {
 		return err
 	}
 	o.Type = into.Type
+	o.Topic = into.Topic
 	o.Data = b
 	return nil
 }
@@ -30,6 +41,68 @@ func (o *owntracksMessage) IsLocation() bool {
 	return o.Type == "location"
 }
 
+func (o *owntracksMessage) IsTransition() bool {
+	return o.Type == "transition"
+}
+
+func (o *owntracksMessage) IsWaypoint() bool {
+	return o.Type == "waypoint"
+}
+
+func (o *owntracksMessage) IsWaypoints() bool {
+	return o.Type == "waypoints"
+}
+
+func (o *owntracksMessage) IsCard() bool {
+	return o.Type == "card"
+}
+
+func (o *owntracksMessage) IsEncrypted() bool {
+	return o.Type == "encrypted"
+}
+
+// Validate checks that a message of a type we persist can be parsed, and has
+// sensible values.
+func (o *owntracksMessage) Validate() error {
+	switch {
+	case o.IsLocation():
+		l, err := o.AsLocation()
+		if err != nil {
+			return err
+		}
+		return validLatLng(l.Latitude, l.Longitude)
+	case o.IsTransition():
+		t, err := o.AsTransition()
+		if err != nil {
+			return err
+		}
+		return validLatLng(t.Latitude, t.Longitude)
+	case o.IsWaypoint():
+		w, err := o.AsWaypoint()
+		if err != nil {
+			return err
+		}
+		return validLatLng(w.Latitude, w.Longitude)
+	case o.IsWaypoints():
+		wps, err := o.AsWaypoints()
+		if err != nil {
+			return err
+		}
+		for _, w := range wps.Waypoints {
+			if err := validLatLng(w.Latitude, w.Longitude); err != nil {
+				return fmt.Errorf("waypoint %s: %v", w.Description, err)
+			}
+		}
+	case o.IsCard():
+		_, err := o.AsCard()
+		return err
+	case o.IsEncrypted():
+		_, err := o.AsEncrypted()
+		return err
+	}
+	return nil
+}
+
 func (o *owntracksMessage) AsLocation() (otLocation, error) {
 	if !o.IsLocation() {
 		return otLocation{}, fmt.Errorf("message type %s is not location", o.Type)
@@ -101,3 +174,221 @@ type otLocation struct {
 func (l *otLocation) Timestamp() time.Time {
 	return time.Unix(int64(l.TimestampUnix), 0)
 }
+
+func (o *owntracksMessage) AsTransition() (otTransition, error) {
+	if !o.IsTransition() {
+		return otTransition{}, fmt.Errorf("message type %s is not transition", o.Type)
+	}
+	r := otTransition{}
+	if err := json.Unmarshal(o.Data, &r); err != nil {
+		return otTransition{}, err
+	}
+	return r, nil
+}
+
+// otTransition is sent when a device enters or leaves a monitored region
+// https://owntracks.org/booklet/tech/json/#_typetransition
+type otTransition struct {
+	// Timestamp of waypoint creation (iOS,Android/integer/epoch/required)
+	WaypointTimestampUnix int `json:"wtst"`
+	// latitude (iOS,Android/float/degree/required)
+	Latitude float64 `json:"lat"`
+	// longitude (iOS,Android/float/degree/required)
+	Longitude float64 `json:"lon"`
+	// Timestamp at which the event occurred (iOS,Android/integer/epoch/required)
+	TimestampUnix int `json:"tst"`
+	// Accuracy of the reported location in meters without unit
+	// (iOS,Android/integer/meters/required)
+	Accuracy *int `json:"acc,omitempty"`
+	// Tracker ID used to display the initials of a user
+	// (iOS,Android/string/optional)
+	TrackerID *string `json:"tid,omitempty"`
+	// event that triggered the transition (iOS,Android/string/required)
+	//   * enter the device entered the defined geographical region or BLE
+	//     Beacon range (iOS,Android)
+	//   * leave the device left the defined geographical region or BLE Beacon
+	//     range (iOS,Android)
+	Event string `json:"event"`
+	// name of the waypoint (iOS,Android/string/optional)
+	Description *string `json:"desc,omitempty"`
+	// trigger for the event (iOS,Android/string/required)
+	//   * c circular region
+	//   * b beacon region (iOS)
+	//   * l location (Android)
+	Trigger *string `json:"t,omitempty"`
+	// region ID of the waypoint (iOS/string/optional)
+	RegionID *string `json:"rid,omitempty"`
+	// (only in HTTP payloads) contains the original publish topic (e.g.
+	// owntracks/jane/phone). (iOS)
+	Topic *string `json:"topic,omitempty"`
+}
+
+// Timestamp returns the time the transition occurred
+func (t *otTransition) Timestamp() time.Time {
+	return time.Unix(int64(t.TimestampUnix), 0)
+}
+
+// WaypointTimestamp returns the time the waypoint the transition relates to
+// was created. This is what OwnTracks uses to identify a region.
+func (t *otTransition) WaypointTimestamp() time.Time {
+	return time.Unix(int64(t.WaypointTimestampUnix), 0)
+}
+
+func (o *owntracksMessage) AsWaypoint() (otWaypoint, error) {
+	if !o.IsWaypoint() {
+		return otWaypoint{}, fmt.Errorf("message type %s is not waypoint", o.Type)
+	}
+	r := otWaypoint{}
+	if err := json.Unmarshal(o.Data, &r); err != nil {
+		return otWaypoint{}, err
+	}
+	return r, nil
+}
+
+func (o *owntracksMessage) AsWaypoints() (otWaypoints, error) {
+	if !o.IsWaypoints() {
+		return otWaypoints{}, fmt.Errorf("message type %s is not waypoints", o.Type)
+	}
+	r := otWaypoints{}
+	if err := json.Unmarshal(o.Data, &r); err != nil {
+		return otWaypoints{}, err
+	}
+	return r, nil
+}
+
+// otWaypoint is a monitored region defined on a device
+// https://owntracks.org/booklet/tech/json/#_typewaypoint
+type otWaypoint struct {
+	// Name of the waypoint that is included in the sent transition message,
+	// copied into the location message inregions array when a current position
+	// is within a region. (iOS,Android,/string/required)
+	Description string `json:"desc"`
+	// latitude (iOS,Android/float/degree/required)
+	Latitude float64 `json:"lat"`
+	// longitude (iOS,Android/float/degree/required)
+	Longitude float64 `json:"lon"`
+	// radius around the latitude and longitude coordinates
+	// (iOS,Android/integer/meters/optional)
+	Radius *int `json:"rad,omitempty"`
+	// Timestamp of creation of region, copied into the wtst element of the
+	// transition message (iOS,Android/integer/epoch/required)
+	TimestampUnix int `json:"tst"`
+	// region ID, created automatically, copied into the location payload
+	// inrids array (iOS/string)
+	RegionID *string `json:"rid,omitempty"`
+
+	// Internal use. Track raw data
+	raw json.RawMessage
+}
+
+func (w *otWaypoint) UnmarshalJSON(b []byte) error {
+	// alias the type to avoid recursing back in to this method
+	type waypoint otWaypoint
+	if err := json.Unmarshal(b, (*waypoint)(w)); err != nil {
+		return err
+	}
+	w.raw = append(json.RawMessage{}, b...)
+	return nil
+}
+
+// Timestamp returns the time the waypoint was created on the device
+func (w *otWaypoint) Timestamp() time.Time {
+	return time.Unix(int64(w.TimestampUnix), 0)
+}
+
+// otWaypoints is the full list of waypoints defined on a device, sent when
+// they are exported
+// https://owntracks.org/booklet/tech/json/#_typewaypoints
+type otWaypoints struct {
+	Waypoints []otWaypoint `json:"waypoints"`
+}
+
+func (o *owntracksMessage) AsCard() (otCard, error) {
+	if !o.IsCard() {
+		return otCard{}, fmt.Errorf("message type %s is not card", o.Type)
+	}
+	r := otCard{}
+	if err := json.Unmarshal(o.Data, &r); err != nil {
+		return otCard{}, err
+	}
+	return r, nil
+}
+
+// otCard describes the user of a device, for display to their friends
+// https://owntracks.org/booklet/tech/json/#_typecard
+type otCard struct {
+	// Name to identify a user (iOS,Android/string/optional)
+	Name *string `json:"name,omitempty"`
+	// Base64 encoded PNG image of the user (iOS,Android/string/optional)
+	Face *string `json:"face,omitempty"`
+	// Tracker ID of the user (iOS,Android/string/optional)
+	TrackerID *string `json:"tid,omitempty"`
+}
+
+func (o *owntracksMessage) AsEncrypted() (otEncrypted, error) {
+	if !o.IsEncrypted() {
+		return otEncrypted{}, fmt.Errorf("message type %s is not encrypted", o.Type)
+	}
+	r := otEncrypted{}
+	if err := json.Unmarshal(o.Data, &r); err != nil {
+		return otEncrypted{}, err
+	}
+	return r, nil
+}
+
+// otEncrypted wraps another message, encrypted with a secret shared with the
+// device
+// https://owntracks.org/booklet/tech/json/#_typeencrypted
+type otEncrypted struct {
+	// base64 encoded libsodium secretbox. The first 24 bytes are the nonce,
+	// the rest the ciphertext (iOS,Android/string/required)
+	Data string `json:"data"`
+}
+
+// Decrypt opens the payload with the devices shared secret, returning the
+// message it contains.
+func (e *otEncrypted) Decrypt(secret string) (owntracksMessage, error) {
+	b, err := base64.StdEncoding.DecodeString(e.Data)
+	if err != nil {
+		return owntracksMessage{}, fmt.Errorf("decoding data: %v", err)
+	}
+	if len(b) < 24+secretbox.Overhead {
+		return owntracksMessage{}, fmt.Errorf("data too short to be encrypted message")
+	}
+
+	// the apps use the secret as the key, zero padded or truncated to the key
+	// length
+	var key [32]byte
+	copy(key[:], secret)
+	var nonce [24]byte
+	copy(nonce[:], b[:24])
+
+	pt, ok := secretbox.Open(nil, b[24:], &nonce, &key)
+	if !ok {
+		return owntracksMessage{}, fmt.Errorf("decrypting message failed, is the secret correct?")
+	}
+
+	msg := owntracksMessage{}
+	if err := json.Unmarshal(pt, &msg); err != nil {
+		return owntracksMessage{}, fmt.Errorf("decoding decrypted message: %v", err)
+	}
+	return msg, nil
+}
+
+// encryptOTMessage wraps the raw message in an encrypted message, in the same
+// way the apps do.
+func encryptOTMessage(secret string, raw []byte) (json.RawMessage, error) {
+	var key [32]byte
+	copy(key[:], secret)
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, fmt.Errorf("generating nonce: %v", err)
+	}
+
+	box := secretbox.Seal(nonce[:], raw, &nonce, &key)
+
+	return json.Marshal(map[string]string{
+		"_type": "encrypted",
+		"data":  base64.StdEncoding.EncodeToString(box),
+	})
+}
@@ -27,3 +27,63 @@ func TestOTMessage(t *testing.T) {
 		t.Error("should be non-zero timestamp")
 	}
 }
+
+const egOwntracksTransition = `{"_type":"transition","wtst":1592000000,"lat":36.1627,"lon":86.7816,"tst":1592691400,"acc":10,"tid":"NE","event":"enter","desc":"Home","t":"c"}`
+
+func TestOTTransition(t *testing.T) {
+	om := owntracksMessage{}
+	if err := json.Unmarshal([]byte(egOwntracksTransition), &om); err != nil {
+		t.Fatal(err)
+	}
+
+	if om.IsLocation() {
+		t.Error("should not be location")
+	}
+	if !om.IsTransition() {
+		t.Error("should be transition")
+	}
+
+	tr, err := om.AsTransition()
+	if err != nil {
+		t.Fatalf("turning in to transition: %v", err)
+	}
+
+	if tr.Event != "enter" {
+		t.Errorf("want event enter, got: %s", tr.Event)
+	}
+	if tr.Timestamp().IsZero() || tr.WaypointTimestamp().IsZero() {
+		t.Error("should be non-zero timestamps")
+	}
+}
+
+func TestOTEncrypted(t *testing.T) {
+	enc, err := encryptOTMessage("s3cret", []byte(egOwntracksLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	om := owntracksMessage{}
+	if err := json.Unmarshal(enc, &om); err != nil {
+		t.Fatal(err)
+	}
+	if !om.IsEncrypted() {
+		t.Fatal("should be encrypted")
+	}
+
+	e, err := om.AsEncrypted()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Decrypt("wrong"); err == nil {
+		t.Error("decrypting with the wrong secret should fail")
+	}
+
+	dm, err := e.Decrypt("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dm.IsLocation() {
+		t.Errorf("decrypted message should be location, got: %s", dm.Type)
+	}
+}
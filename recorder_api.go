@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	geojson "github.com/paulmach/go.geojson"
+)
+
+// recorderAPIVersion is the OwnTracks Recorder version we present as
+const recorderAPIVersion = "0.9.9"
+
+type recorderStore interface {
+	Devices(ctx context.Context) ([]Device, error)
+	RecentLocations(ctx context.Context, from, to time.Time, filter LocationFilter) ([]DeviceLocation, error)
+	LatestLocations(ctx context.Context, filter LocationFilter) ([]DeviceLocation, error)
+}
+
+var _ recorderStore = (*Storage)(nil)
+
+// recorderAPI serves the read parts of the OwnTracks Recorder HTTP API, so the
+// OwnTracks frontend and other clients can be used with our data.
+//
+// https://github.com/owntracks/recorder/blob/master/API.md
+type recorderAPI struct {
+	log   logger
+	store recorderStore
+
+	mux *http.ServeMux
+}
+
+func newRecorderAPI(log logger, store recorderStore) *recorderAPI {
+	a := &recorderAPI{
+		log:   log,
+		store: store,
+		mux:   http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/api/0/version", a.version)
+	a.mux.HandleFunc("/api/0/list", a.list)
+	a.mux.HandleFunc("/api/0/locations", a.locations)
+	a.mux.HandleFunc("/api/0/last", a.last)
+	return a
+}
+
+func (a *recorderAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *recorderAPI) version(w http.ResponseWriter, r *http.Request) {
+	a.writeJSON(w, map[string]string{"version": recorderAPIVersion})
+}
+
+// list returns the users, or the devices for a user if one is requested
+func (a *recorderAPI) list(w http.ResponseWriter, r *http.Request) {
+	devs, err := a.store.Devices(r.Context())
+	if err != nil {
+		a.log.Printf("getting devices: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+
+	results := []string{}
+	for _, d := range devs {
+		if user == "" {
+			// devices are ordered by user, so only need to check the last
+			if len(results) == 0 || results[len(results)-1] != d.User {
+				results = append(results, d.User)
+			}
+		} else if d.User == user {
+			results = append(results, d.Name)
+		}
+	}
+
+	a.writeJSON(w, map[string]interface{}{"results": results})
+}
+
+func (a *recorderAPI) locations(w http.ResponseWriter, r *http.Request) {
+	var (
+		q      = r.URL.Query()
+		to     = time.Now()
+		from   = to.Add(-6 * time.Hour)
+		filter = LocationFilter{User: q.Get("user"), Device: q.Get("device")}
+	)
+
+	if q.Get("from") != "" {
+		f, err := parseRecorderTime(q.Get("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parsing from: %v", err), http.StatusBadRequest)
+			return
+		}
+		from = f
+	}
+	if q.Get("to") != "" {
+		t, err := parseRecorderTime(q.Get("to"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parsing to: %v", err), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	locs, err := a.store.RecentLocations(r.Context(), from, to, filter)
+	if err != nil {
+		a.log.Printf("getting locations: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch q.Get("format") {
+	case "", "json":
+		data := []recorderLocation{}
+		for _, l := range locs {
+			data = append(data, newRecorderLocation(l))
+		}
+		a.writeJSON(w, map[string]interface{}{
+			"count":  len(data),
+			"data":   data,
+			"status": http.StatusOK,
+		})
+	case "geojson":
+		fc := geojson.NewFeatureCollection()
+		for _, l := range locs {
+			rl := newRecorderLocation(l)
+			props := map[string]interface{}{}
+			// re-use the json representation, so the properties match
+			b, err := json.Marshal(rl)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := json.Unmarshal(b, &props); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fc.AddFeature(&geojson.Feature{
+				Geometry:   geojson.NewPointGeometry([]float64{l.Lng, l.Lat}),
+				Properties: props,
+			})
+		}
+		a.writeJSON(w, fc)
+	default:
+		http.Error(w, "format must be json or geojson", http.StatusBadRequest)
+	}
+}
+
+// last returns the latest location of each device
+func (a *recorderAPI) last(w http.ResponseWriter, r *http.Request) {
+	locs, err := a.store.LatestLocations(r.Context(), LocationFilter{User: r.URL.Query().Get("user"), Device: r.URL.Query().Get("device")})
+	if err != nil {
+		a.log.Printf("getting latest locations: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ret := []recorderLocation{}
+	for _, l := range locs {
+		rl := newRecorderLocation(l)
+		rl.Username = l.User
+		rl.Device = l.Device
+		rl.Topic = fmt.Sprintf("owntracks/%s/%s", l.User, l.Device)
+		ret = append(ret, rl)
+	}
+
+	a.writeJSON(w, ret)
+}
+
+func (a *recorderAPI) writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		a.log.Printf("marshaling response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// recorderLocation is a location in the form the recorder returns it, which is
+// an OwnTracks location message with some extra fields.
+type recorderLocation struct {
+	Type             string  `json:"_type"`
+	Latitude         float64 `json:"lat"`
+	Longitude        float64 `json:"lon"`
+	TimestampUnix    int64   `json:"tst"`
+	Accuracy         int     `json:"acc"`
+	Altitude         *int    `json:"alt,omitempty"`
+	Batt             *int    `json:"batt,omitempty"`
+	CourseOverGround *int    `json:"cog,omitempty"`
+	Velocity         *int    `json:"vel,omitempty"`
+	TrackerID        *string `json:"tid,omitempty"`
+	// ISO 8601 timestamp, in UTC
+	ISOTimestamp string `json:"isotst"`
+	// Display timestamp
+	DisplayTimestamp string `json:"disptst"`
+
+	// only set for last
+	Username string `json:"username,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+func newRecorderLocation(l DeviceLocation) recorderLocation {
+	return recorderLocation{
+		Type:             "location",
+		Latitude:         l.Lat,
+		Longitude:        l.Lng,
+		TimestampUnix:    l.Timestamp.Unix(),
+		Accuracy:         l.Accuracy,
+		Altitude:         l.Altitude,
+		Batt:             l.Batt,
+		CourseOverGround: l.CourseOverGround,
+		Velocity:         l.Velocity,
+		TrackerID:        l.TrackerID,
+		ISOTimestamp:     l.Timestamp.UTC().Format(time.RFC3339),
+		DisplayTimestamp: l.Timestamp.UTC().Format("2006-01-02 15:04:05"),
+	}
+}
+
+// parseRecorderTime parses the time formats the recorder accepts for from and
+// to, which is ISO 8601 with optional parts. Times without a zone are UTC.
+func parseRecorderTime(s string) (time.Time, error) {
+	for _, layout := range []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not in a supported format (e.g 2006-01-02T15:04:05)", s)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecorderAPI(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	base := time.Date(2020, 6, 20, 10, 0, 0, 0, time.UTC)
+	acc := 10
+
+	for i, topic := range []string{"owntracks/jane/phone", "owntracks/jane/phone", "owntracks/jane/ipad", "owntracks/bob/pixel"} {
+		jb, err := json.Marshal(otLocation{
+			TimestampUnix: int(base.Add(time.Duration(i) * time.Minute).Unix()),
+			Latitude:      float64(i),
+			Accuracy:      &acc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddOTLocation(ctx, owntracksMessage{Type: "location", Data: jb, Topic: topic}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := newRecorderAPI(log.New(os.Stderr, "", log.LstdFlags), s)
+
+	get := func(path string, into interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: want status 200, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), into); err != nil {
+			t.Fatalf("GET %s: decoding %s: %v", path, rec.Body.String(), err)
+		}
+	}
+
+	var version map[string]string
+	get("/api/0/version", &version)
+	if version["version"] == "" {
+		t.Error("want a version")
+	}
+
+	var list struct {
+		Results []string `json:"results"`
+	}
+	get("/api/0/list", &list)
+	if len(list.Results) != 2 || list.Results[0] != "bob" || list.Results[1] != "jane" {
+		t.Errorf("want users bob and jane, got: %v", list.Results)
+	}
+	get("/api/0/list?user=jane", &list)
+	if len(list.Results) != 2 || list.Results[0] != "ipad" || list.Results[1] != "phone" {
+		t.Errorf("want jane's devices ipad and phone, got: %v", list.Results)
+	}
+
+	var locs struct {
+		Count int                `json:"count"`
+		Data  []recorderLocation `json:"data"`
+	}
+	get("/api/0/locations?user=jane&device=phone&from=2020-06-20T09:00:00&to=2020-06-20T11:00:00", &locs)
+	if locs.Count != 2 || len(locs.Data) != 2 {
+		t.Errorf("want 2 locations for jane's phone, got: %d", locs.Count)
+	}
+	get("/api/0/locations?from=2020-06-21", &locs)
+	if locs.Count != 0 {
+		t.Errorf("want no locations after the range, got: %d", locs.Count)
+	}
+
+	var fc struct {
+		Type     string            `json:"type"`
+		Features []json.RawMessage `json:"features"`
+	}
+	get("/api/0/locations?user=jane&from=2020-06-20&format=geojson", &fc)
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 3 {
+		t.Errorf("want a feature collection with 3 features, got type %s with %d", fc.Type, len(fc.Features))
+	}
+
+	var last []recorderLocation
+	get("/api/0/last", &last)
+	if len(last) != 3 {
+		t.Fatalf("want last location for 3 devices, got: %d", len(last))
+	}
+	for _, l := range last {
+		if l.Username == "jane" && l.Device == "phone" && l.Latitude != 1 {
+			t.Errorf("want jane's phone latest location lat 1, got: %f", l.Latitude)
+		}
+		if l.Topic != "owntracks/"+l.Username+"/"+l.Device {
+			t.Errorf("want topic for %s/%s, got: %s", l.Username, l.Device, l.Topic)
+		}
+	}
+}
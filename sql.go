@@ -307,6 +307,512 @@ var migrations = []migration{
 			create index checkins_checkin_time_idx on checkins(checkin_time);
 		`,
 	},
+	{
+		Idx: 202610171000,
+		SQL: `
+		create table region_transitions (
+			id text primary key,
+			event text, -- enter or leave
+			description text, -- name of the region
+			region_id text, -- OwnTracks rid, if the device sent one
+			waypoint_timestamp datetime, -- creation time of the region, OwnTracks uses this to identify it
+			lat float,
+			lng float,
+			accuracy integer, -- metres
+			trigger text, -- c for circular region, b for beacon, l for location
+			tracker_id text,
+			topic string,
+			timestamp datetime, -- when the transition happened
+			raw_owntracks_message text,
+			created_at datetime default (datetime('now'))
+		);
+
+		create index region_transitions_timestamp_idx on region_transitions(timestamp);
+		`,
+	},
+	{
+		Idx: 202610171100,
+		SQL: `
+		-- regions monitored by devices, synced from OwnTracks waypoints
+		create table regions (
+			id text primary key,
+			name text,
+			lat float,
+			lng float,
+			radius integer, -- metres
+			region_id text, -- OwnTracks rid, if the device sent one
+			topic string not null, -- device the region is defined on
+			timestamp datetime not null, -- creation time of the region on the device
+			raw_owntracks_message text,
+			created_at datetime default (datetime('now')),
+			unique(topic, timestamp) -- OwnTracks identifies a devices region by its creation time
+		);
+		`,
+	},
+	{
+		Idx: 202610171200,
+		SQL: `
+		-- OwnTracks user cards, latest per device
+		create table cards (
+			id text primary key,
+			topic string unique not null,
+			name text,
+			tracker_id text,
+			raw_owntracks_message text,
+			created_at datetime default (datetime('now')),
+			updated_at datetime default (datetime('now'))
+		);
+
+		create index device_locations_topic_timestamp_idx on device_locations(topic, timestamp);
+		`,
+	},
+	{
+		Idx: 202610171300,
+		SQL: `
+		create table users (
+			id text primary key,
+			username text unique not null,
+			created_at datetime default (datetime('now'))
+		);
+
+		create table devices (
+			id text primary key,
+			user_id text not null,
+			name text not null,
+			created_at datetime default (datetime('now')),
+			unique(user_id, name),
+			foreign key(user_id) references users(id)
+		);
+
+		alter table device_locations add device_id text references devices(id);
+
+		create index device_locations_device_id_timestamp_idx on device_locations(device_id, timestamp);
+		`,
+		AfterFunc: func(ctx context.Context, tx *sql.Tx) error {
+			// attribute existing locations to devices, based on the topic they
+			// were published to (<base>/<user>/<device>)
+			rows, err := tx.QueryContext(ctx,
+				`select distinct topic from device_locations where topic is not null`)
+			if err != nil {
+				return fmt.Errorf("getting topics: %v", err)
+			}
+			var topics []string
+			for rows.Next() {
+				var topic string
+				if err := rows.Scan(&topic); err != nil {
+					rows.Close()
+					return fmt.Errorf("scanning row: %v", err)
+				}
+				topics = append(topics, topic)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("rows err: %v", err)
+			}
+
+			for _, topic := range topics {
+				parts := strings.Split(topic, "/")
+				if len(parts) < 3 {
+					continue
+				}
+				username, devname := parts[len(parts)-2], parts[len(parts)-1]
+
+				if _, err := tx.ExecContext(ctx,
+					`insert into users(id, username) values ($1, $2) on conflict(username) do nothing`,
+					uuid.New().String(), username); err != nil {
+					return fmt.Errorf("inserting user %s: %v", username, err)
+				}
+				if _, err := tx.ExecContext(ctx,
+					`insert into devices(id, user_id, name) select $1, id, $2 from users where username = $3 on conflict(user_id, name) do nothing`,
+					uuid.New().String(), devname, username); err != nil {
+					return fmt.Errorf("inserting device %s/%s: %v", username, devname, err)
+				}
+				if _, err := tx.ExecContext(ctx,
+					`update device_locations set device_id = (
+						select d.id from devices d join users u on (d.user_id = u.id) where u.username = $1 and d.name = $2
+					) where topic = $3`,
+					username, devname, topic); err != nil {
+					return fmt.Errorf("attributing locations for %s: %v", topic, err)
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Idx: 202610171400,
+		SQL: `
+		-- credentials devices can authenticate with when publishing
+		create table device_credentials (
+			id text primary key,
+			device_id text unique not null,
+			username text unique not null,
+			password_hash text not null, -- bcrypt
+			created_at datetime default (datetime('now')),
+			rotated_at datetime,
+			revoked_at datetime,
+			foreign key(device_id) references devices(id)
+		);
+		`,
+	},
+	{
+		Idx: 202610171500,
+		SQL: `
+		alter table device_locations add source text; -- where the location came from, e.g owntracks, google_takeout, overland
+		alter table device_locations add raw_source text; -- raw data, for sources without their own raw column
+
+		update device_locations set source = 'owntracks' where raw_owntracks_message is not null;
+		update device_locations set source = 'google_takeout' where raw_google_location is not null;
+		`,
+	},
+	{
+		Idx: 202610171600,
+		SQL: `
+		-- remove duplicated locations, e.g from retried publishes or re-imports,
+		-- keeping the first copy
+		delete from device_locations where rowid not in (
+			select min(rowid) from device_locations
+			group by ifnull(source, ''), ifnull(device_id, ''), strftime('%s', timestamp), lat, lng
+		);
+
+		-- timestamps are compared as unix time, so the same time stored with a
+		-- different zone is still a duplicate
+		create unique index device_locations_unique_idx on device_locations(ifnull(source, ''), ifnull(device_id, ''), strftime('%s', timestamp), lat, lng);
+		`,
+	},
+	{
+		Idx: 202610171700,
+		SQL: `
+		-- time spent at a place, e.g from google semantic location history
+		create table visits (
+			id text primary key,
+			source text not null, -- where the visit came from, e.g google_semantic
+			place_id text, -- the source's ID for the place
+			name text,
+			address text,
+			semantic_type text, -- e.g home, work
+			lat float not null,
+			lng float not null,
+			start_time datetime not null,
+			end_time datetime not null,
+			device_id text references devices(id),
+			raw text, -- the source's data for the visit, as imported
+			created_at datetime default (datetime('now')),
+			unique(source, start_time, end_time)
+		);
+		create index visits_start_time_idx on visits(start_time);
+
+		-- travel between places, e.g from google semantic location history
+		create table activity_segments (
+			id text primary key,
+			source text not null,
+			activity_type text, -- mode of transport, e.g walking, in_bus
+			distance integer, -- metres
+			start_lat float,
+			start_lng float,
+			end_lat float,
+			end_lng float,
+			start_time datetime not null,
+			end_time datetime not null,
+			waypoints text, -- json array of [lng, lat] points along the way
+			device_id text references devices(id),
+			raw text,
+			created_at datetime default (datetime('now')),
+			unique(source, start_time, end_time)
+		);
+		create index activity_segments_start_time_idx on activity_segments(start_time);
+		`,
+	},
+	{
+		Idx: 202610171800,
+		SQL: `
+		-- give locations an id other tables can reference. The rowid isn't
+		-- stable across a vacuum unless it's declared, so keep the existing
+		-- rowids as the ids.
+		create table device_locations_new (
+			id integer primary key,
+			accuracy integer, -- metres
+			altitude integer, -- metres
+			batt integer,
+			battery_status integer,
+			course_over_ground integer, -- degrees, direction heading
+			lat float,
+			lng float,
+			region_radius float, --metres
+			trigger text,
+			tracker_id text,
+			timestamp datetime,
+			vertical_accuracy integer, -- metres
+			velocity integer, -- kmh
+			barometric_pressure float64,
+			connection_status string,
+			topic string,
+			in_regions string, -- json array of regions
+			raw_owntracks_message text, -- If this is owntracks, the raw json submitted
+			raw_google_location text, -- If this is google location imported, raw json
+			created_at datetime default (datetime('now')),
+			device_id text references devices(id),
+			source text, -- where the location came from, e.g owntracks, google_takeout, overland
+			raw_source text -- raw data, for sources without their own raw column
+		);
+
+		insert into device_locations_new(id, accuracy, altitude, batt, battery_status, course_over_ground,
+			lat, lng, region_radius, trigger, tracker_id, timestamp, vertical_accuracy, velocity,
+			barometric_pressure, connection_status, topic, in_regions, raw_owntracks_message,
+			raw_google_location, created_at, device_id, source, raw_source)
+		select rowid, accuracy, altitude, batt, battery_status, course_over_ground,
+			lat, lng, region_radius, trigger, tracker_id, timestamp, vertical_accuracy, velocity,
+			barometric_pressure, connection_status, topic, in_regions, raw_owntracks_message,
+			raw_google_location, created_at, device_id, source, raw_source
+			from device_locations;
+
+		drop table device_locations;
+		alter table device_locations_new rename to device_locations;
+
+		create index device_locations_timestamp_idx on device_locations(timestamp);
+		create index device_locations_topic_timestamp_idx on device_locations(topic, timestamp);
+		create index device_locations_device_id_timestamp_idx on device_locations(device_id, timestamp);
+		create unique index device_locations_unique_idx on device_locations(ifnull(source, ''), ifnull(device_id, ''), strftime('%s', timestamp), lat, lng);
+
+		-- what the device thought it was doing at a location, e.g walking or
+		-- in a vehicle. A location can have several classifications, each with
+		-- several candidate activities.
+		create table location_activities (
+			location_id integer not null references device_locations(id) on delete cascade,
+			timestamp datetime, -- when the classification was made
+			type text not null, -- e.g WALKING, IN_VEHICLE, STILL
+			confidence integer not null, -- percent
+			unique(location_id, timestamp, type)
+		);
+		create index location_activities_type_idx on location_activities(type);
+		`,
+	},
+	{
+		Idx: 202610171900,
+		SQL: `
+		-- named points of interest, e.g GPX waypoints
+		create table places (
+			id text primary key,
+			source text not null, -- where the place came from, e.g gpx
+			name text,
+			description text,
+			lat float not null,
+			lng float not null,
+			elevation integer, -- metres
+			timestamp datetime, -- when the place was recorded, if known
+			device_id text references devices(id),
+			raw text, -- the source's data for the place, as imported
+			created_at datetime default (datetime('now'))
+		);
+		create unique index places_unique_idx on places(source, ifnull(device_id, ''), lat, lng, ifnull(name, ''));
+		`,
+	},
+	{
+		Idx: 202610172000,
+		SQL: `
+		-- trips imported from a TripIt iCalendar feed are identified by the
+		-- event UID, rather than a TripIt API id
+		alter table trips add ical_uid text;
+		alter table trips add ical_raw text;
+		create unique index trips_ical_uid_idx on trips(ical_uid);
+
+		-- the parts of a trip, e.g flights and hotel stays
+		create table trip_segments (
+			id text primary key,
+			trip_id text references trips(id),
+			ical_uid text unique not null,
+			type text not null, -- flight, lodging, rail or other
+			summary text,
+			description text,
+			location text,
+			lat float,
+			lng float,
+			start_time datetime,
+			end_time datetime,
+			ical_raw text,
+			created_at datetime default (datetime('now'))
+		);
+		create index trip_segments_start_time_idx on trip_segments(start_time);
+		`,
+	},
+	{
+		Idx: 202610172100,
+		SQL: `
+		-- photos imported for their location. The location is stored in
+		-- device_locations, this records which file it came from. Photos are
+		-- identified by their contents, so moved files aren't imported twice.
+		create table photos (
+			id text primary key,
+			sha256 text unique not null,
+			path text not null,
+			location_id integer references device_locations(id) on delete cascade,
+			taken_at datetime not null,
+			created_at datetime default (datetime('now'))
+		);
+		create index photos_taken_at_idx on photos(taken_at);
+		`,
+	},
+	{
+		Idx: 202610172200,
+		SQL: `
+		-- a run of one of the import commands. Rows it created reference it,
+		-- so a bad import can be found and rolled back.
+		create table imports (
+			id text primary key,
+			source text not null,
+			path text, -- file or directory imported from, if any
+			sha256 text, -- of the file, if a single file was imported
+			started_at datetime not null,
+			finished_at datetime,
+			error text, -- set if the import failed part way
+			row_count integer not null default 0,
+			rolled_back_at datetime,
+			created_at datetime default (datetime('now'))
+		);
+
+		alter table device_locations add import_id text references imports(id);
+		create index device_locations_import_id_idx on device_locations(import_id);
+		alter table places add import_id text references imports(id);
+		create index places_import_id_idx on places(import_id);
+		alter table visits add import_id text references imports(id);
+		create index visits_import_id_idx on visits(import_id);
+		alter table activity_segments add import_id text references imports(id);
+		create index activity_segments_import_id_idx on activity_segments(import_id);
+		alter table checkins add import_id text references imports(id);
+		create index checkins_import_id_idx on checkins(import_id);
+		alter table trips add import_id text references imports(id);
+		create index trips_import_id_idx on trips(import_id);
+		alter table trip_segments add import_id text references imports(id);
+		create index trip_segments_import_id_idx on trip_segments(import_id);
+		alter table photos add import_id text references imports(id);
+		create index photos_import_id_idx on photos(import_id);
+		`,
+	},
+	{
+		Idx: 202610172300,
+		SQL: `
+		-- users whose devices can see the user's devices as OwnTracks friends.
+		-- A user's own devices can always see each other.
+		create table location_shares (
+			user_id text not null references users(id),
+			with_user_id text not null references users(id),
+			created_at datetime default (datetime('now')),
+			primary key(user_id, with_user_id)
+		);
+		`,
+	},
+	{
+		Idx: 202610172310,
+		SQL: `
+		-- visits and activity segments are unique per device, so people
+		-- importing the same kind of history don't overwrite each other's.
+		-- The unique constraint can't be changed in place, so rebuild the
+		-- tables with it as an index.
+		create table visits_new (
+			id text primary key,
+			source text not null, -- where the visit came from, e.g google_semantic
+			place_id text, -- the source's ID for the place
+			name text,
+			address text,
+			semantic_type text, -- e.g home, work
+			lat float not null,
+			lng float not null,
+			start_time datetime not null,
+			end_time datetime not null,
+			device_id text references devices(id),
+			raw text, -- the source's data for the visit, as imported
+			created_at datetime default (datetime('now')),
+			import_id text references imports(id)
+		);
+		insert into visits_new(id, source, place_id, name, address, semantic_type, lat, lng, start_time, end_time, device_id, raw, created_at, import_id)
+			select id, source, place_id, name, address, semantic_type, lat, lng, start_time, end_time, device_id, raw, created_at, import_id from visits;
+		drop table visits;
+		alter table visits_new rename to visits;
+		create unique index visits_unique_idx on visits(source, ifnull(device_id, ''), start_time, end_time);
+		create index visits_start_time_idx on visits(start_time);
+		create index visits_import_id_idx on visits(import_id);
+
+		create table activity_segments_new (
+			id text primary key,
+			source text not null,
+			activity_type text, -- mode of transport, e.g walking, in_bus
+			distance integer, -- metres
+			start_lat float,
+			start_lng float,
+			end_lat float,
+			end_lng float,
+			start_time datetime not null,
+			end_time datetime not null,
+			waypoints text, -- json array of [lng, lat] points along the way
+			device_id text references devices(id),
+			raw text,
+			created_at datetime default (datetime('now')),
+			import_id text references imports(id)
+		);
+		insert into activity_segments_new(id, source, activity_type, distance, start_lat, start_lng, end_lat, end_lng, start_time, end_time, waypoints, device_id, raw, created_at, import_id)
+			select id, source, activity_type, distance, start_lat, start_lng, end_lat, end_lng, start_time, end_time, waypoints, device_id, raw, created_at, import_id from activity_segments;
+		drop table activity_segments;
+		alter table activity_segments_new rename to activity_segments;
+		create unique index activity_segments_unique_idx on activity_segments(source, ifnull(device_id, ''), start_time, end_time);
+		create index activity_segments_start_time_idx on activity_segments(start_time);
+		create index activity_segments_import_id_idx on activity_segments(import_id);
+		`,
+	},
+	{
+		Idx: 202610172320,
+		SQL: `
+		-- sources like KML can have many places, or journeys, over the same
+		-- time span. e.g My Maps placemarks with a date only span.
+		drop index visits_unique_idx;
+		create unique index visits_unique_idx on visits(source, ifnull(device_id, ''), start_time, end_time, lat, lng);
+		drop index activity_segments_unique_idx;
+		create unique index activity_segments_unique_idx on activity_segments(source, ifnull(device_id, ''), start_time, end_time,
+			ifnull(start_lat, ''), ifnull(start_lng, ''), ifnull(end_lat, ''), ifnull(end_lng, ''));
+		`,
+	},
+	{
+		Idx: 202610172330,
+		SQL: `
+		-- only active credentials are unique, so a device can get a new one
+		-- after its credential is revoked
+		create table device_credentials_new (
+			id text primary key,
+			device_id text not null,
+			username text not null,
+			password_hash text not null, -- bcrypt
+			created_at datetime default (datetime('now')),
+			rotated_at datetime,
+			revoked_at datetime,
+			foreign key(device_id) references devices(id)
+		);
+		insert into device_credentials_new(id, device_id, username, password_hash, created_at, rotated_at, revoked_at)
+			select id, device_id, username, password_hash, created_at, rotated_at, revoked_at from device_credentials;
+		drop table device_credentials;
+		alter table device_credentials_new rename to device_credentials;
+		create unique index device_credentials_device_id_idx on device_credentials(device_id) where revoked_at is null;
+		create unique index device_credentials_username_idx on device_credentials(username) where revoked_at is null;
+		`,
+	},
+	{
+		Idx: 202610172340,
+		SQL: `
+		-- locations are compared by their stored timestamp, so store them all
+		-- in UTC rather than the zone they were recorded in. The unique index
+		-- is on the unix time, so this can't make duplicates.
+		update device_locations
+			set timestamp = case when strftime('%f', timestamp) like '%.000'
+				then strftime('%Y-%m-%d %H:%M:%S', timestamp)
+				else strftime('%Y-%m-%d %H:%M:%f', timestamp)
+			end || '+00:00'
+			where timestamp not like '%+00:00';
+		update photos
+			set taken_at = case when strftime('%f', taken_at) like '%.000'
+				then strftime('%Y-%m-%d %H:%M:%S', taken_at)
+				else strftime('%Y-%m-%d %H:%M:%f', taken_at)
+			end || '+00:00'
+			where taken_at not like '%+00:00';
+		`,
+	},
 }
 
 type Storage struct {
@@ -40,6 +40,25 @@ where fsq_id=$9`,
 	return checkin.ID, nil
 }
 
+// Add4sqExportCheckin stores a checkin from a foursquare data export. Exports
+// have less detail than the API, so a checkin that is already stored is left
+// as it is. Returns false if the checkin was already stored.
+func (s *Storage) Add4sqExportCheckin(ctx context.Context, checkin fsqCheckin) (bool, error) {
+	if checkin.ID == "" {
+		return false, fmt.Errorf("checkin has no foursquare ID")
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+insert into checkins(id, fsq_id, fsq_raw, checkin_time, checkin_time_offset, import_id) values ($1, $2, $3, $4, $5, $6)
+on conflict(fsq_id) do nothing`,
+		newDBID(), checkin.ID, checkin.raw, time.Unix(int64(checkin.CreatedAt), 0), checkin.TimeZoneOffset, ctxImportID(ctx))
+	if err != nil {
+		return false, fmt.Errorf("inserting checkin %s: %v", checkin.ID, err)
+	}
+
+	return rowInserted(res)
+}
+
 // Sync4sqUsers finds all foursquare checkins in the DB, and ensures there are
 // up-to-date user entries for them. Also denormalizes the checkin with
 // information in to the database record.
@@ -139,6 +158,10 @@ func (s *Storage) Sync4sqVenues(ctx context.Context) error {
 		}
 
 		fv := fsq.Venue
+		if fv.ID == "" {
+			// e.g a shout, not at a venue
+			continue
+		}
 		var cgry fsqCategories
 		for _, c := range fv.Categories {
 			if c.Primary {
@@ -157,12 +180,25 @@ func (s *Storage) Sync4sqVenues(ctx context.Context) error {
 			venueID = newDBID()
 		}
 
+		// checkins from a data export only have some of the venue's details,
+		// so only update what this checkin has. Their coordinates are where
+		// the checkin was rather than the venue's, and they have no country,
+		// so they only fill in a venue without a location.
 		_, err := s.db.ExecContext(ctx, `
 				insert into venues(id, fsq_id, name, lat, lng, category, street_address, city, state, postal_code, country, country_code) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-				on conflict(fsq_id) do update set name = ?, lat = ?, lng = ?, category = ?, street_address = ?, city = ?, state = ?, postal_code = ?, country = ?, country_code = ?
+				on conflict(fsq_id) do update set
+				  name = coalesce(nullif(excluded.name, ''), name),
+				  lat = case when (excluded.lat = 0 and excluded.lng = 0) or (excluded.country_code = '' and ifnull(lat, 0) != 0) then lat else excluded.lat end,
+				  lng = case when (excluded.lat = 0 and excluded.lng = 0) or (excluded.country_code = '' and ifnull(lng, 0) != 0) then lng else excluded.lng end,
+				  category = coalesce(nullif(excluded.category, ''), category),
+				  street_address = coalesce(nullif(excluded.street_address, ''), street_address),
+				  city = coalesce(nullif(excluded.city, ''), city),
+				  state = coalesce(nullif(excluded.state, ''), state),
+				  postal_code = coalesce(nullif(excluded.postal_code, ''), postal_code),
+				  country = coalesce(nullif(excluded.country, ''), country),
+				  country_code = coalesce(nullif(excluded.country_code, ''), country_code)
 				where fsq_id=?`,
 			venueID, fv.ID, fv.Name, fv.Location.Lat, fv.Location.Lng, cgry.Name, fv.Location.Address, fv.Location.City, fv.Location.State, fv.Location.PostalCode, fv.Location.Country, fv.Location.Cc,
-			fv.Name, fv.Location.Lat, fv.Location.Lng, cgry.Name, fv.Location.Address, fv.Location.City, fv.Location.State, fv.Location.PostalCode, fv.Location.Country, fv.Location.Cc,
 			fv.ID,
 		)
 		if err != nil {
@@ -209,16 +245,18 @@ type Checkin struct {
 	With      []string
 }
 
-func (s *Storage) GetCheckins(ctx context.Context, from, to time.Time) ([]Checkin, error) {
+func (s *Storage) GetCheckins(ctx context.Context, from, to time.Time, filter ImportFilter) ([]Checkin, error) {
 	rows, err := s.db.QueryContext(ctx,
 		`select c.checkin_time, v.name, v.lng, v.lat, group_concat(p.name, ';') from checkins c
 left outer join checkin_people cp on (c.id = cp.checkin_id)
 left outer join people p on (cp.person_id = p.id)
 join venues v on (c.venue_id = v.id)
 where c.checkin_time > ? and c.checkin_time < ?
+  and (? = '' or c.import_id = ?)
+  and (? = '' or ifnull(c.import_id, '') != ?)
 group by c.id
 order by c.checkin_time asc;
-`, from, to)
+`, from, to, filter.Import, filter.Import, filter.HideImport, filter.HideImport)
 	if err != nil {
 		return nil, fmt.Errorf("getting locations: %v", err)
 	}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DeviceCredential is a username/password a device publishes locations with.
+// The password is only available when it is created or rotated.
+type DeviceCredential struct {
+	Username  string
+	User      string
+	Device    string
+	CreatedAt time.Time
+	RotatedAt *time.Time
+	RevokedAt *time.Time
+}
+
+// CreateDeviceCredential creates a credential for the user's device, creating
+// the device if needed. A device can only have one active credential, but can
+// get a new one once it's revoked. The username and generated password are
+// returned.
+func (s *Storage) CreateDeviceCredential(ctx context.Context, username, device string) (credUsername, password string, _ error) {
+	password, hash, err := newDevicePassword()
+	if err != nil {
+		return "", "", err
+	}
+	credUsername = username + "/" + device
+
+	err = s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		deviceID, err := ensureDevice(ctx, tx, username, device)
+		if err != nil {
+			return err
+		}
+
+		var existing string
+		err = tx.QueryRowContext(ctx, `select username from device_credentials where device_id = ? and revoked_at is null`, deviceID).Scan(&existing)
+		if err == nil {
+			return fmt.Errorf("device %s already has credential %s, rotate it instead", credUsername, existing)
+		}
+		if err != sql.ErrNoRows {
+			return fmt.Errorf("checking for existing credential: %v", err)
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			`insert into device_credentials(id, device_id, username, password_hash) values (?, ?, ?, ?)`,
+			newDBID(), deviceID, credUsername, hash); err != nil {
+			return fmt.Errorf("inserting credential: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return credUsername, password, nil
+}
+
+// RotateDeviceCredential generates a new password for the credential,
+// returning it. Revoked credentials can't be rotated, a new one needs to be
+// created for the device instead.
+func (s *Storage) RotateDeviceCredential(ctx context.Context, credUsername string) (string, error) {
+	password, hash, err := newDevicePassword()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		`update device_credentials set password_hash = ?, rotated_at = datetime('now') where username = ? and revoked_at is null`,
+		hash, credUsername)
+	if err != nil {
+		return "", fmt.Errorf("updating credential: %v", err)
+	}
+	if ra, err := res.RowsAffected(); err != nil {
+		return "", fmt.Errorf("checking rows affected: %v", err)
+	} else if ra != 1 {
+		return "", fmt.Errorf("active credential %s not found", credUsername)
+	}
+
+	return password, nil
+}
+
+// RevokeDeviceCredential stops the credential from being used to authenticate
+func (s *Storage) RevokeDeviceCredential(ctx context.Context, credUsername string) error {
+	res, err := s.db.ExecContext(ctx,
+		`update device_credentials set revoked_at = datetime('now') where username = ? and revoked_at is null`,
+		credUsername)
+	if err != nil {
+		return fmt.Errorf("revoking credential: %v", err)
+	}
+	if ra, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("checking rows affected: %v", err)
+	} else if ra != 1 {
+		return fmt.Errorf("active credential %s not found", credUsername)
+	}
+	return nil
+}
+
+// ListDeviceCredentials returns all credentials, including revoked ones
+func (s *Storage) ListDeviceCredentials(ctx context.Context) ([]DeviceCredential, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`select c.username, u.username, d.name, c.created_at, c.rotated_at, c.revoked_at from device_credentials c
+join devices d on (c.device_id = d.id)
+join users u on (d.user_id = u.id)
+order by c.username`)
+	if err != nil {
+		return nil, fmt.Errorf("getting credentials: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []DeviceCredential{}
+
+	for rows.Next() {
+		var c DeviceCredential
+		if err := rows.Scan(&c.Username, &c.User, &c.Device, &c.CreatedAt, &c.RotatedAt, &c.RevokedAt); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		ret = append(ret, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
+
+// AuthenticateDevice checks the username and password against the active
+// credentials, returning the device they belong to. If they don't match, nil
+// is returned.
+func (s *Storage) AuthenticateDevice(ctx context.Context, credUsername, password string) (*Device, error) {
+	var (
+		d    Device
+		hash string
+	)
+	err := s.db.QueryRowContext(ctx,
+		`select d.id, u.username, d.name, c.password_hash from device_credentials c
+join devices d on (c.device_id = d.id)
+join users u on (d.user_id = u.id)
+where c.username = ? and c.revoked_at is null`, credUsername).Scan(&d.ID, &d.User, &d.Name, &hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding credential: %v", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, nil
+	}
+
+	return &d, nil
+}
+
+// newDevicePassword generates a random password, returning it and its hash
+func newDevicePassword() (password, hash string, _ error) {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", "", fmt.Errorf("generating password: %v", err)
+	}
+	password = base64.RawURLEncoding.EncodeToString(b)
+
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", fmt.Errorf("hashing password: %v", err)
+	}
+
+	return password, string(h), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestDeviceCredentials(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	u, p, err := s.CreateDeviceCredential(ctx, "jane", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.CreateDeviceCredential(ctx, "jane", "phone"); err == nil {
+		t.Error("creating a second credential for a device should fail")
+	}
+
+	d, err := s.AuthenticateDevice(ctx, u, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.User != "jane" || d.Name != "phone" {
+		t.Fatalf("want authenticated as jane/phone, got: %#v", d)
+	}
+
+	if d, err := s.AuthenticateDevice(ctx, u, "wrong"); err != nil || d != nil {
+		t.Errorf("want wrong password rejected, got device %#v err %v", d, err)
+	}
+
+	np, err := s.RotateDeviceCredential(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := s.AuthenticateDevice(ctx, u, p); err != nil || d != nil {
+		t.Errorf("want old password rejected after rotation, got device %#v err %v", d, err)
+	}
+	if d, err := s.AuthenticateDevice(ctx, u, np); err != nil || d == nil {
+		t.Errorf("want new password accepted after rotation, got device %#v err %v", d, err)
+	}
+
+	if err := s.RevokeDeviceCredential(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := s.AuthenticateDevice(ctx, u, np); err != nil || d != nil {
+		t.Errorf("want revoked credential rejected, got device %#v err %v", d, err)
+	}
+	if err := s.RevokeDeviceCredential(ctx, u); err == nil {
+		t.Error("revoking an already revoked credential should fail")
+	}
+	if _, err := s.RotateDeviceCredential(ctx, u); err == nil {
+		t.Error("rotating a revoked credential should fail")
+	}
+	if d, err := s.AuthenticateDevice(ctx, u, np); err != nil || d != nil {
+		t.Errorf("want revoked credential still rejected after trying to rotate it, got device %#v err %v", d, err)
+	}
+
+	nu, nup, err := s.CreateDeviceCredential(ctx, "jane", "phone")
+	if err != nil {
+		t.Fatalf("creating a credential after revoking: %v", err)
+	}
+	if d, err := s.AuthenticateDevice(ctx, nu, nup); err != nil || d == nil || d.User != "jane" || d.Name != "phone" {
+		t.Errorf("want new credential accepted after revoking, got device %#v err %v", d, err)
+	}
+	if d, err := s.AuthenticateDevice(ctx, u, np); err != nil || d != nil {
+		t.Errorf("want revoked password still rejected, got device %#v err %v", d, err)
+	}
+
+	creds, err := s.ListDeviceCredentials(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revoked, active int
+	for _, c := range creds {
+		if c.RevokedAt != nil {
+			revoked++
+		} else {
+			active++
+		}
+	}
+	if revoked != 1 || active != 1 {
+		t.Errorf("want one revoked and one active credential, got: %#v", creds)
+	}
+}
@@ -5,27 +5,100 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"strconv"
+	"math"
 	"time"
 )
 
 var _ owntracksStore = (*Storage)(nil)
 
+// Sources device locations can come from, stored in the source column
+const (
+	sourceOwnTracks      = "owntracks"
+	sourceGoogleTakeout  = "google_takeout"
+	sourceGoogleTimeline = "google_timeline" // on-device Timeline exports
+	sourceOverland       = "overland"
+	sourceOsmAnd         = "osmand"
+	sourceGPSLogger      = "gpslogger"
+	sourceGPX            = "gpx"
+	sourceKML            = "kml"
+	sourcePhoto          = "photo"
+	sourceCSV            = "csv"
+)
+
 type DeviceLocation struct {
-	Lat       float64   `json:"lat"`
-	Lng       float64   `json:"lng"`
-	Accuracy  int       `json:"accuracy"`
-	Timestamp time.Time `json:"timestamp,omitempty"`
-	Velocity  *int      `json:"velocity,omitempty"`
+	Lat              float64   `json:"lat"`
+	Lng              float64   `json:"lng"`
+	Accuracy         int       `json:"accuracy"`
+	Timestamp        time.Time `json:"timestamp,omitempty"`
+	Velocity         *int      `json:"velocity,omitempty"`
+	Altitude         *int      `json:"altitude,omitempty"`
+	Batt             *int      `json:"batt,omitempty"`
+	CourseOverGround *int      `json:"course_over_ground,omitempty"`
+	TrackerID        *string   `json:"tracker_id,omitempty"`
+	// User and Device the location is attributed to, empty if unknown
+	User   string `json:"user,omitempty"`
+	Device string `json:"device,omitempty"`
+	// Activity is the most likely thing the device was doing, e.g WALKING.
+	// Empty if unknown
+	Activity string `json:"activity,omitempty"`
+	// Source is where the location came from, e.g owntracks
+	Source string `json:"source,omitempty"`
+}
+
+// AddOTMessages persists the location, transition, waypoint(s) and card
+// messages in a single transaction. If any of them fail, none are persisted.
+// Locations that are already stored are skipped, the number skipped is
+// returned.
+func (s *Storage) AddOTMessages(ctx context.Context, msgs []owntracksMessage) (duplicates int, _ error) {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		duplicates = 0
+		for i, msg := range msgs {
+			var err error
+			switch {
+			case msg.IsLocation():
+				var inserted bool
+				inserted, err = addOTLocation(ctx, tx, msg)
+				if err == nil && !inserted {
+					duplicates++
+				}
+			case msg.IsTransition():
+				err = addOTTransition(ctx, tx, msg)
+			case msg.IsWaypoint(), msg.IsWaypoints():
+				err = upsertOTWaypoints(ctx, tx, msg)
+			case msg.IsCard():
+				err = addOTCard(ctx, tx, msg)
+			default:
+				err = fmt.Errorf("unhandled message type %s", msg.Type)
+			}
+			if err != nil {
+				return fmt.Errorf("message %d: %v", i, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("running tx: %v", err)
+	}
+
+	return duplicates, nil
 }
 
+// AddOTLocation persists the location message. If it is already stored, it is
+// skipped.
 func (s *Storage) AddOTLocation(ctx context.Context, msg owntracksMessage) error {
+	_, err := addOTLocation(ctx, s.db, msg)
+	return err
+}
+
+// addOTLocation inserts the location message, returning false if it was a
+// duplicate.
+func addOTLocation(ctx context.Context, q dbtx, msg owntracksMessage) (inserted bool, _ error) {
 	if !msg.IsLocation() {
-		return fmt.Errorf("message needs to be location")
+		return false, fmt.Errorf("message needs to be location")
 	}
 	loc, err := msg.AsLocation()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	var regions *string
@@ -33,73 +106,338 @@ func (s *Storage) AddOTLocation(ctx context.Context, msg owntracksMessage) error
 	if len(loc.InRegions) > 0 {
 		regb, err := json.Marshal(loc.InRegions)
 		if err != nil {
-			return fmt.Errorf("marshaling regions: %v", err)
+			return false, fmt.Errorf("marshaling regions: %v", err)
 		}
 		s := string(regb)
 		regions = &s
 	}
 
-	_, err = s.db.ExecContext(ctx, `insert into device_locations (accuracy, altitude, batt, battery_status, course_over_ground, lat, lng, region_radius, trigger, tracker_id, timestamp, vertical_accuracy, velocity, barometric_pressure, connection_status, topic, in_regions, raw_owntracks_message) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		loc.Accuracy, loc.Altitude, loc.Batt, loc.BatteryStatus, loc.CourseOverGround, loc.Latitude, loc.Longitude, loc.RegionRadius, loc.Trigger, loc.TrackerID, loc.Timestamp(), loc.VerticalAccuracy, loc.Velocity, loc.BarometricPressure, loc.ConnectionStatus, loc.Topic, regions, string(msg.Data),
+	// prefer the topic the transport attributed the message to
+	topic := loc.Topic
+	if msg.Topic != "" {
+		topic = &msg.Topic
+	}
+
+	var deviceID *string
+	if topic != nil {
+		if username, device, ok := otTopicUserDevice(*topic); ok {
+			id, err := ensureDevice(ctx, q, username, device)
+			if err != nil {
+				return false, err
+			}
+			deviceID = &id
+		}
+	}
+
+	res, err := q.ExecContext(ctx, `insert into device_locations (accuracy, altitude, batt, battery_status, course_over_ground, lat, lng, region_radius, trigger, tracker_id, timestamp, vertical_accuracy, velocity, barometric_pressure, connection_status, topic, in_regions, raw_owntracks_message, device_id, source) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict do nothing`,
+		loc.Accuracy, loc.Altitude, loc.Batt, loc.BatteryStatus, loc.CourseOverGround, loc.Latitude, loc.Longitude, loc.RegionRadius, loc.Trigger, loc.TrackerID, loc.Timestamp().UTC(), loc.VerticalAccuracy, loc.Velocity, loc.BarometricPressure, loc.ConnectionStatus, topic, regions, string(msg.Data), deviceID, sourceOwnTracks,
 	)
 	if err != nil {
-		return fmt.Errorf("inserting location: %v", err)
+		return false, fmt.Errorf("inserting location: %v", err)
 	}
 
-	return nil
+	return rowInserted(res)
 }
 
-func (s *Storage) AddGoogleTakeoutLocations(ctx context.Context, locs []takeoutLocation) error {
+// AddGoogleTakeoutLocations persists the locations. If username and device are
+// set, the locations will be attributed to that device. Locations that are
+// already stored are skipped, the number skipped is returned.
+func (s *Storage) AddGoogleTakeoutLocations(ctx context.Context, username, device string, locs []takeoutLocation) (duplicates int, _ error) {
 	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
-		for _, loc := range locs {
-			if loc.Raw == nil || len(loc.Raw) < 1 {
-				return fmt.Errorf("location missing raw data")
-			}
-			// check for https://support.google.com/maps/thread/4595364?hl=en
-			if e7ToNormal(loc.LatitudeE7) > 90 || e7ToNormal(loc.LatitudeE7) < -90 ||
-				e7ToNormal(loc.LongitudeE7) > 180 || e7ToNormal(loc.LongitudeE7) < -180 {
-				return fmt.Errorf("location has invalid lat %f (e7 %d) or long %f (e7 %d)",
-					e7ToNormal(loc.LatitudeE7), loc.LatitudeE7, e7ToNormal(loc.LongitudeE7), loc.LongitudeE7)
+		duplicates = 0
+		var deviceID *string
+		if username != "" || device != "" {
+			id, err := ensureDevice(ctx, tx, username, device)
+			if err != nil {
+				return err
 			}
+			deviceID = &id
+		}
 
-			tsms, err := strconv.ParseInt(loc.TimestampMS, 10, 64)
+		for _, loc := range locs {
+			if err := loc.Validate(); err != nil {
+				return err
+			}
+			ts, err := loc.Timestamp()
 			if err != nil {
-				return fmt.Errorf("parsing timestamp %s to int64: %v", loc.TimestampMS, err)
+				return err
 			}
 
-			ts := time.Unix(0, tsms*int64(1000000))
-
 			var velkmh *int
 			if loc.Velocity != nil {
 				v := msToKmh(*loc.Velocity)
 				velkmh = &v
 			}
 
-			_, err = tx.ExecContext(ctx, `insert into device_locations (accuracy, altitude, course_over_ground, lat, lng, timestamp, vertical_accuracy, velocity, raw_google_location) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				loc.Accuracy, loc.Altitude, loc.Heading, e7ToNormal(loc.LatitudeE7), e7ToNormal(loc.LongitudeE7), ts, loc.VerticalAccuracy, velkmh, string(loc.Raw),
+			acts, err := loc.LocationActivities()
+			if err != nil {
+				return err
+			}
+
+			res, err := tx.ExecContext(ctx, `insert into device_locations (accuracy, altitude, course_over_ground, lat, lng, timestamp, vertical_accuracy, velocity, raw_google_location, device_id, source, import_id) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict do nothing`,
+				loc.Accuracy, loc.Altitude, loc.Heading, e7ToNormal(loc.LatitudeE7), e7ToNormal(loc.LongitudeE7), ts.UTC(), loc.VerticalAccuracy, velkmh, string(loc.Raw), deviceID, sourceGoogleTakeout, ctxImportID(ctx),
 			)
 			if err != nil {
 				return fmt.Errorf("inserting location: %v", err)
 			}
+			inserted, err := rowInserted(res)
+			if err != nil {
+				return err
+			}
+			if !inserted {
+				duplicates++
+				continue
+			}
+
+			id, err := res.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("getting location id: %v", err)
+			}
+			if err := insertLocationActivities(ctx, tx, id, acts); err != nil {
+				return err
+			}
 		}
 
 		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("running tx: %v", err)
+		return 0, fmt.Errorf("running tx: %v", err)
+	}
+
+	return duplicates, nil
+}
+
+var _ deviceLocationStore = (*Storage)(nil)
+
+// AddDeviceLocations persists the locations for the user's device, in a single
+// transaction. If username and device are empty, the locations aren't
+// attributed to a device. Locations that are already stored are skipped, the
+// number skipped is returned.
+func (s *Storage) AddDeviceLocations(ctx context.Context, username, device string, locs []newDeviceLocation) (duplicates int, _ error) {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		duplicates = 0
+		var deviceID *string
+		if username != "" || device != "" {
+			id, err := ensureDevice(ctx, tx, username, device)
+			if err != nil {
+				return err
+			}
+			deviceID = &id
+		}
+
+		for i, loc := range locs {
+			loc.DeviceID = deviceID
+			inserted, err := insertDeviceLocation(ctx, tx, loc)
+			if err != nil {
+				return fmt.Errorf("location %d: %v", i, err)
+			}
+			if !inserted {
+				duplicates++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("running tx: %v", err)
+	}
+
+	return duplicates, nil
+}
+
+// scaledMeasurement scales and rounds v to an int. Values that aren't finite,
+// or are far larger than any real measurement, are treated as unset rather
+// than stored as junk.
+func scaledMeasurement(v *float64, scale float64) *int {
+	if v == nil {
+		return nil
+	}
+	f := math.Round(*v * scale)
+	if math.IsNaN(f) || math.Abs(f) > math.MaxInt32 {
+		return nil
+	}
+	i := int(f)
+	return &i
+}
+
+// knownMeasurement is scaledMeasurement for values that can't be negative.
+// Loggers use negative values for unknown, so those are treated as unset.
+func knownMeasurement(v *float64, scale float64) *int {
+	if v != nil && *v < 0 {
+		return nil
+	}
+	return scaledMeasurement(v, scale)
+}
+
+// newDeviceLocation is a location to persist, for sources that don't have
+// their own columns. Pointer fields are optional.
+type newDeviceLocation struct {
+	Source    string
+	DeviceID  *string
+	Lat       float64
+	Lng       float64
+	Timestamp time.Time
+	// metres
+	Accuracy *int
+	// metres
+	Altitude *int
+	// metres
+	VerticalAccuracy *int
+	// km/h
+	Velocity *int
+	// degrees
+	CourseOverGround *int
+	// percent
+	Batt *int
+	// Raw is the original data for the location, as received
+	Raw []byte
+}
+
+// insertDeviceLocation inserts the location, returning false if it was a
+// duplicate. Timestamps are stored in UTC, so they sort in time order.
+func insertDeviceLocation(ctx context.Context, q dbtx, loc newDeviceLocation) (inserted bool, _ error) {
+	if loc.Source == "" {
+		return false, fmt.Errorf("location has no source")
+	}
+	if err := validLatLng(loc.Lat, loc.Lng); err != nil {
+		return false, err
+	}
+
+	res, err := q.ExecContext(ctx, `insert into device_locations (source, device_id, lat, lng, timestamp, accuracy, altitude, vertical_accuracy, velocity, course_over_ground, batt, raw_source, import_id) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict do nothing`,
+		loc.Source, loc.DeviceID, loc.Lat, loc.Lng, loc.Timestamp.UTC(), loc.Accuracy, loc.Altitude, loc.VerticalAccuracy, loc.Velocity, loc.CourseOverGround, loc.Batt, string(loc.Raw), ctxImportID(ctx),
+	)
+	if err != nil {
+		return false, fmt.Errorf("inserting location: %v", err)
+	}
+
+	return rowInserted(res)
+}
+
+// rowInserted reports if an insert that ignores conflicts added a row
+func rowInserted(res sql.Result) (bool, error) {
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("checking rows affected: %v", err)
 	}
+	return ra > 0, nil
+}
 
+// validLatLng checks the coordinates are in range. NaN is never in range, but
+// fails every comparison so needs checking for.
+func validLatLng(lat, lng float64) error {
+	if math.IsNaN(lat) || math.IsNaN(lng) || lat > 90 || lat < -90 || lng > 180 || lng < -180 {
+		return fmt.Errorf("location has invalid lat %f or lng %f", lat, lng)
+	}
 	return nil
 }
 
-func (s *Storage) RecentLocations(ctx context.Context, from, to time.Time) ([]DeviceLocation, error) {
+// LocationFilter narrows down the locations returned. Empty fields match
+// everything.
+type LocationFilter struct {
+	// User limits to locations from this user's devices
+	User string
+	// Device limits to locations from devices with this name
+	Device string
+	ImportFilter
+}
+
+func (s *Storage) RecentLocations(ctx context.Context, from, to time.Time, filter LocationFilter) ([]DeviceLocation, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`select lat, lng, accuracy, timestamp, velocity from device_locations where timestamp > ? and timestamp < ? order by timestamp asc`, from, to)
+		`select `+deviceLocationCols+` from device_locations l
+left outer join devices d on (l.device_id = d.id)
+left outer join users u on (d.user_id = u.id)
+where l.timestamp > ? and l.timestamp < ?
+  and (? = '' or u.username = ?)
+  and (? = '' or d.name = ?)
+  and (? = '' or l.import_id = ?)
+  and (? = '' or ifnull(l.import_id, '') != ?)
+order by l.timestamp asc`,
+		from.UTC(), to.UTC(), filter.User, filter.User, filter.Device, filter.Device,
+		filter.Import, filter.Import, filter.HideImport, filter.HideImport)
 	if err != nil {
 		return nil, fmt.Errorf("getting locations: %v", err)
 	}
 	defer rows.Close()
 
+	return scanDeviceLocations(rows)
+}
+
+// LatestLocations returns the most recent location for each device that
+// matches the filter, ordered by user and device.
+func (s *Storage) LatestLocations(ctx context.Context, filter LocationFilter) ([]DeviceLocation, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`select `+deviceLocationCols+` from devices d
+join users u on (d.user_id = u.id)
+join device_locations l on (l.rowid = (
+	select rowid from device_locations
+	where device_id = d.id
+	  and (? = '' or import_id = ?)
+	  and (? = '' or ifnull(import_id, '') != ?)
+	order by timestamp desc limit 1
+))
+where (? = '' or u.username = ?)
+  and (? = '' or d.name = ?)
+order by u.username, d.name`,
+		filter.Import, filter.Import, filter.HideImport, filter.HideImport,
+		filter.User, filter.User, filter.Device, filter.Device)
+	if err != nil {
+		return nil, fmt.Errorf("getting latest locations: %v", err)
+	}
+	defer rows.Close()
+
+	return scanDeviceLocations(rows)
+}
+
+// NearestLocations returns the closest location at or before at, and the
+// closest after it, that match the filter. Either is nil if there isn't one
+// within window of at.
+func (s *Storage) NearestLocations(ctx context.Context, at time.Time, window time.Duration, filter LocationFilter) (before, after *DeviceLocation, _ error) {
+	atSecs, windowSecs := at.Unix(), int64(window/time.Second)
+
+	nearest := func(fromSecs, toSecs int64, order string) (*DeviceLocation, error) {
+		rows, err := s.db.QueryContext(ctx,
+			`select `+deviceLocationCols+` from device_locations l
+left outer join devices d on (l.device_id = d.id)
+left outer join users u on (d.user_id = u.id)
+where l.timestamp >= ? and l.timestamp < ?
+  and (? = '' or u.username = ?)
+  and (? = '' or d.name = ?)
+  and (? = '' or l.import_id = ?)
+  and (? = '' or ifnull(l.import_id, '') != ?)
+order by l.timestamp `+order+`
+limit 1`,
+			time.Unix(fromSecs, 0).UTC(), time.Unix(toSecs+1, 0).UTC(),
+			filter.User, filter.User, filter.Device, filter.Device,
+			filter.Import, filter.Import, filter.HideImport, filter.HideImport)
+		if err != nil {
+			return nil, fmt.Errorf("getting nearest location: %v", err)
+		}
+		defer rows.Close()
+
+		locs, err := scanDeviceLocations(rows)
+		if err != nil || len(locs) == 0 {
+			return nil, err
+		}
+		return &locs[0], nil
+	}
+
+	before, err := nearest(atSecs-windowSecs, atSecs, "desc")
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err = nearest(atSecs+1, atSecs+windowSecs, "asc")
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// deviceLocationCols are the columns scanDeviceLocations expects, with
+// device_locations as l, devices as d and users as u
+// accuracy isn't reported by every source
+const deviceLocationCols = `l.lat, l.lng, ifnull(l.accuracy, 0), l.timestamp, l.velocity, l.altitude, l.batt, l.course_over_ground, l.tracker_id, ifnull(u.username, ''), ifnull(d.name, ''), ` + locationActivityCol + `, ifnull(l.source, '')`
+
+func scanDeviceLocations(rows *sql.Rows) ([]DeviceLocation, error) {
 	ret := []DeviceLocation{}
 
 	for rows.Next() {
@@ -110,12 +448,23 @@ func (s *Storage) RecentLocations(ctx context.Context, from, to time.Time) ([]De
 			&loc.Accuracy,
 			&loc.Timestamp,
 			&loc.Velocity,
+			&loc.Altitude,
+			&loc.Batt,
+			&loc.CourseOverGround,
+			&loc.TrackerID,
+			&loc.User,
+			&loc.Device,
+			&loc.Activity,
+			&loc.Source,
 		); err != nil {
 			return nil, fmt.Errorf("scanning row: %v", err)
 		}
 
 		ret = append(ret, loc)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
 
 	return ret, nil
 }
@@ -134,3 +483,38 @@ func (s *Storage) LatestLocationTimestamp(ctx context.Context) (time.Time, error
 
 	return timestamp, nil
 }
+
+// DeviceLastLocation is the time a device last reported its location
+type DeviceLastLocation struct {
+	User      string
+	Device    string
+	Timestamp time.Time
+}
+
+// LatestDeviceLocationTimestamps returns the time each device last reported
+// its location. Devices that have never reported are omitted.
+func (s *Storage) LatestDeviceLocationTimestamps(ctx context.Context) ([]DeviceLastLocation, error) {
+	devs, err := s.Devices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []DeviceLastLocation{}
+
+	for _, d := range devs {
+		var timestamp time.Time
+		if err := s.db.QueryRowContext(ctx, `select timestamp from device_locations where device_id = ? order by timestamp desc limit 1`, d.ID).Scan(&timestamp); err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return nil, fmt.Errorf("finding latest timestamp for %s/%s: %v", d.User, d.Name, err)
+		}
+		ret = append(ret, DeviceLastLocation{
+			User:      d.User,
+			Device:    d.Name,
+			Timestamp: timestamp,
+		})
+	}
+
+	return ret, nil
+}
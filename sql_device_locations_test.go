@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"math"
 	"strconv"
 	"testing"
 	"time"
@@ -30,17 +31,57 @@ func TestAddOTLocation(t *testing.T) {
 	}
 }
 
+func TestAddOTMessagesAtomic(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	loc := owntracksMessage{}
+	if err := json.Unmarshal([]byte(egOwntracksLocation), &loc); err != nil {
+		t.Fatal(err)
+	}
+	// cards can't be stored without a topic
+	card := owntracksMessage{Type: "card", Data: json.RawMessage(`{"_type":"card","name":"Jane"}`)}
+
+	if _, err := s.AddOTMessages(ctx, []owntracksMessage{loc, card}); err == nil {
+		t.Fatal("want error persisting card without topic")
+	}
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("want location rolled back, got %d rows", count)
+	}
+
+	if _, err := s.AddOTMessages(ctx, []owntracksMessage{loc}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("want one row, got: %d", count)
+	}
+}
+
 func TestAddTakeoutLocation(t *testing.T) {
 	ctx, s := setupDB(t)
 
+	now := time.Now()
 	locs := []takeoutLocation{
-		{LatitudeE7: 10 * 1e7, LongitudeE7: -10 * 10e7, TimestampMS: strconv.Itoa(int(time.Now().Unix() * 1000)), Accuracy: 100, Raw: json.RawMessage([]byte(`{}`))},
-		{LatitudeE7: 10 * 1e7, LongitudeE7: -10 * 10e7, TimestampMS: strconv.Itoa(int(time.Now().Unix() * 1000)), Accuracy: 100, Raw: json.RawMessage([]byte(`{}`))},
+		{LatitudeE7: 10 * 1e7, LongitudeE7: -10 * 10e7, TimestampMS: strconv.Itoa(int(now.Unix() * 1000)), Accuracy: 100, Raw: json.RawMessage([]byte(`{}`))},
+		{LatitudeE7: 10 * 1e7, LongitudeE7: -10 * 10e7, TimestampMS: strconv.Itoa(int(now.Add(time.Second).Unix() * 1000)), Accuracy: 100, Raw: json.RawMessage([]byte(`{}`))},
+		// duplicate of the first
+		{LatitudeE7: 10 * 1e7, LongitudeE7: -10 * 10e7, TimestampMS: strconv.Itoa(int(now.Unix() * 1000)), Accuracy: 100, Raw: json.RawMessage([]byte(`{}`))},
 	}
 
-	if err := s.AddGoogleTakeoutLocations(ctx, locs); err != nil {
+	dups, err := s.AddGoogleTakeoutLocations(ctx, "", "", locs)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if dups != 1 {
+		t.Errorf("want 1 duplicate skipped, got: %d", dups)
+	}
 
 	var count int
 
@@ -51,6 +92,21 @@ func TestAddTakeoutLocation(t *testing.T) {
 	if count != 2 {
 		t.Errorf("want 2 rows, got: %d", count)
 	}
+
+	// importing the same file again should be a no-op
+	dups, err = s.AddGoogleTakeoutLocations(ctx, "", "", locs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dups != 3 {
+		t.Errorf("want all 3 skipped on re-import, got: %d", dups)
+	}
+	if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("want 2 rows after re-import, got: %d", count)
+	}
 }
 
 func TestLatestLocationTimestamp(t *testing.T) {
@@ -90,3 +146,121 @@ func TestLatestLocationTimestamp(t *testing.T) {
 		t.Errorf("want latest time %s, got: %s", now.String(), l.String())
 	}
 }
+
+func TestRecentLocationsFilter(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	now := time.Now()
+	acc := 10
+
+	for _, topic := range []string{"owntracks/jane/phone", "owntracks/jane/ipad", "owntracks/bob/phone", ""} {
+		jb, err := json.Marshal(otLocation{TimestampUnix: int(now.Unix()), Accuracy: &acc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		om := owntracksMessage{
+			Type:  "location",
+			Data:  jb,
+			Topic: topic,
+		}
+		if err := s.AddOTLocation(ctx, om); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		filter LocationFilter
+		want   int
+	}{
+		{filter: LocationFilter{}, want: 4},
+		{filter: LocationFilter{User: "jane"}, want: 2},
+		{filter: LocationFilter{User: "jane", Device: "phone"}, want: 1},
+		{filter: LocationFilter{Device: "phone"}, want: 2},
+		{filter: LocationFilter{User: "alice"}, want: 0},
+	} {
+		locs, err := s.RecentLocations(ctx, now.Add(-1*time.Minute), now.Add(1*time.Minute), tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locs) != tc.want {
+			t.Errorf("filter %#v: want %d locations, got: %d", tc.filter, tc.want, len(locs))
+		}
+	}
+
+	devs, err := s.Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 3 {
+		t.Errorf("want 3 devices, got: %d", len(devs))
+	}
+}
+
+func TestDeviceLocationsStoredInUTC(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	// recorded an hour apart, in different zones. In their own zones they'd
+	// sort the other way around.
+	first := time.Date(2019, 6, 12, 20, 0, 0, 0, time.FixedZone("", 10*60*60))
+	second := time.Date(2019, 6, 12, 4, 0, 0, 0, time.FixedZone("", -7*60*60))
+	if _, err := s.AddDeviceLocations(ctx, "jane", "phone", []newDeviceLocation{
+		{Source: sourceOverland, Lat: 1, Lng: 1, Timestamp: first},
+		{Source: sourceOverland, Lat: 2, Lng: 2, Timestamp: second},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	locs, err := s.RecentLocations(ctx, first.Add(-time.Minute), second.Add(time.Minute), LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 || locs[0].Lat != 1 || locs[1].Lat != 2 {
+		t.Fatalf("want both locations in time order, got: %#v", locs)
+	}
+	if !locs[0].Timestamp.Equal(first) || locs[0].Timestamp.Location() != time.UTC {
+		t.Errorf("want %s in UTC, got %s", first, locs[0].Timestamp)
+	}
+
+	locs, err = s.RecentLocations(ctx, first.Add(30*time.Minute), second.Add(time.Minute), LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 1 || locs[0].Lat != 2 {
+		t.Errorf("want only the second location, got: %#v", locs)
+	}
+
+	before, after, err := s.NearestLocations(ctx, first.Add(30*time.Minute), time.Hour, LocationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == nil || before.Lat != 1 || after == nil || after.Lat != 2 {
+		t.Errorf("want nearest locations either side, got %#v and %#v", before, after)
+	}
+}
+
+func TestScaledMeasurement(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	i := func(v int) *int { return &v }
+	for _, tc := range []struct {
+		v     *float64
+		known bool
+		want  *int
+	}{
+		{v: nil, want: nil},
+		{v: f(2.5), want: i(3)},
+		{v: f(-2), want: i(-2)},
+		{v: f(-1), known: true, want: nil},
+		{v: f(math.NaN()), want: nil},
+		{v: f(math.Inf(1)), known: true, want: nil},
+		{v: f(math.Inf(-1)), want: nil},
+		{v: f(1e300), want: nil},
+	} {
+		got := scaledMeasurement(tc.v, 1)
+		if tc.known {
+			got = knownMeasurement(tc.v, 1)
+		}
+		if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+			t.Errorf("%v: want %v, got %v", tc.v, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+func (s *Storage) AddOTCard(ctx context.Context, msg owntracksMessage) error {
+	return addOTCard(ctx, s.db, msg)
+}
+
+func addOTCard(ctx context.Context, q dbtx, msg owntracksMessage) error {
+	if !msg.IsCard() {
+		return fmt.Errorf("message needs to be card")
+	}
+	if msg.Topic == "" {
+		return fmt.Errorf("card needs to be attributed to a topic")
+	}
+	card, err := msg.AsCard()
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, `
+insert into cards(id, topic, name, tracker_id, raw_owntracks_message) values (?, ?, ?, ?, ?)
+on conflict(topic) do update
+  set name = ?, tracker_id = ?, raw_owntracks_message = ?, updated_at = datetime('now')
+where topic=?`,
+		newDBID(), msg.Topic, card.Name, card.TrackerID, string(msg.Data), // insert
+		card.Name, card.TrackerID, string(msg.Data), // update
+		msg.Topic) // where
+	if err != nil {
+		return fmt.Errorf("upserting card: %v", err)
+	}
+
+	return nil
+}
+
+// OTFriendMessages returns the latest location and card message for the
+// devices the device publishing to topic is allowed to see, in the form the
+// OwnTracks apps expect in a HTTP publish response. These are the other devices
+// of the same user, and those of users who share their locations with them.
+// Each message has the topic of the device it belongs to set on it.
+func (s *Storage) OTFriendMessages(ctx context.Context, topic string) ([]json.RawMessage, error) {
+	viewer, _, ok := otTopicUserDevice(topic)
+	if !ok {
+		return []json.RawMessage{}, nil
+	}
+	visible := map[string]bool{viewer: true}
+	srows, err := s.db.QueryContext(ctx, `
+select u.username from location_shares s
+join users u on (s.user_id = u.id)
+join users w on (s.with_user_id = w.id)
+where w.username = ?`, viewer)
+	if err != nil {
+		return nil, fmt.Errorf("getting shares: %v", err)
+	}
+	defer srows.Close()
+	for srows.Next() {
+		var u string
+		if err := srows.Scan(&u); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		visible[u] = true
+	}
+	if err := srows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	// find the latest OwnTracks message per device with the index on device
+	// and time, rather than scanning all of them for the latest per topic
+	drows, err := s.db.QueryContext(ctx, `
+select d.id, u.username from devices d
+join users u on (d.user_id = u.id)`)
+	if err != nil {
+		return nil, fmt.Errorf("getting devices: %v", err)
+	}
+	defer drows.Close()
+	var deviceIDs []string
+	for drows.Next() {
+		var id, u string
+		if err := drows.Scan(&id, &u); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		if visible[u] {
+			deviceIDs = append(deviceIDs, id)
+		}
+	}
+	if err := drows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	type friendMessage struct {
+		topic string
+		raw   string
+	}
+	var msgs []friendMessage
+	for _, id := range deviceIDs {
+		var m friendMessage
+		err := s.db.QueryRowContext(ctx, `
+select topic, raw_owntracks_message from device_locations
+where device_id = ? and raw_owntracks_message is not null and topic is not null
+order by timestamp desc
+limit 1`, id).Scan(&m.topic, &m.raw)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("getting latest location: %v", err)
+		}
+		msgs = append(msgs, m)
+	}
+
+	// there's one card per device
+	crows, err := s.db.QueryContext(ctx, `select topic, raw_owntracks_message from cards`)
+	if err != nil {
+		return nil, fmt.Errorf("getting cards: %v", err)
+	}
+	defer crows.Close()
+	for crows.Next() {
+		var m friendMessage
+		if err := crows.Scan(&m.topic, &m.raw); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		msgs = append(msgs, m)
+	}
+	if err := crows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	ret := []json.RawMessage{}
+
+	for _, fm := range msgs {
+		if fm.topic == topic {
+			continue
+		}
+		if u, _, ok := otTopicUserDevice(fm.topic); !ok || !visible[u] {
+			continue
+		}
+
+		// the stored message may not have been published with the topic, set
+		// it so the apps can attribute it.
+		m := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(fm.raw), &m); err != nil {
+			return nil, fmt.Errorf("unmarshaling message for %s: %v", fm.topic, err)
+		}
+		tb, err := json.Marshal(fm.topic)
+		if err != nil {
+			return nil, err
+		}
+		m["topic"] = tb
+		mb, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling message for %s: %v", fm.topic, err)
+		}
+
+		ret = append(ret, mb)
+	}
+
+	return ret, nil
+}
+
+// LocationShare is a user sharing their devices' locations with another user
+type LocationShare struct {
+	User      string
+	With      string
+	CreatedAt time.Time
+}
+
+// ShareLocations lets withUsername's devices see username's devices as
+// friends. Both users must exist.
+func (s *Storage) ShareLocations(ctx context.Context, username, withUsername string) error {
+	if username == withUsername {
+		return fmt.Errorf("a user's devices can already see each other")
+	}
+	return s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		uid, err := userID(ctx, tx, username)
+		if err != nil {
+			return err
+		}
+		wid, err := userID(ctx, tx, withUsername)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`insert into location_shares(user_id, with_user_id) values (?, ?) on conflict do nothing`,
+			uid, wid); err != nil {
+			return fmt.Errorf("inserting share: %v", err)
+		}
+		return nil
+	})
+}
+
+// UnshareLocations stops withUsername's devices seeing username's
+func (s *Storage) UnshareLocations(ctx context.Context, username, withUsername string) error {
+	res, err := s.db.ExecContext(ctx, `
+delete from location_shares
+where user_id = (select id from users where username = ?)
+  and with_user_id = (select id from users where username = ?)`,
+		username, withUsername)
+	if err != nil {
+		return fmt.Errorf("deleting share: %v", err)
+	}
+	deleted, err := rowInserted(res)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("%s does not share with %s", username, withUsername)
+	}
+	return nil
+}
+
+// LocationShares returns all the shares, ordered by user
+func (s *Storage) LocationShares(ctx context.Context) ([]LocationShare, error) {
+	rows, err := s.db.QueryContext(ctx, `
+select u.username, w.username, s.created_at from location_shares s
+join users u on (s.user_id = u.id)
+join users w on (s.with_user_id = w.id)
+order by u.username, w.username`)
+	if err != nil {
+		return nil, fmt.Errorf("getting shares: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []LocationShare{}
+	for rows.Next() {
+		var ls LocationShare
+		if err := rows.Scan(&ls.User, &ls.With, &ls.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		ret = append(ret, ls)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Import is a run of one of the import commands
+type Import struct {
+	ID     string
+	Source string
+	// Path and SHA256 are empty if unknown, SHA256 is only set when a single
+	// file was imported
+	Path         string
+	SHA256       string
+	StartedAt    time.Time
+	FinishedAt   *time.Time
+	Error        string
+	Rows         int
+	RolledBackAt *time.Time
+}
+
+// importTables are the tables with rows attributed to an import, in the order
+// they can be deleted in
+var importTables = []string{
+	"photos",
+	"trip_segments",
+	"trips",
+	"activity_segments",
+	"visits",
+	"places",
+	"checkins",
+	"device_locations",
+}
+
+// ImportFilter narrows down rows by the import that stored them. Empty fields
+// match everything.
+type ImportFilter struct {
+	// Import limits to rows stored by this import
+	Import string
+	// HideImport excludes rows stored by this import
+	HideImport string
+}
+
+type importCtxKey struct{}
+
+// withImport attributes rows stored with the returned context to the import
+func withImport(ctx context.Context, importID string) context.Context {
+	return context.WithValue(ctx, importCtxKey{}, importID)
+}
+
+// ctxImportID returns the import rows stored with ctx belong to, nil if they
+// aren't from an import
+func ctxImportID(ctx context.Context) *string {
+	id, ok := ctx.Value(importCtxKey{}).(string)
+	if !ok {
+		return nil
+	}
+	return &id
+}
+
+// onConflictUpdate returns the conflict action of an upsert that sets the
+// given columns. Imports only ever add rows, so they leave an existing row as
+// it is, and rolling one back can't lose data another stored.
+func onConflictUpdate(ctx context.Context, set string) string {
+	if ctxImportID(ctx) != nil {
+		return "do nothing"
+	}
+	return "do update set " + set
+}
+
+// StartImport records the start of an import, returning its ID
+func (s *Storage) StartImport(ctx context.Context, source, path, sha256 string) (string, error) {
+	id := newDBID()
+	if _, err := s.db.ExecContext(ctx,
+		`insert into imports(id, source, path, sha256, started_at) values (?, ?, ?, ?, ?)`,
+		id, source, nullString(path), nullString(sha256), time.Now()); err != nil {
+		return "", fmt.Errorf("inserting import: %v", err)
+	}
+	return id, nil
+}
+
+// FinishImport records that the import is done, and how many rows it created.
+// importErr is the error it failed with, if it did.
+func (s *Storage) FinishImport(ctx context.Context, importID string, importErr error) error {
+	var rows int
+	for _, t := range importTables {
+		var n int
+		if err := s.db.QueryRowContext(ctx, `select count(*) from `+t+` where import_id = ?`, importID).Scan(&n); err != nil {
+			return fmt.Errorf("counting %s: %v", t, err)
+		}
+		rows += n
+	}
+
+	var errStr *string
+	if importErr != nil {
+		e := importErr.Error()
+		errStr = &e
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`update imports set finished_at = ?, error = ?, row_count = ? where id = ?`,
+		time.Now(), errStr, rows, importID); err != nil {
+		return fmt.Errorf("updating import %s: %v", importID, err)
+	}
+	return nil
+}
+
+// Imports returns all the imports, most recent first
+func (s *Storage) Imports(ctx context.Context) ([]Import, error) {
+	rows, err := s.db.QueryContext(ctx, `
+select id, source, ifnull(path, ''), ifnull(sha256, ''), started_at, finished_at, ifnull(error, ''), row_count, rolled_back_at
+from imports
+order by started_at desc`)
+	if err != nil {
+		return nil, fmt.Errorf("getting imports: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []Import{}
+	for rows.Next() {
+		var i Import
+		if err := rows.Scan(&i.ID, &i.Source, &i.Path, &i.SHA256, &i.StartedAt, &i.FinishedAt, &i.Error, &i.Rows, &i.RolledBackAt); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		ret = append(ret, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
+
+// RollbackImport deletes all the rows the import created, in a single
+// transaction, returning how many were deleted. Imports never change rows that
+// were already stored when they ran, so those are left exactly as the earlier
+// import or sync stored them, and the data is as it was before the import. The
+// exception is a photo's path, which follows the file if it has moved. Rows the
+// import created are deleted even if an untracked sync, e.g of the TripIt feed,
+// has since updated them. An import whose photo locations are used by photos
+// from later imports can't be rolled back until they are. The import itself
+// is kept, marked as rolled back.
+func (s *Storage) RollbackImport(ctx context.Context, importID string) (deleted int, _ error) {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		deleted = 0
+		var rolledBack *time.Time
+		if err := tx.QueryRowContext(ctx, `select rolled_back_at from imports where id = ?`, importID).Scan(&rolledBack); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("import %s not found", importID)
+			}
+			return fmt.Errorf("getting import %s: %v", importID, err)
+		}
+		if rolledBack != nil {
+			return fmt.Errorf("import %s was already rolled back at %s", importID, rolledBack.Format(time.RFC3339))
+		}
+
+		// photos share a location if it's the same, e.g burst shots. Deleting
+		// the location would delete photos another import stored with it.
+		var dependent string
+		if err := tx.QueryRowContext(ctx, `
+select ifnull(group_concat(distinct ifnull(p.import_id, '-')), '') from photos p
+join device_locations l on (p.location_id = l.id)
+where l.import_id = ? and ifnull(p.import_id, '') != ?`, importID, importID).Scan(&dependent); err != nil {
+			return fmt.Errorf("checking for photos from other imports: %v", err)
+		}
+		if dependent != "" {
+			return fmt.Errorf("photos from imports %s use locations import %s stored, roll them back first", dependent, importID)
+		}
+
+		// segments from other imports may belong to a trip this one created
+		if _, err := tx.ExecContext(ctx,
+			`update trip_segments set trip_id = null where trip_id in (select id from trips where import_id = ?)`, importID); err != nil {
+			return fmt.Errorf("unlinking trip segments: %v", err)
+		}
+		// people aren't attributed to an import, but who was at a checkin is
+		if _, err := tx.ExecContext(ctx,
+			`delete from checkin_people where checkin_id in (select id from checkins where import_id = ?)`, importID); err != nil {
+			return fmt.Errorf("deleting checkin people: %v", err)
+		}
+
+		for _, t := range importTables {
+			res, err := tx.ExecContext(ctx, `delete from `+t+` where import_id = ?`, importID)
+			if err != nil {
+				return fmt.Errorf("deleting from %s: %v", t, err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("checking rows affected: %v", err)
+			}
+			deleted += int(n)
+		}
+
+		if _, err := tx.ExecContext(ctx, `update imports set rolled_back_at = ? where id = ?`, time.Now(), importID); err != nil {
+			return fmt.Errorf("updating import %s: %v", importID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("running tx: %v", err)
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// locationActivity is a candidate for what the device was doing at a
+// location, e.g WALKING or IN_VEHICLE
+type locationActivity struct {
+	// Timestamp is when the classification was made
+	Timestamp  time.Time
+	Type       string
+	Confidence int // percent
+}
+
+// ActivityTotal is how many locations were most likely recorded doing an
+// activity
+type ActivityTotal struct {
+	Type      string
+	Locations int
+}
+
+func insertLocationActivities(ctx context.Context, q dbtx, locationID int64, acts []locationActivity) error {
+	for _, a := range acts {
+		if _, err := q.ExecContext(ctx,
+			`insert into location_activities(location_id, timestamp, type, confidence) values (?, ?, ?, ?) on conflict do nothing`,
+			locationID, a.Timestamp, a.Type, a.Confidence); err != nil {
+			return fmt.Errorf("inserting activity for location %d: %v", locationID, err)
+		}
+	}
+	return nil
+}
+
+// BackfillLocationActivities extracts the activities from the raw data of up to
+// limit google takeout locations with an id after afterID, that don't have any
+// stored. It returns the last location id handled, which is 0 when there are
+// no more to handle, and the number of locations and activities updated.
+func (s *Storage) BackfillLocationActivities(ctx context.Context, afterID int64, limit int) (lastID int64, locations, activities int, _ error) {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		lastID, locations, activities = 0, 0, 0
+
+		rows, err := tx.QueryContext(ctx,
+			`select l.id, l.raw_google_location from device_locations l
+			where l.id > ? and l.raw_google_location is not null
+			  and not exists (select 1 from location_activities a where a.location_id = l.id)
+			order by l.id asc
+			limit ?`, afterID, limit)
+		if err != nil {
+			return fmt.Errorf("getting locations: %v", err)
+		}
+		type rawLoc struct {
+			id  int64
+			raw string
+		}
+		var locs []rawLoc
+		for rows.Next() {
+			var rl rawLoc
+			if err := rows.Scan(&rl.id, &rl.raw); err != nil {
+				rows.Close()
+				return fmt.Errorf("scanning row: %v", err)
+			}
+			locs = append(locs, rl)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("rows err: %v", err)
+		}
+
+		for _, rl := range locs {
+			lastID = rl.id
+
+			var tl takeoutLocation
+			if err := json.Unmarshal([]byte(rl.raw), &tl); err != nil {
+				return fmt.Errorf("unmarshaling location %d: %v", rl.id, err)
+			}
+			acts, err := tl.LocationActivities()
+			if err != nil {
+				return fmt.Errorf("location %d: %v", rl.id, err)
+			}
+			if len(acts) == 0 {
+				continue
+			}
+			if err := insertLocationActivities(ctx, tx, rl.id, acts); err != nil {
+				return err
+			}
+			locations++
+			activities += len(acts)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("running tx: %v", err)
+	}
+
+	return lastID, locations, activities, nil
+}
+
+// ActivityTotals returns the number of locations in the time range for each
+// most likely activity, most common first. Locations without activities
+// aren't counted.
+func (s *Storage) ActivityTotals(ctx context.Context, from, to time.Time, filter LocationFilter) ([]ActivityTotal, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`select activity, count(*) as locations from (
+	select `+locationActivityCol+` as activity from device_locations l
+	left outer join devices d on (l.device_id = d.id)
+	left outer join users u on (d.user_id = u.id)
+	where l.timestamp > ? and l.timestamp < ?
+	  and (? = '' or u.username = ?)
+	  and (? = '' or d.name = ?)
+	  and (? = '' or l.import_id = ?)
+	  and (? = '' or ifnull(l.import_id, '') != ?)
+)
+where activity != ''
+group by activity
+order by locations desc, activity asc`,
+		from.UTC(), to.UTC(), filter.User, filter.User, filter.Device, filter.Device,
+		filter.Import, filter.Import, filter.HideImport, filter.HideImport)
+	if err != nil {
+		return nil, fmt.Errorf("getting activity totals: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []ActivityTotal{}
+	for rows.Next() {
+		var at ActivityTotal
+		if err := rows.Scan(&at.Type, &at.Locations); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		ret = append(ret, at)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
+
+// locationActivityCol selects the most likely activity for the location l,
+// the highest confidence candidate from its first classification. Empty if it
+// has none.
+const locationActivityCol = `ifnull((select a.type from location_activities a where a.location_id = l.id order by a.timestamp asc, a.confidence desc limit 1), '')`
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLocationActivities(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	var locs []takeoutLocation
+	for _, raw := range []string{
+		`{"latitudeE7": 361000000, "longitudeE7": 867000000, "accuracy": 10, "timestampMs": "1592691300000", "activity": [
+			{"timestampMs": "1592691301000", "activity": [{"type": "ON_FOOT", "confidence": 40}, {"type": "WALKING", "confidence": 60}]},
+			{"timestampMs": "1592691302000", "activity": [{"type": "STILL", "confidence": 100}]}
+		]}`,
+		`{"latitudeE7": 362000000, "longitudeE7": 868000000, "accuracy": 10, "timestampMs": "1592691400000", "activity": [
+			{"timestamp": "2020-06-20T22:16:41Z", "activity": [{"type": "IN_VEHICLE", "confidence": 80}, {"type": "STILL", "confidence": 20}]}
+		]}`,
+		`{"latitudeE7": 363000000, "longitudeE7": 869000000, "accuracy": 10, "timestampMs": "1592691500000"}`,
+	} {
+		tl, err := parseTakeoutLocation([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs = append(locs, tl)
+	}
+
+	if _, err := s.AddGoogleTakeoutLocations(ctx, "", "", locs); err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := time.Date(2020, 6, 20, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 21, 0, 0, 0, 0, time.UTC)
+
+	checkActivities := func() {
+		t.Helper()
+		rl, err := s.RecentLocations(ctx, from, to, LocationFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, l := range rl {
+			got = append(got, l.Activity)
+		}
+		if len(got) != 3 || got[0] != "WALKING" || got[1] != "IN_VEHICLE" || got[2] != "" {
+			t.Errorf("want most likely activities [WALKING IN_VEHICLE ], got %q", got)
+		}
+
+		totals, err := s.ActivityTotals(ctx, from, to, LocationFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(totals) != 2 || totals[0] != (ActivityTotal{Type: "IN_VEHICLE", Locations: 1}) || totals[1] != (ActivityTotal{Type: "WALKING", Locations: 1}) {
+			t.Errorf("unexpected activity totals: %#v", totals)
+		}
+	}
+
+	checkActivities()
+
+	// locations imported before activities were stored can be backfilled
+	if _, err := s.db.ExecContext(ctx, `delete from location_activities`); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &activitybackfillCommand{
+		log:       log.New(os.Stderr, "", log.LstdFlags),
+		batchSize: 1,
+		store:     s,
+	}
+	if err := cmd.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from location_activities`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("want 5 activities backfilled, got %d", count)
+	}
+	checkActivities()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// newPhoto is a photo to persist, with the location it was taken at
+type newPhoto struct {
+	// SHA256 of the file's contents, hex encoded
+	SHA256   string
+	Path     string
+	Location newDeviceLocation
+}
+
+// Photo is a photo and where it was taken
+type Photo struct {
+	Path    string
+	TakenAt time.Time
+	Lat     float64
+	Lng     float64
+}
+
+// AddPhoto stores the photo and its location. If a photo with the same
+// contents is already stored it is skipped, and false returned. Its path is
+// updated, in case it has moved. If username and device are set the location
+// is attributed to that device.
+func (s *Storage) AddPhoto(ctx context.Context, username, device string, p newPhoto) (inserted bool, _ error) {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		inserted = false
+		res, err := tx.ExecContext(ctx, `update photos set path = ? where sha256 = ?`, p.Path, p.SHA256)
+		if err != nil {
+			return fmt.Errorf("updating photo %s: %v", p.Path, err)
+		}
+		ra, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("checking rows affected: %v", err)
+		}
+		if ra > 0 {
+			return nil
+		}
+
+		if username != "" || device != "" {
+			id, err := ensureDevice(ctx, tx, username, device)
+			if err != nil {
+				return err
+			}
+			p.Location.DeviceID = &id
+		}
+
+		// the location may already be stored, e.g for burst shots. Either way,
+		// find it by the same columns as the unique index.
+		if _, err := insertDeviceLocation(ctx, tx, p.Location); err != nil {
+			return fmt.Errorf("photo %s: %v", p.Path, err)
+		}
+		var locID int64
+		if err := tx.QueryRowContext(ctx, `
+select id from device_locations
+where source = ? and ifnull(device_id, '') = ifnull(?, '')
+  and strftime('%s', timestamp) = strftime('%s', ?) and lat = ? and lng = ?`,
+			p.Location.Source, p.Location.DeviceID, p.Location.Timestamp, p.Location.Lat, p.Location.Lng).Scan(&locID); err != nil {
+			return fmt.Errorf("finding location for photo %s: %v", p.Path, err)
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			`insert into photos(id, sha256, path, location_id, taken_at, import_id) values (?, ?, ?, ?, ?, ?)`,
+			newDBID(), p.SHA256, p.Path, locID, p.Location.Timestamp.UTC(), ctxImportID(ctx)); err != nil {
+			return fmt.Errorf("inserting photo %s: %v", p.Path, err)
+		}
+		inserted = true
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("running tx: %v", err)
+	}
+
+	return inserted, nil
+}
+
+// Photos returns the photos taken between from and to, that match the filter
+func (s *Storage) Photos(ctx context.Context, from, to time.Time, filter LocationFilter) ([]Photo, error) {
+	rows, err := s.db.QueryContext(ctx, `
+select p.path, p.taken_at, l.lat, l.lng from photos p
+join device_locations l on (p.location_id = l.id)
+left outer join devices d on (l.device_id = d.id)
+left outer join users u on (d.user_id = u.id)
+where p.taken_at > ? and p.taken_at < ?
+  and (? = '' or u.username = ?)
+  and (? = '' or d.name = ?)
+  and (? = '' or p.import_id = ?)
+  and (? = '' or ifnull(p.import_id, '') != ?)
+order by p.taken_at asc`,
+		from.UTC(), to.UTC(), filter.User, filter.User, filter.Device, filter.Device,
+		filter.Import, filter.Import, filter.HideImport, filter.HideImport)
+	if err != nil {
+		return nil, fmt.Errorf("getting photos: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []Photo{}
+	for rows.Next() {
+		var p Photo
+		if err := rows.Scan(&p.Path, &p.TakenAt, &p.Lat, &p.Lng); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		ret = append(ret, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
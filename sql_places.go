@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// newPlace is a place to persist. Pointer fields are optional.
+type newPlace struct {
+	Source      string
+	Name        string
+	Description string
+	Lat         float64
+	Lng         float64
+	Elevation   *int
+	Timestamp   *time.Time
+	Raw         []byte
+}
+
+// AddPlaces stores the places in a single transaction. A place with the same
+// source, device, coordinates and name as one already stored is skipped, the
+// number skipped is returned. If username and device are set the places are
+// attributed to that device.
+func (s *Storage) AddPlaces(ctx context.Context, username, device string, places []newPlace) (duplicates int, _ error) {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		duplicates = 0
+		var deviceID *string
+		if username != "" || device != "" {
+			id, err := ensureDevice(ctx, tx, username, device)
+			if err != nil {
+				return err
+			}
+			deviceID = &id
+		}
+
+		for i, p := range places {
+			if err := validLatLng(p.Lat, p.Lng); err != nil {
+				return fmt.Errorf("place %d: %v", i, err)
+			}
+			res, err := tx.ExecContext(ctx,
+				`insert into places(id, source, name, description, lat, lng, elevation, timestamp, device_id, raw, import_id) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict do nothing`,
+				newDBID(), p.Source, nullString(p.Name), nullString(p.Description), p.Lat, p.Lng, p.Elevation, p.Timestamp, deviceID, string(p.Raw), ctxImportID(ctx))
+			if err != nil {
+				return fmt.Errorf("inserting place %d: %v", i, err)
+			}
+			inserted, err := rowInserted(res)
+			if err != nil {
+				return err
+			}
+			if !inserted {
+				duplicates++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("running tx: %v", err)
+	}
+
+	return duplicates, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RegionTransition is a record of a device entering or leaving a region
+type RegionTransition struct {
+	// Event is either enter or leave
+	Event string
+	// Region is the description/name of the region
+	Region    string
+	Lat       float64
+	Lng       float64
+	Timestamp time.Time
+}
+
+// Region is a monitored area defined on a device
+type Region struct {
+	Name string
+	Lat  float64
+	Lng  float64
+	// Radius in metres
+	Radius int
+	// Topic of the device the region is defined on
+	Topic string
+	// Timestamp the region was created on the device
+	Timestamp time.Time
+}
+
+func (s *Storage) AddOTTransition(ctx context.Context, msg owntracksMessage) error {
+	return addOTTransition(ctx, s.db, msg)
+}
+
+func addOTTransition(ctx context.Context, q dbtx, msg owntracksMessage) error {
+	if !msg.IsTransition() {
+		return fmt.Errorf("message needs to be transition")
+	}
+	tr, err := msg.AsTransition()
+	if err != nil {
+		return err
+	}
+
+	// prefer the topic the transport attributed the message to
+	topic := tr.Topic
+	if msg.Topic != "" {
+		topic = &msg.Topic
+	}
+
+	_, err = q.ExecContext(ctx, `insert into region_transitions (id, event, description, region_id, waypoint_timestamp, lat, lng, accuracy, trigger, tracker_id, topic, timestamp, raw_owntracks_message) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		newDBID(), tr.Event, tr.Description, tr.RegionID, tr.WaypointTimestamp(), tr.Latitude, tr.Longitude, tr.Accuracy, tr.Trigger, tr.TrackerID, topic, tr.Timestamp(), string(msg.Data),
+	)
+	if err != nil {
+		return fmt.Errorf("inserting transition: %v", err)
+	}
+
+	return nil
+}
+
+// RegionTransitions returns the region enter/leave events that occurred in the
+// given time range, oldest first.
+func (s *Storage) RegionTransitions(ctx context.Context, from, to time.Time) ([]RegionTransition, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`select event, ifnull(description, ''), lat, lng, timestamp from region_transitions where timestamp > ? and timestamp < ? order by timestamp asc`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("getting region transitions: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []RegionTransition{}
+
+	for rows.Next() {
+		var rt RegionTransition
+		if err := rows.Scan(
+			&rt.Event,
+			&rt.Region,
+			&rt.Lat,
+			&rt.Lng,
+			&rt.Timestamp,
+		); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+
+		ret = append(ret, rt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
+
+// UpsertOTWaypoints persists the regions in a waypoint or waypoints message.
+// A waypoints message is the full list of regions on the device, so any
+// regions previously stored for the device that are not in it are removed.
+func (s *Storage) UpsertOTWaypoints(ctx context.Context, msg owntracksMessage) error {
+	return s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		return upsertOTWaypoints(ctx, tx, msg)
+	})
+}
+
+func upsertOTWaypoints(ctx context.Context, q dbtx, msg owntracksMessage) error {
+	var (
+		wps     []otWaypoint
+		replace bool
+	)
+	switch {
+	case msg.IsWaypoint():
+		wp, err := msg.AsWaypoint()
+		if err != nil {
+			return err
+		}
+		wps = []otWaypoint{wp}
+	case msg.IsWaypoints():
+		wpl, err := msg.AsWaypoints()
+		if err != nil {
+			return err
+		}
+		wps = wpl.Waypoints
+		replace = true
+	default:
+		return fmt.Errorf("message needs to be waypoint or waypoints")
+	}
+
+	var keep []interface{}
+	for _, wp := range wps {
+		_, err := q.ExecContext(ctx, `
+insert into regions(id, name, lat, lng, radius, region_id, topic, timestamp, raw_owntracks_message) values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+on conflict(topic, timestamp) do update
+  set name = ?, lat = ?, lng = ?, radius = ?, region_id = ?, raw_owntracks_message = ?
+where topic=? and timestamp=?`,
+			newDBID(), wp.Description, wp.Latitude, wp.Longitude, wp.Radius, wp.RegionID, msg.Topic, wp.Timestamp(), string(wp.raw), // insert
+			wp.Description, wp.Latitude, wp.Longitude, wp.Radius, wp.RegionID, string(wp.raw), // update
+			msg.Topic, wp.Timestamp()) // where
+		if err != nil {
+			return fmt.Errorf("upserting region %s: %v", wp.Description, err)
+		}
+		keep = append(keep, wp.Timestamp())
+	}
+
+	if replace {
+		stmt := `delete from regions where topic = ?`
+		if len(keep) > 0 {
+			stmt += ` and timestamp not in (?` + strings.Repeat(`, ?`, len(keep)-1) + `)`
+		}
+		if _, err := q.ExecContext(ctx, stmt, append([]interface{}{msg.Topic}, keep...)...); err != nil {
+			return fmt.Errorf("removing old regions: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Regions returns the regions defined on devices by the given time, that
+// match the filter. Regions aren't imported, so none match a filter on an
+// import.
+func (s *Storage) Regions(ctx context.Context, to time.Time, filter LocationFilter) ([]Region, error) {
+	ret := []Region{}
+	if filter.Import != "" {
+		return ret, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`select ifnull(name, ''), lat, lng, ifnull(radius, 0), topic, timestamp from regions order by name asc`)
+	if err != nil {
+		return nil, fmt.Errorf("getting regions: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Region
+		if err := rows.Scan(
+			&r.Name,
+			&r.Lat,
+			&r.Lng,
+			&r.Radius,
+			&r.Topic,
+			&r.Timestamp,
+		); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+
+		// timestamps are in whatever zone the device was in, so compare
+		// them as times
+		if !r.Timestamp.Before(to) {
+			continue
+		}
+		u, d, _ := otTopicUserDevice(r.Topic)
+		if (filter.User != "" && u != filter.User) || (filter.Device != "" && d != filter.Device) {
+			continue
+		}
+
+		ret = append(ret, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
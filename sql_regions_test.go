@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegionTransitions(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	om := owntracksMessage{}
+	if err := json.Unmarshal([]byte(egOwntracksTransition), &om); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddOTTransition(ctx, om); err != nil {
+		t.Fatal(err)
+	}
+
+	trs, err := s.RegionTransitions(ctx, time.Unix(1592691000, 0), time.Unix(1592692000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trs) != 1 {
+		t.Fatalf("want one transition, got: %d", len(trs))
+	}
+	if trs[0].Event != "enter" || trs[0].Region != "Home" {
+		t.Errorf("want enter Home, got: %s %s", trs[0].Event, trs[0].Region)
+	}
+
+	trs, err = s.RegionTransitions(ctx, time.Unix(1592692000, 0), time.Unix(1592693000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trs) != 0 {
+		t.Errorf("want no transitions outside range, got: %d", len(trs))
+	}
+}
+
+func TestUpsertOTWaypoints(t *testing.T) {
+	ctx, s := setupDB(t)
+
+	for _, tc := range []struct {
+		msg  string
+		want []string
+	}{
+		{
+			msg:  `{"_type":"waypoint","desc":"Home","lat":36.1627,"lon":86.7816,"rad":50,"tst":1592000000}`,
+			want: []string{"Home"},
+		},
+		{
+			// same creation time, so should update
+			msg:  `{"_type":"waypoint","desc":"House","lat":36.1627,"lon":86.7816,"rad":50,"tst":1592000000}`,
+			want: []string{"House"},
+		},
+		{
+			msg:  `{"_type":"waypoint","desc":"Office","lat":36.1,"lon":86.7,"rad":100,"tst":1592000100}`,
+			want: []string{"House", "Office"},
+		},
+		{
+			// full export, should replace what we have
+			msg: `{"_type":"waypoints","waypoints":[
+				{"_type":"waypoint","desc":"Office","lat":36.1,"lon":86.7,"rad":100,"tst":1592000100},
+				{"_type":"waypoint","desc":"Gym","lat":36.2,"lon":86.8,"rad":20,"tst":1592000200}
+			]}`,
+			want: []string{"Gym", "Office"},
+		},
+	} {
+		om := owntracksMessage{}
+		if err := json.Unmarshal([]byte(tc.msg), &om); err != nil {
+			t.Fatal(err)
+		}
+		om.Topic = "owntracks/jane/phone"
+
+		if err := s.UpsertOTWaypoints(ctx, om); err != nil {
+			t.Fatal(err)
+		}
+
+		regs, err := s.Regions(ctx, time.Now(), LocationFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range regs {
+			got = append(got, r.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("want regions %v, got: %v", tc.want, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		to     time.Time
+		filter LocationFilter
+		want   int
+	}{
+		{name: "user", to: time.Now(), filter: LocationFilter{User: "jane"}, want: 2},
+		{name: "other user", to: time.Now(), filter: LocationFilter{User: "bob"}, want: 0},
+		{name: "other device", to: time.Now(), filter: LocationFilter{User: "jane", Device: "tablet"}, want: 0},
+		{name: "import", to: time.Now(), filter: LocationFilter{ImportFilter: ImportFilter{Import: "x"}}, want: 0},
+		{name: "before gym", to: time.Unix(1592000150, 0), want: 1},
+	} {
+		regs, err := s.Regions(ctx, tc.to, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(regs) != tc.want {
+			t.Errorf("%s: want %d regions, got: %#v", tc.name, tc.want, regs)
+		}
+	}
+}
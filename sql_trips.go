@@ -54,3 +54,109 @@ func (s *Storage) LatestTripitID(ctx context.Context) (string, error) {
 	}
 	return tripitID, nil
 }
+
+// UpsertICalTrips stores trips and their segments from an iCalendar feed in a
+// single transaction. They're identified by their UID, so syncing them again
+// updates them. Trips with a TripIt ID are merged with the trip synced from
+// the TripIt API, if there is one. Imports leave trips and segments that are
+// already stored unchanged.
+func (s *Storage) UpsertICalTrips(ctx context.Context, trips []icalTrip, segments []icalSegment) error {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		// segments reference their trip by UID, which an import doesn't add
+		// to a trip synced from the API
+		tripIDs := map[string]string{}
+		for _, t := range trips {
+			id, err := icalTripID(ctx, tx, t)
+			if err != nil {
+				return err
+			}
+			switch {
+			case id == "":
+				id = newDBID()
+				if _, err := tx.ExecContext(ctx, `
+insert into trips(id, tripit_id, ical_uid, ical_raw, name, start_date, end_date, primary_location, description, import_id) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+					id, nullString(t.TripitID), t.UID, t.Raw, t.Name, t.StartDate, t.EndDate, t.PrimaryLocation, t.Description, ctxImportID(ctx)); err != nil {
+					return fmt.Errorf("inserting trip %s: %v", t.UID, err)
+				}
+			case ctxImportID(ctx) == nil:
+				if _, err := tx.ExecContext(ctx, `
+update trips
+  set tripit_id = ifnull(tripit_id, ?), ical_uid = ?, ical_raw = ?, name = ?, start_date = ?, end_date = ?,
+  primary_location = ?, description = ?
+where id = ?`,
+					nullString(t.TripitID), t.UID, t.Raw, t.Name, t.StartDate, t.EndDate, t.PrimaryLocation, t.Description, id); err != nil {
+					return fmt.Errorf("updating trip %s: %v", t.UID, err)
+				}
+			}
+			tripIDs[t.UID] = id
+		}
+
+		for _, sg := range segments {
+			var tripID *string
+			if sg.TripUID != "" {
+				id, ok := tripIDs[sg.TripUID]
+				if !ok {
+					if err := tx.QueryRowContext(ctx, `select id from trips where ical_uid = ?`, sg.TripUID).Scan(&id); err != nil {
+						return fmt.Errorf("finding trip %s: %v", sg.TripUID, err)
+					}
+				}
+				tripID = &id
+			}
+			var start, end *time.Time
+			if !sg.StartTime.IsZero() {
+				start = &sg.StartTime
+			}
+			if !sg.EndTime.IsZero() {
+				end = &sg.EndTime
+			}
+			if _, err := tx.ExecContext(ctx, `
+insert into trip_segments(id, trip_id, ical_uid, type, summary, description, location, lat, lng, start_time, end_time, ical_raw, import_id) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+on conflict(ical_uid) `+onConflictUpdate(ctx, `
+  trip_id = excluded.trip_id, type = excluded.type, summary = excluded.summary, description = excluded.description,
+  location = excluded.location, lat = excluded.lat, lng = excluded.lng, start_time = excluded.start_time, end_time = excluded.end_time,
+  ical_raw = excluded.ical_raw`),
+				newDBID(), tripID, sg.UID, sg.Type, sg.Summary, sg.Description, sg.Location, sg.Lat, sg.Lng, start, end, sg.Raw, ctxImportID(ctx)); err != nil {
+				return fmt.Errorf("upserting trip segment %s: %v", sg.UID, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("running tx: %v", err)
+	}
+	return nil
+}
+
+// icalTripID returns the ID of the stored trip the iCalendar trip is, empty if
+// it's new. If it was stored from the feed before it was synced from the
+// TripIt API, the feed's copy is merged in to the API's, unless this is an
+// import, which keeps using the feed's copy.
+func icalTripID(ctx context.Context, tx *sql.Tx, t icalTrip) (string, error) {
+	var icalID, apiID string
+	if err := tx.QueryRowContext(ctx, `select id from trips where ical_uid = ?`, t.UID).Scan(&icalID); err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("finding trip %s: %v", t.UID, err)
+	}
+	if t.TripitID != "" {
+		if err := tx.QueryRowContext(ctx, `select id from trips where tripit_id = ?`, t.TripitID).Scan(&apiID); err != nil && err != sql.ErrNoRows {
+			return "", fmt.Errorf("finding tripit trip %s: %v", t.TripitID, err)
+		}
+	}
+
+	switch {
+	case apiID == "":
+		return icalID, nil
+	case icalID == "" || icalID == apiID:
+		return apiID, nil
+	case ctxImportID(ctx) != nil:
+		return icalID, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `update trip_segments set trip_id = ? where trip_id = ?`, apiID, icalID); err != nil {
+		return "", fmt.Errorf("moving segments of trip %s: %v", t.UID, err)
+	}
+	if _, err := tx.ExecContext(ctx, `delete from trips where id = ?`, icalID); err != nil {
+		return "", fmt.Errorf("deleting duplicate trip %s: %v", t.UID, err)
+	}
+	return apiID, nil
+}
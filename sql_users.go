@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so helpers can be used inside
+// and outside of transactions.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Device is a location tracking device, belonging to a user
+type Device struct {
+	ID   string
+	User string
+	Name string
+}
+
+// ensureDevice returns the ID for the named user's device, creating the user
+// and device if they don't exist yet.
+func ensureDevice(ctx context.Context, q dbtx, username, device string) (string, error) {
+	if username == "" || device == "" {
+		return "", fmt.Errorf("username and device name are required")
+	}
+
+	if _, err := q.ExecContext(ctx,
+		`insert into users(id, username) values (?, ?) on conflict(username) do nothing`,
+		newDBID(), username); err != nil {
+		return "", fmt.Errorf("upserting user %s: %v", username, err)
+	}
+
+	if _, err := q.ExecContext(ctx,
+		`insert into devices(id, user_id, name) select ?, id, ? from users where username = ? on conflict(user_id, name) do nothing`,
+		newDBID(), device, username); err != nil {
+		return "", fmt.Errorf("upserting device %s/%s: %v", username, device, err)
+	}
+
+	var deviceID string
+	if err := q.QueryRowContext(ctx,
+		`select d.id from devices d join users u on (d.user_id = u.id) where u.username = ? and d.name = ?`,
+		username, device).Scan(&deviceID); err != nil {
+		return "", fmt.Errorf("finding device %s/%s: %v", username, device, err)
+	}
+
+	return deviceID, nil
+}
+
+// userID returns the ID of the named user, erroring if they don't exist
+func userID(ctx context.Context, q dbtx, username string) (string, error) {
+	var id string
+	if err := q.QueryRowContext(ctx, `select id from users where username = ?`, username).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("user %s not found", username)
+		}
+		return "", fmt.Errorf("finding user %s: %v", username, err)
+	}
+	return id, nil
+}
+
+// Devices returns all the known devices, ordered by user and device name
+func (s *Storage) Devices(ctx context.Context) ([]Device, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`select d.id, u.username, d.name from devices d join users u on (d.user_id = u.id) order by u.username, d.name`)
+	if err != nil {
+		return nil, fmt.Errorf("getting devices: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []Device{}
+
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.User, &d.Name); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		ret = append(ret, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Sources visits and activity segments can come from, stored in the source
+// column
+const (
+	sourceGoogleSemantic = "google_semantic" // takeout Semantic Location History
+)
+
+// Visit is a period of time spent at a place
+type Visit struct {
+	PlaceID      string
+	Name         string
+	Address      string
+	SemanticType string
+	Lat          float64
+	Lng          float64
+	StartTime    time.Time
+	EndTime      time.Time
+}
+
+type newVisit struct {
+	Visit
+	Source string
+	Raw    []byte
+}
+
+type newActivitySegment struct {
+	Source       string
+	ActivityType string
+	// Distance in metres, nil if unknown
+	Distance  *int
+	StartLat  float64
+	StartLng  float64
+	EndLat    float64
+	EndLng    float64
+	StartTime time.Time
+	EndTime   time.Time
+	Waypoints [][2]float64 // lng, lat
+	Raw       []byte
+}
+
+// AddVisits stores the visits and activity segments in a single transaction.
+// They are identified by their source, device, time span and where they were,
+// so storing them again updates the existing records. Imports leave existing
+// records as they are. If username and device are set they are attributed to
+// that device.
+func (s *Storage) AddVisits(ctx context.Context, username, device string, visits []newVisit, segments []newActivitySegment) error {
+	err := s.execTx(ctx, func(ctx context.Context, tx *sql.Tx) error {
+		var deviceID *string
+		if username != "" || device != "" {
+			id, err := ensureDevice(ctx, tx, username, device)
+			if err != nil {
+				return err
+			}
+			deviceID = &id
+		}
+
+		for i, v := range visits {
+			if _, err := tx.ExecContext(ctx,
+				`insert into visits(id, source, place_id, name, address, semantic_type, lat, lng, start_time, end_time, device_id, raw, import_id)
+				values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				on conflict(source, ifnull(device_id, ''), start_time, end_time, lat, lng) `+onConflictUpdate(ctx,
+					`place_id=excluded.place_id, name=excluded.name, address=excluded.address, semantic_type=excluded.semantic_type,
+				raw=excluded.raw`),
+				newDBID(), v.Source, nullString(v.PlaceID), nullString(v.Name), nullString(v.Address), nullString(v.SemanticType),
+				v.Lat, v.Lng, v.StartTime.UTC(), v.EndTime.UTC(), deviceID, string(v.Raw), ctxImportID(ctx)); err != nil {
+				return fmt.Errorf("upserting visit %d: %v", i, err)
+			}
+		}
+
+		for i, a := range segments {
+			var waypoints *string
+			if len(a.Waypoints) > 0 {
+				wb, err := json.Marshal(a.Waypoints)
+				if err != nil {
+					return fmt.Errorf("marshaling activity segment %d waypoints: %v", i, err)
+				}
+				w := string(wb)
+				waypoints = &w
+			}
+			if _, err := tx.ExecContext(ctx,
+				`insert into activity_segments(id, source, activity_type, distance, start_lat, start_lng, end_lat, end_lng, start_time, end_time, waypoints, device_id, raw, import_id)
+				values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				on conflict(source, ifnull(device_id, ''), start_time, end_time,
+					ifnull(start_lat, ''), ifnull(start_lng, ''), ifnull(end_lat, ''), ifnull(end_lng, '')) `+onConflictUpdate(ctx,
+					`activity_type=excluded.activity_type, distance=excluded.distance,
+				waypoints=excluded.waypoints, raw=excluded.raw`),
+				newDBID(), a.Source, nullString(a.ActivityType), a.Distance, a.StartLat, a.StartLng, a.EndLat, a.EndLng,
+				a.StartTime.UTC(), a.EndTime.UTC(), waypoints, deviceID, string(a.Raw), ctxImportID(ctx)); err != nil {
+				return fmt.Errorf("upserting activity segment %d: %v", i, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("running tx: %v", err)
+	}
+	return nil
+}
+
+// Visits returns the visits that overlap the given time range and match the
+// filter, ordered by when they started
+func (s *Storage) Visits(ctx context.Context, from, to time.Time, filter LocationFilter) ([]Visit, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`select ifnull(v.place_id, ''), ifnull(v.name, ''), ifnull(v.address, ''), ifnull(v.semantic_type, ''), v.lat, v.lng, v.start_time, v.end_time
+		from visits v
+		left outer join devices d on (v.device_id = d.id)
+		left outer join users u on (d.user_id = u.id)
+		where v.start_time < ? and v.end_time > ?
+		  and (? = '' or u.username = ?)
+		  and (? = '' or d.name = ?)
+		  and (? = '' or v.import_id = ?)
+		  and (? = '' or ifnull(v.import_id, '') != ?)
+		order by v.start_time asc`, to.UTC(), from.UTC(),
+		filter.User, filter.User, filter.Device, filter.Device,
+		filter.Import, filter.Import, filter.HideImport, filter.HideImport)
+	if err != nil {
+		return nil, fmt.Errorf("getting visits: %v", err)
+	}
+	defer rows.Close()
+
+	ret := []Visit{}
+	for rows.Next() {
+		var v Visit
+		if err := rows.Scan(&v.PlaceID, &v.Name, &v.Address, &v.SemanticType, &v.Lat, &v.Lng, &v.StartTime, &v.EndTime); err != nil {
+			return nil, fmt.Errorf("scanning row: %v", err)
+		}
+		ret = append(ret, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows err: %v", err)
+	}
+
+	return ret, nil
+}
+
+// nullString returns nil for an empty string, so it's stored as null
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
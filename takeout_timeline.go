@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Google moved location history on to devices, and the exports from there
+// replace the takeout Records.json. The Android export (Timeline.json) is an
+// object with semanticSegments and rawSignals arrays, and writes coordinates
+// like "52.5200000°, 13.4050000°". The iOS export (location-history.json) is a
+// top level array of segments, with coordinates like "geo:52.520000,13.405000"
+// and numbers as strings.
+
+// timelineSegment is a period of time on the timeline. It has one of a path,
+// visit or activity.
+type timelineSegment struct {
+	StartTime    string              `json:"startTime"`
+	EndTime      string              `json:"endTime"`
+	TimelinePath []timelinePathPoint `json:"timelinePath"`
+	Visit        *timelineVisit      `json:"visit"`
+	Activity     *timelineActivity   `json:"activity"`
+}
+
+type timelinePathPoint struct {
+	Point timelineLatLng `json:"point"`
+	// Android sets the time of the point
+	Time string `json:"time"`
+	// iOS sets how long after the segment started the point was at
+	DurationMinutesOffsetFromStartTime string `json:"durationMinutesOffsetFromStartTime"`
+
+	raw json.RawMessage
+}
+
+func (t *timelinePathPoint) UnmarshalJSON(b []byte) error {
+	type alias timelinePathPoint
+	var a alias
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	*t = timelinePathPoint(a)
+	t.raw = append(json.RawMessage{}, b...)
+	return nil
+}
+
+type timelineVisit struct {
+	TopCandidate struct {
+		PlaceID      string         `json:"placeId"`
+		SemanticType string         `json:"semanticType"`
+		Location     timelineLatLng `json:"placeLocation"`
+	} `json:"topCandidate"`
+}
+
+type timelineActivity struct {
+	Start        timelineLatLng `json:"start"`
+	End          timelineLatLng `json:"end"`
+	TopCandidate struct {
+		Type string `json:"type"`
+	} `json:"topCandidate"`
+}
+
+// timelineRawSignal is an entry in the Android rawSignals array. We only use
+// the positions, it also has wifi scans and activity records.
+type timelineRawSignal struct {
+	Position *struct {
+		LatLng               timelineLatLng `json:"LatLng"`
+		AccuracyMeters       *float64       `json:"accuracyMeters"`
+		AltitudeMeters       *float64       `json:"altitudeMeters"`
+		SpeedMetersPerSecond *float64       `json:"speedMetersPerSecond"`
+		Timestamp            string         `json:"timestamp"`
+	} `json:"position"`
+}
+
+// timelineLatLng is a coordinate in either export's format. Android sometimes
+// wraps it in an object, e.g {"latLng": "..."}.
+type timelineLatLng struct {
+	Lat   float64
+	Lng   float64
+	Valid bool
+}
+
+func (t *timelineLatLng) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var o struct {
+			LatLng string `json:"latLng"`
+		}
+		if err := json.Unmarshal(b, &o); err != nil {
+			return fmt.Errorf("coordinate %s is not a string or object", string(b))
+		}
+		s = o.LatLng
+	}
+	if s == "" {
+		*t = timelineLatLng{}
+		return nil
+	}
+	lat, lng, err := parseTimelineLatLng(s)
+	if err != nil {
+		return err
+	}
+	*t = timelineLatLng{Lat: lat, Lng: lng, Valid: true}
+	return nil
+}
+
+// parseTimelineLatLng parses "52.52°, 13.405°" or "geo:52.52,13.405"
+func parseTimelineLatLng(s string) (lat, lng float64, _ error) {
+	c := strings.ReplaceAll(strings.TrimPrefix(s, "geo:"), "°", "")
+	latS, lngS, ok := strings.Cut(c, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid coordinate %q", s)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latS), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude in %q", s)
+	}
+	lng, err = strconv.ParseFloat(strings.TrimSpace(lngS), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude in %q", s)
+	}
+	return lat, lng, nil
+}
+
+// timelineLocations converts a record from the array with the given key to the
+// locations in it. Records without locations return none.
+func timelineLocations(kind string, raw json.RawMessage) ([]newDeviceLocation, error) {
+	switch kind {
+	case takeoutKindSemanticSegments:
+		var seg timelineSegment
+		if err := json.Unmarshal(raw, &seg); err != nil {
+			return nil, fmt.Errorf("unmarshaling segment: %v", err)
+		}
+		return seg.locations(raw)
+	case takeoutKindRawSignals:
+		var sig timelineRawSignal
+		if err := json.Unmarshal(raw, &sig); err != nil {
+			return nil, fmt.Errorf("unmarshaling raw signal: %v", err)
+		}
+		if sig.Position == nil {
+			return nil, nil
+		}
+		p := sig.Position
+		if !p.LatLng.Valid {
+			return nil, fmt.Errorf("position has no coordinates")
+		}
+		ts, err := time.Parse(time.RFC3339, p.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("parsing position timestamp: %v", err)
+		}
+		ts = ts.UTC()
+		loc := newDeviceLocation{
+			Source:    sourceGoogleTimeline,
+			Lat:       p.LatLng.Lat,
+			Lng:       p.LatLng.Lng,
+			Timestamp: ts,
+			Accuracy:  knownMeasurement(p.AccuracyMeters, 1),
+			Altitude:  scaledMeasurement(p.AltitudeMeters, 1),
+			Velocity:  knownMeasurement(p.SpeedMetersPerSecond, 3.6),
+			Raw:       raw,
+		}
+		return []newDeviceLocation{loc}, validLatLng(loc.Lat, loc.Lng)
+	default:
+		return nil, fmt.Errorf("unknown record kind %s", kind)
+	}
+}
+
+// locations returns the points on the segment's path, or the start and end of
+// a visit or activity.
+func (s *timelineSegment) locations(raw json.RawMessage) ([]newDeviceLocation, error) {
+	if len(s.TimelinePath) == 0 && s.Visit == nil && s.Activity == nil {
+		// e.g timeline memories, which don't have any locations
+		return nil, nil
+	}
+
+	// times are in the zone they were recorded in, store them in UTC like
+	// other sources
+	start, err := time.Parse(time.RFC3339, s.StartTime)
+	if err != nil {
+		return nil, fmt.Errorf("parsing segment start time: %v", err)
+	}
+	start = start.UTC()
+	end, err := time.Parse(time.RFC3339, s.EndTime)
+	if err != nil {
+		return nil, fmt.Errorf("parsing segment end time: %v", err)
+	}
+	end = end.UTC()
+
+	var ret []newDeviceLocation
+	add := func(ll timelineLatLng, ts time.Time, raw json.RawMessage) error {
+		if !ll.Valid {
+			return nil
+		}
+		if err := validLatLng(ll.Lat, ll.Lng); err != nil {
+			return err
+		}
+		ret = append(ret, newDeviceLocation{
+			Source:    sourceGoogleTimeline,
+			Lat:       ll.Lat,
+			Lng:       ll.Lng,
+			Timestamp: ts,
+			Raw:       raw,
+		})
+		return nil
+	}
+
+	for i, p := range s.TimelinePath {
+		var ts time.Time
+		switch {
+		case p.Time != "":
+			if ts, err = time.Parse(time.RFC3339, p.Time); err != nil {
+				return nil, fmt.Errorf("parsing path point %d time: %v", i, err)
+			}
+			ts = ts.UTC()
+		case p.DurationMinutesOffsetFromStartTime != "":
+			mins, err := strconv.ParseFloat(p.DurationMinutesOffsetFromStartTime, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing path point %d offset: %v", i, err)
+			}
+			ts = start.Add(time.Duration(mins * float64(time.Minute)))
+		default:
+			return nil, fmt.Errorf("path point %d has no time", i)
+		}
+		if err := add(p.Point, ts, p.raw); err != nil {
+			return nil, fmt.Errorf("path point %d: %v", i, err)
+		}
+	}
+
+	if s.Visit != nil {
+		// we were at the place for the whole visit
+		if err := add(s.Visit.TopCandidate.Location, start, raw); err != nil {
+			return nil, fmt.Errorf("visit: %v", err)
+		}
+		if err := add(s.Visit.TopCandidate.Location, end, raw); err != nil {
+			return nil, fmt.Errorf("visit: %v", err)
+		}
+	}
+
+	if s.Activity != nil {
+		if err := add(s.Activity.Start, start, raw); err != nil {
+			return nil, fmt.Errorf("activity start: %v", err)
+		}
+		if err := add(s.Activity.End, end, raw); err != nil {
+			return nil, fmt.Errorf("activity end: %v", err)
+		}
+	}
+
+	return ret, nil
+}
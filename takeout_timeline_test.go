@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const egAndroidTimeline = `{
+  "semanticSegments": [
+    {
+      "startTime": "2024-01-01T08:00:00.000+01:00",
+      "endTime": "2024-01-01T10:00:00.000+01:00",
+      "timelinePath": [
+        {"point": "52.5200000°, 13.4050000°", "time": "2024-01-01T08:05:00.000+01:00"},
+        {"point": "52.5210000°, 13.4060000°", "time": "2024-01-01T08:07:00.000+01:00"}
+      ]
+    },
+    {
+      "startTime": "2024-01-01T08:10:00.000+01:00",
+      "endTime": "2024-01-01T09:00:00.000+01:00",
+      "visit": {"hierarchyLevel": 0, "probability": 0.9, "topCandidate": {"placeId": "abc", "semanticType": "HOME", "probability": 0.8, "placeLocation": {"latLng": "52.5300000°, 13.4100000°"}}}
+    },
+    {
+      "startTime": "2024-01-01T09:00:00.000+01:00",
+      "endTime": "2024-01-01T09:30:00.000+01:00",
+      "activity": {"start": {"latLng": "52.5300000°, 13.4100000°"}, "end": {"latLng": "52.5400000°, 13.4200000°"}, "distanceMeters": 1500.5, "topCandidate": {"type": "IN_PASSENGER_VEHICLE", "probability": 0.9}}
+    },
+    {
+      "startTime": "2024-01-01T00:00:00.000+01:00",
+      "endTime": "2024-01-02T00:00:00.000+01:00",
+      "timelineMemory": {"destinations": [{"identifier": "xyz"}]}
+    }
+  ],
+  "rawSignals": [
+    {"position": {"LatLng": "52.5500000°, 13.4300000°", "accuracyMeters": 13, "altitudeMeters": 50.1, "source": "WIFI", "timestamp": "2024-01-01T11:00:00.000+01:00", "speedMetersPerSecond": 2.5}},
+    {"wifiScan": {"deliveryTime": "2024-01-01T11:00:00.000+01:00", "devicesRecords": []}}
+  ],
+  "userLocationProfile": {"frequentPlaces": []}
+}`
+
+const egIOSTimeline = `[
+  {
+    "startTime": "2024-01-01T08:00:00.000+01:00",
+    "endTime": "2024-01-01T10:00:00.000+01:00",
+    "timelinePath": [
+      {"point": "geo:52.520000,13.405000", "durationMinutesOffsetFromStartTime": "5"},
+      {"point": "geo:52.521000,13.406000", "durationMinutesOffsetFromStartTime": "7"}
+    ]
+  },
+  {
+    "startTime": "2024-01-01T08:10:00.000+01:00",
+    "endTime": "2024-01-01T09:00:00.000+01:00",
+    "visit": {"hierarchyLevel": "0", "topCandidate": {"probability": "0.9", "semanticType": "Home", "placeID": "abc", "placeLocation": "geo:52.530000,13.410000"}, "probability": "0.8"}
+  },
+  {
+    "startTime": "2024-01-01T09:00:00.000+01:00",
+    "endTime": "2024-01-01T09:30:00.000+01:00",
+    "activity": {"start": "geo:52.530000,13.410000", "end": "geo:52.540000,13.420000", "topCandidate": {"type": "in passenger vehicle", "probability": "0.9"}, "distanceMeters": "1500.5"}
+  }
+]`
+
+func TestTakeoutImportTimeline(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		wantLocs int
+	}{
+		// the end of the visit is the same point as the start of the
+		// activity, so is only stored once
+		{name: "android", file: egAndroidTimeline, wantLocs: 6},
+		{name: "ios", file: egIOSTimeline, wantLocs: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, s := setupDB(t)
+
+			path := filepath.Join(t.TempDir(), "timeline.json")
+			if err := os.WriteFile(path, []byte(tc.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := &takeoutimportCommand{
+				log:       log.New(os.Stderr, "", log.LstdFlags),
+				filePath:  path,
+				username:  "jane",
+				device:    "pixel",
+				batchSize: 3,
+				store:     s,
+			}
+			if err := cmd.run(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			locs, err := s.RecentLocations(ctx, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), LocationFilter{User: "jane", Device: "pixel"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(locs) != tc.wantLocs {
+				t.Fatalf("want %d locations, got %d", tc.wantLocs, len(locs))
+			}
+
+			first := locs[0]
+			if first.Lat != 52.52 || first.Lng != 13.405 || !first.Timestamp.Equal(time.Date(2024, 1, 1, 7, 5, 0, 0, time.UTC)) {
+				t.Errorf("unexpected first path point: %#v", first)
+			}
+
+			// re-importing shouldn't add anything
+			if err := cmd.run(ctx); err != nil {
+				t.Fatal(err)
+			}
+			var count int
+			if err := s.db.QueryRowContext(ctx, `select count(*) from device_locations where source = ?`, sourceGoogleTimeline).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != tc.wantLocs {
+				t.Errorf("want %d locations after re-import, got %d", tc.wantLocs, count)
+			}
+		})
+	}
+}
+
+func TestParseTimelineLatLng(t *testing.T) {
+	for _, s := range []string{
+		"52.5200000°, -13.4050000°",
+		"geo:52.520000,-13.405000",
+	} {
+		lat, lng, err := parseTimelineLatLng(s)
+		if err != nil {
+			t.Errorf("parsing %s: %v", s, err)
+			continue
+		}
+		if lat != 52.52 || lng != -13.405 {
+			t.Errorf("parsing %s: want 52.52,-13.405, got %f,%f", s, lat, lng)
+		}
+	}
+
+	if _, _, err := parseTimelineLatLng("52.52"); err == nil {
+		t.Error("want error for coordinate without longitude")
+	}
+}
+
+func TestTimelineLocationsUTC(t *testing.T) {
+	for _, tc := range []struct {
+		kind string
+		raw  string
+	}{
+		{
+			kind: takeoutKindSemanticSegments,
+			raw:  `{"startTime": "2024-01-01T08:00:00.000+01:00", "endTime": "2024-01-01T09:00:00.000+01:00", "timelinePath": [{"point": "52.52°, 13.405°", "time": "2024-01-01T08:05:00.000+01:00"}, {"point": "52.52°, 13.405°", "durationMinutesOffsetFromStartTime": "5"}]}`,
+		},
+		{
+			kind: takeoutKindRawSignals,
+			raw:  `{"position": {"LatLng": "52.52°, 13.405°", "timestamp": "2024-01-01T08:05:00.000+01:00"}}`,
+		},
+	} {
+		locs, err := timelineLocations(tc.kind, json.RawMessage(tc.raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locs) == 0 {
+			t.Fatalf("%s: want locations", tc.kind)
+		}
+		for _, l := range locs {
+			if want := time.Date(2024, 1, 1, 7, 5, 0, 0, time.UTC); l.Timestamp != want {
+				t.Errorf("%s: want %s, got %s", tc.kind, want, l.Timestamp)
+			}
+		}
+	}
+}
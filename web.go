@@ -45,6 +45,12 @@ type indexData struct {
 	DeviceLocations    template.JS
 	DeviceLocationLine template.JS
 	Checkins           template.JS
+	Regions            template.JS
+	Visits             template.JS
+	Photos             template.JS
+
+	// Activities are the most likely activities for the locations shown
+	Activities []ActivityTotal
 
 	From string
 	To   string
@@ -52,6 +58,17 @@ type indexData struct {
 	Accuracy int
 
 	Line bool
+
+	// Users and Devices that can be filtered by, with the selected one
+	Users   []string
+	User    string
+	Devices []string
+	Device  string
+
+	// Imports that can be shown alone or hidden, with the selected ones
+	Imports    []Import
+	Import     string
+	HideImport string
 }
 
 func (w *web) index(rw http.ResponseWriter, r *http.Request) {
@@ -101,38 +118,127 @@ func (w *web) index(rw http.ResponseWriter, r *http.Request) {
 		drawLine = true
 	}
 
+	// devices are identified as user/device, so one param can select it
+	filter := LocationFilter{
+		User: r.URL.Query().Get("user"),
+		ImportFilter: ImportFilter{
+			Import:     r.URL.Query().Get("import"),
+			HideImport: r.URL.Query().Get("hide_import"),
+		},
+	}
+	if d := r.URL.Query().Get("device"); d != "" {
+		u, dn, ok := strings.Cut(d, "/")
+		if !ok {
+			http.Error(rw, "device should be in the form user/device", http.StatusBadRequest)
+			return
+		}
+		filter.User = u
+		filter.Device = dn
+	}
+
+	devs, err := w.store.Devices(r.Context())
+	if err != nil {
+		w.log.Printf("getting devices: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var (
+		users   []string
+		devices []string
+	)
+	for _, d := range devs {
+		if len(users) == 0 || users[len(users)-1] != d.User {
+			users = append(users, d.User)
+		}
+		devices = append(devices, d.User+"/"+d.Name)
+	}
+
+	allImps, err := w.store.Imports(r.Context())
+	if err != nil {
+		w.log.Printf("getting imports: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// rolled back imports have nothing left to show
+	var imps []Import
+	for _, im := range allImps {
+		if im.RolledBackAt == nil {
+			imps = append(imps, im)
+		}
+	}
+
 	// make it to the end of the "to" day
 	// TODO timezone awareness? Or move to EU where it's all closer to UTC
 	// anyway
-	rl, err := w.store.RecentLocations(r.Context(), from, to.Add(24*time.Hour-1*time.Second))
+	rl, err := w.store.RecentLocations(r.Context(), from, to.Add(24*time.Hour-1*time.Second), filter)
 	if err != nil {
 		w.log.Printf("getting recent locations: %v", err)
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	cis, err := w.store.GetCheckins(r.Context(), from, to.Add(24*time.Hour-1*time.Second))
+	acts, err := w.store.ActivityTotals(r.Context(), from, to.Add(24*time.Hour-1*time.Second), filter)
+	if err != nil {
+		w.log.Printf("getting activity totals: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cis, err := w.store.GetCheckins(r.Context(), from, to.Add(24*time.Hour-1*time.Second), filter.ImportFilter)
 	if err != nil {
 		w.log.Printf("getting checkins: %v", err)
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	vis, err := w.store.Visits(r.Context(), from, to.Add(24*time.Hour-1*time.Second), filter)
+	if err != nil {
+		w.log.Printf("getting visits: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	phs, err := w.store.Photos(r.Context(), from, to.Add(24*time.Hour-1*time.Second), filter)
+	if err != nil {
+		w.log.Printf("getting photos: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	regs, err := w.store.Regions(r.Context(), to.Add(24*time.Hour-1*time.Second), filter)
+	if err != nil {
+		w.log.Printf("getting regions: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	deviceLocations := geojson.NewFeatureCollection()
 	linePoints := [][]float64{}
 	checkins := geojson.NewFeatureCollection()
+	regions := geojson.NewFeatureCollection()
+	visits := geojson.NewFeatureCollection()
+	photos := geojson.NewFeatureCollection()
 
 	for _, l := range rl {
+		if l.Source == sourcePhoto {
+			// these are shown on their own layer
+			continue
+		}
 		if l.Accuracy <= accuracy {
 			vel := 0
 			if l.Velocity != nil {
 				vel = *l.Velocity
 			}
+			popup := fmt.Sprintf("At: %s<br>Velocity: %d km/h", l.Timestamp.String(), vel)
+			if l.Activity != "" {
+				popup += "<br>Activity: " + template.HTMLEscapeString(l.Activity)
+			}
 			deviceLocations.AddFeature(&geojson.Feature{
 				Geometry: geojson.NewPointGeometry([]float64{l.Lng, l.Lat}),
 				Properties: map[string]interface{}{
 					"accuracy":     l.Accuracy,
-					"popupContent": fmt.Sprintf("At: %s<br>Velocity: %d km/h", l.Timestamp.String(), vel),
+					"activity":     l.Activity,
+					"popupContent": popup,
 				},
 			})
 			if drawLine {
@@ -153,6 +259,41 @@ func (w *web) index(rw http.ResponseWriter, r *http.Request) {
 
 	}
 
+	for _, v := range vis {
+		name := v.Name
+		if name == "" {
+			name = v.Address
+		}
+		visits.AddFeature(&geojson.Feature{
+			Geometry: geojson.NewPointGeometry([]float64{v.Lng, v.Lat}),
+			Properties: map[string]interface{}{
+				// tooltips are HTML too
+				"name":         template.HTMLEscapeString(name),
+				"popupContent": fmt.Sprintf("At: %s<br>Address: %s<br>From: %s<br>To: %s", template.HTMLEscapeString(v.Name), template.HTMLEscapeString(v.Address), v.StartTime.String(), v.EndTime.String()),
+			},
+		})
+	}
+
+	for _, p := range phs {
+		photos.AddFeature(&geojson.Feature{
+			Geometry: geojson.NewPointGeometry([]float64{p.Lng, p.Lat}),
+			Properties: map[string]interface{}{
+				"popupContent": fmt.Sprintf("Photo: %s<br>Taken: %s", template.HTMLEscapeString(p.Path), p.TakenAt.String()),
+			},
+		})
+	}
+
+	for _, rg := range regs {
+		regions.AddFeature(&geojson.Feature{
+			Geometry: geojson.NewPointGeometry([]float64{rg.Lng, rg.Lat}),
+			Properties: map[string]interface{}{
+				// tooltips are HTML, and any device can name a region
+				"name":   template.HTMLEscapeString(rg.Name),
+				"radius": rg.Radius,
+			},
+		})
+	}
+
 	geoJSON, err := json.Marshal(deviceLocations)
 	if err != nil {
 		w.log.Printf("marshaling geoJSON: %v", err)
@@ -174,10 +315,36 @@ func (w *web) index(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	regionsJSON, err := json.Marshal(regions)
+	if err != nil {
+		w.log.Printf("marshaling regionsJSON: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	visitsJSON, err := json.Marshal(visits)
+	if err != nil {
+		w.log.Printf("marshaling visitsJSON: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	photosJSON, err := json.Marshal(photos)
+	if err != nil {
+		w.log.Printf("marshaling photosJSON: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	tmpData := indexData{
 		DeviceLocations:    template.JS(geoJSON),
 		DeviceLocationLine: template.JS(lineJSON),
 		Checkins:           template.JS(checkinsJSON),
+		Regions:            template.JS(regionsJSON),
+		Visits:             template.JS(visitsJSON),
+		Photos:             template.JS(photosJSON),
+
+		Activities: acts,
 
 		From: from.Format("2006-01-02"),
 		To:   to.Format("2006-01-02"),
@@ -185,6 +352,15 @@ func (w *web) index(rw http.ResponseWriter, r *http.Request) {
 		Accuracy: accuracy,
 
 		Line: drawLine,
+
+		Users:   users,
+		User:    r.URL.Query().Get("user"),
+		Devices: devices,
+		Device:  r.URL.Query().Get("device"),
+
+		Imports:    imps,
+		Import:     filter.Import,
+		HideImport: filter.HideImport,
 	}
 
 	if err := indexTmpl.Execute(rw, tmpData); err != nil {
@@ -260,6 +436,8 @@ func (w *web) init() {
 		w.mux.HandleFunc("/connect", w.connect)
 		w.mux.HandleFunc("/connect/fsqcallback", w.fsqcallback)
 		w.mux.HandleFunc("/connect/tripitcallback", w.tripitCallback)
+
+		w.mux.Handle("/api/0/", newRecorderAPI(w.log, w.store))
 	})
 }
 